@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
+	"github.com/xsmartdns/xsmartdns/querylog"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/server"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+	// records of the query log api if no limit
+	DEFAULT_QUERY_LOG_LIMIT = 100
+	// max time to wait the outbounds of the trace api
+	TRACE_TIMEOUT = 5 * time.Second
+)
+
+// admin http api server
+type apiServer struct {
+	cfg    config.Api
+	router router.Router
+	// reload config, nil if not supported
+	reload     func() error
+	httpServer *http.Server
+	listener   net.Listener
+	// replaced by reload without rebinding
+	token atomic.Pointer[string]
+}
+
+func NewApiServer(cfg config.Api, router router.Router, reload func() error) server.Server {
+	srv := &apiServer{cfg: cfg, router: router, reload: reload}
+	srv.token.Store(&cfg.Token)
+	return srv
+}
+
+// replace the token of the api server, the listen address is not changed
+func SetToken(srv server.Server, token string) {
+	srv.(*apiServer).token.Store(&token)
+}
+
+func (srv *apiServer) Init() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/groups", srv.listGroups)
+	mux.HandleFunc("GET /api/v1/groups/{group}/cache", srv.listCache)
+	mux.HandleFunc("DELETE /api/v1/groups/{group}/cache", srv.deleteCache)
+	mux.HandleFunc("POST /api/v1/groups/{group}/cache/flush", srv.flushCache)
+	mux.HandleFunc("POST /api/v1/groups/{group}/cache/refresh", srv.refreshCache)
+	mux.HandleFunc("GET /api/v1/speedcheck/stats", srv.speedCheckStats)
+	mux.HandleFunc("POST /api/v1/reload", srv.reloadConfig)
+	mux.HandleFunc("GET /api/v1/querylog", srv.queryLog)
+	mux.HandleFunc("GET /api/v1/trace", srv.trace)
+	mux.Handle("GET /metrics", metrics.Handler())
+	srv.httpServer = &http.Server{Addr: srv.cfg.Listen, Handler: srv.auth(mux)}
+	return nil
+}
+
+func (srv *apiServer) Listen() error {
+	l, err := net.Listen("tcp", srv.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	srv.listener = l
+	return nil
+}
+
+func (srv *apiServer) Start() error {
+	log.Infof("Starting api server on %s", srv.cfg.Listen)
+	if err := srv.httpServer.Serve(srv.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (srv *apiServer) Shutdown() error {
+	log.Infof("Shutdown api server on %s", srv.cfg.Listen)
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := srv.httpServer.Shutdown(ctx)
+	// not closed by the http server if bound but not served
+	if srv.listener != nil {
+		srv.listener.Close()
+	}
+	return err
+}
+
+// check "Authorization: Bearer {token}" header
+func (srv *apiServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*srv.token.Load())) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (srv *apiServer) listGroups(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, srv.router.GroupTags())
+}
+
+func (srv *apiServer) speedCheckStats(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, speedcheck.GetSchedulerStats())
+}
+
+// GET /api/v1/querylog?client=ip&domain=example.com&limit=100
+func (srv *apiServer) queryLog(w http.ResponseWriter, r *http.Request) {
+	filter := &querylog.Filter{Client: r.URL.Query().Get("client"), Domain: r.URL.Query().Get("domain"), Limit: DEFAULT_QUERY_LOG_LIMIT}
+	if limit := r.URL.Query().Get("limit"); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit:%s", limit))
+			return
+		}
+		filter.Limit = n
+	}
+	writeJson(w, querylog.Recent(filter))
+}
+
+// GET /api/v1/trace?name=example.com&type=A&group=tag, resolve and explain the answer
+func (srv *apiServer) trace(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("name is empty"))
+		return
+	}
+	qtype := dns.TypeA
+	if t := r.URL.Query().Get("type"); len(t) > 0 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown type:%s", t))
+			return
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	e, err := router.Explain(srv.router, req, r.URL.Query().Get("group"), nil, TRACE_TIMEOUT)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, e)
+}
+
+func (srv *apiServer) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if srv.reload == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("reload is not supported"))
+		return
+	}
+	if err := srv.reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJson(w, map[string]string{"status": "reloaded"})
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("api write response error:%v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/cache"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/group"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/router"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+type mockRouter struct {
+	// cache of the default group
+	cache *cache.DnsQueryCache
+}
+
+func (r *mockRouter) FindGroupInvoker(*dns.Msg) (group.GroupInvoker, error) {
+	return &mockGroup{cache: r.cache}, nil
+}
+func (r *mockRouter) FindRoute(*dns.Msg, *router.RouteOptions) (*router.Route, error) {
+	return &router.Route{Group: "default", Invoker: &mockGroup{cache: r.cache}}, nil
+}
+func (r *mockRouter) GetGroupInvoker(tag string) (group.GroupInvoker, error) {
+	if tag != "default" {
+		return nil, fmt.Errorf("group:%s not found", tag)
+	}
+	return &mockGroup{cache: r.cache}, nil
+}
+func (r *mockRouter) GroupTags() []string {
+	return []string{"default"}
+}
+func (r *mockRouter) Shutdown() {
+}
+
+type mockGroup struct {
+	cache *cache.DnsQueryCache
+}
+
+func (g *mockGroup) Invoke(r *dns.Msg) (*dns.Msg, error) {
+	return r, nil
+}
+func (g *mockGroup) Cache() *cache.DnsQueryCache {
+	return g.cache
+}
+func (g *mockGroup) Shutdown() {
+}
+
+// request the api server with the token
+func serveTestRequest(srv *apiServer, method, url, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	srv.httpServer.Handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestApiAuth(t *testing.T) {
+	Convey("TestApiAuth", t, func() {
+		srv := NewApiServer(config.Api{Listen: "127.0.0.1:0", Token: "secret"}, &mockRouter{}, nil).(*apiServer)
+		So(srv.Init(), ShouldBeNil)
+		do := func(method, url, token string) *httptest.ResponseRecorder {
+			return serveTestRequest(srv, method, url, token)
+		}
+
+		So(do(http.MethodGet, "/api/v1/groups", "").Code, ShouldEqual, http.StatusUnauthorized)
+		So(do(http.MethodGet, "/api/v1/groups", "wrong").Code, ShouldEqual, http.StatusUnauthorized)
+		w := do(http.MethodGet, "/api/v1/groups", "secret")
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqualJSON, `["default"]`)
+		So(do(http.MethodGet, "/api/v1/groups/other/cache", "secret").Code, ShouldEqual, http.StatusNotFound)
+		So(do(http.MethodPost, "/api/v1/groups/default/cache/flush", "secret").Code, ShouldEqual, http.StatusNotFound)
+	})
+}
+
+func TestApiCache(t *testing.T) {
+	Convey("TestApiCache", t, func() {
+		cfg, err := config.Parse([]byte(`{
+			"inbounds": [{"listen": "127.0.0.1:0"}],
+			"groups": [{"outbounds": [{"setting": {"addr": "127.0.0.1:53"}}], "speedChecks": "none"}]
+		}`))
+		So(err, ShouldBeNil)
+		c, err := cache.NewDnsQueryCache(cfg.Groups[0])
+		So(err, ShouldBeNil)
+		defer c.Shutdown()
+		for _, name := range []string{"example.com.", "www.example.com.", "example.org."} {
+			r := new(dns.Msg)
+			r.SetQuestion(name, dns.TypeA)
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.0")
+			resp.Answer = append(resp.Answer, rr)
+			msg := model.WrapDnsMsg(r)
+			msg.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "10.0.0.0", RtMs: 5}}
+			c.StoreCache(msg, resp)
+		}
+		srv := NewApiServer(config.Api{Listen: "127.0.0.1:0", Token: "secret"}, &mockRouter{cache: c}, nil).(*apiServer)
+		So(srv.Init(), ShouldBeNil)
+		do := func(method, url string) *httptest.ResponseRecorder {
+			return serveTestRequest(srv, method, url, "secret")
+		}
+
+		Convey("list the entries", func() {
+			w := do(http.MethodGet, "/api/v1/groups/default/cache?search=example.com&limit=1")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			ret := struct {
+				Size    int                `json:"size"`
+				Entries []*cache.EntryInfo `json:"entries"`
+			}{}
+			So(json.Unmarshal(w.Body.Bytes(), &ret), ShouldBeNil)
+			So(ret.Size, ShouldEqual, 3)
+			So(ret.Entries, ShouldHaveLength, 1)
+			So(ret.Entries[0].Name, ShouldEqual, "www.example.com.")
+			So(ret.Entries[0].TtlLeft, ShouldBeBetweenOrEqual, 59, 60)
+			So(ret.Entries[0].VisitedTime.IsZero(), ShouldBeFalse)
+			So(ret.Entries[0].SpeedCheckResults, ShouldResemble, []*model.SpeedCheckResult{{Ip: "10.0.0.0", RtMs: 5}})
+			So(do(http.MethodGet, "/api/v1/groups/default/cache?limit=many").Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("delete by the name or suffix", func() {
+			So(do(http.MethodDelete, "/api/v1/groups/default/cache").Code, ShouldEqual, http.StatusBadRequest)
+			w := do(http.MethodDelete, "/api/v1/groups/default/cache?name=example.com")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqualJSON, `{"removed": 1}`)
+			w = do(http.MethodDelete, "/api/v1/groups/default/cache?name=example.com&suffix=true")
+			So(w.Body.String(), ShouldEqualJSON, `{"removed": 1}`)
+			So(c.Len(), ShouldEqual, 1)
+		})
+
+		Convey("flush the group", func() {
+			w := do(http.MethodPost, "/api/v1/groups/default/cache/flush")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqualJSON, `{"removed": 3}`)
+			So(c.Len(), ShouldEqual, 0)
+		})
+
+		Convey("refresh the entry", func() {
+			So(do(http.MethodPost, "/api/v1/groups/default/cache/refresh").Code, ShouldEqual, http.StatusBadRequest)
+			So(do(http.MethodPost, "/api/v1/groups/default/cache/refresh?name=example.com&type=unknown").Code, ShouldEqual, http.StatusBadRequest)
+			// not cached
+			w := do(http.MethodPost, "/api/v1/groups/default/cache/refresh?name=example.net&type=aaaa")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqualJSON, `{"refreshed": 0}`)
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/cache"
+)
+
+// GET /api/v1/groups/{group}/cache?search={keyword}&limit={limit}
+func (srv *apiServer) listCache(w http.ResponseWriter, r *http.Request) {
+	c, err := srv.getCache(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); len(s) > 0 {
+		if limit, err = strconv.Atoi(s); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("illegal limit:%s", s))
+			return
+		}
+	}
+	writeJson(w, map[string]any{
+		"size":       c.Len(),
+		"memoryUsed": c.MemoryUsed(),
+		"entries":    c.List(r.URL.Query().Get("search"), limit),
+	})
+}
+
+// DELETE /api/v1/groups/{group}/cache?name={name}&suffix={true|false}
+func (srv *apiServer) deleteCache(w http.ResponseWriter, r *http.Request) {
+	c, err := srv.getCache(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is empty"))
+		return
+	}
+	suffix, _ := strconv.ParseBool(r.URL.Query().Get("suffix"))
+	writeJson(w, map[string]int{"removed": c.Remove(name, suffix)})
+}
+
+// POST /api/v1/groups/{group}/cache/flush
+func (srv *apiServer) flushCache(w http.ResponseWriter, r *http.Request) {
+	c, err := srv.getCache(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, map[string]int{"removed": c.Flush()})
+}
+
+// POST /api/v1/groups/{group}/cache/refresh?name={name}&type={type}, type default A
+func (srv *apiServer) refreshCache(w http.ResponseWriter, r *http.Request) {
+	c, err := srv.getCache(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name is empty"))
+		return
+	}
+	qtype, err := parseQtype(r.URL.Query().Get("type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	refreshed, err := c.Refresh(name, qtype)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJson(w, map[string]int{"refreshed": refreshed})
+}
+
+func (srv *apiServer) getCache(r *http.Request) (*cache.DnsQueryCache, error) {
+	g, err := srv.router.GetGroupInvoker(r.PathValue("group"))
+	if err != nil {
+		return nil, err
+	}
+	c := g.Cache()
+	if c == nil {
+		return nil, fmt.Errorf("group:%s has no cache", r.PathValue("group"))
+	}
+	return c, nil
+}
+
+func parseQtype(s string) (uint16, error) {
+	if len(s) == 0 {
+		return dns.TypeA, nil
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown type:%s", s)
+	}
+	return qtype, nil
+}
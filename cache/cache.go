@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"math"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -9,7 +12,8 @@ import (
 	"github.com/xsmartdns/xsmartdns/cache/updateinvoke"
 	"github.com/xsmartdns/xsmartdns/config"
 	"github.com/xsmartdns/xsmartdns/log"
-	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
 )
 
 const (
@@ -20,13 +24,40 @@ type DnsQueryCache struct {
 	sync.RWMutex
 	cfg          *config.CacheConfig
 	checkTimer   *time.Ticker
+	persistTimer *time.Ticker
 	cache        *lru.Cache[string, *CacheEntry]
 	updateinvoke *updateinvoke.UpdateInvoker
+	// limit prefetch number per second of all entries
+	prefetchLimiter *ratelimit.Limiter
+	// ECS scopes of the scoped entries
+	scopes map[string]ecsScopes
+	// max memory(bytes) of entries, 0 if the cache is sized by entries number
+	memoryLimit int64
+	memoryUsed  int64
+	shared      *SharedCache
+	// persisted for the replacement cache, not persisted again
+	handedOver atomic.Bool
 }
 
 func NewDnsQueryCache(cfg *config.Group) (*DnsQueryCache, error) {
-	dc := &DnsQueryCache{cfg: cfg.CacheConfig, checkTimer: time.NewTicker(CLEAR_EXPIRED_CACHE_INTERVAL)}
-	c, err := lru.NewWithEvict(int(*cfg.CacheConfig.CacheSize), dc.onEvicted)
+	dc := &DnsQueryCache{cfg: cfg.CacheConfig, checkTimer: time.NewTicker(CLEAR_EXPIRED_CACHE_INTERVAL), scopes: make(map[string]ecsScopes)}
+	size := int(*cfg.CacheConfig.CacheSize)
+	if dc.cfg.CacheMemorySize > 0 || dc.cfg.UseSharedCache {
+		// sized by memory
+		size = math.MaxInt32
+		dc.memoryLimit = dc.cfg.CacheMemorySize
+		if dc.cfg.UseSharedCache && dc.cfg.SharedCacheQuota > 0 && (dc.memoryLimit == 0 || dc.cfg.SharedCacheQuota < dc.memoryLimit) {
+			dc.memoryLimit = dc.cfg.SharedCacheQuota
+		}
+	}
+	if dc.cfg.UseSharedCache {
+		shared, err := getSharedCache()
+		if err != nil {
+			return nil, err
+		}
+		dc.shared = shared
+	}
+	c, err := lru.NewWithEvict(size, dc.onEvicted)
 	if err != nil {
 		return nil, err
 	}
@@ -36,55 +67,225 @@ func NewDnsQueryCache(cfg *config.Group) (*DnsQueryCache, error) {
 		return nil, err
 	}
 	dc.updateinvoke = updateinvoke
+	maxPrefetch := *dc.cfg.MaxPrefetchPerSecond
+	dc.prefetchLimiter = ratelimit.NewLimiter(float64(maxPrefetch), int(maxPrefetch))
+	if dc.shared != nil {
+		dc.shared.register(dc)
+	}
+	if dc.cfg.CachePersist {
+		dc.restore()
+		if *dc.cfg.CacheCheckpointTimeSecond > 0 {
+			dc.persistTimer = time.NewTicker(time.Duration(*dc.cfg.CacheCheckpointTimeSecond) * time.Second)
+			go dc.persistLoop()
+		}
+	}
 	go dc.checkExpiredCacheLoop()
 	return dc, nil
 }
 
-func (c *DnsQueryCache) FindCacheResp(r *dns.Msg) *dns.Msg {
-	key, err := getKey(r)
-	if err != nil {
-		return nil
-	}
-
+// find the cached resp, nil if missed, stale is true if the expired resp is served,
+// the speed check results of the entry are set to r if found
+func (c *DnsQueryCache) FindCacheResp(r *model.Message) (resp *dns.Msg, stale bool) {
 	c.RLock()
-	if !c.cache.Contains(key) {
-		c.RUnlock()
-		return nil
-	}
+	_, ok := c.lookupKey(r.Msg)
 	c.RUnlock()
+	if !ok {
+		return nil, false
+	}
 
 	c.Lock()
-	defer c.Unlock()
-	if !c.cache.Contains(key) {
-		return nil
+	key, ok := c.lookupKey(r.Msg)
+	if !ok {
+		c.Unlock()
+		return nil, false
 	}
 	value, ok := c.cache.Get(key)
+	c.Unlock()
 	if !ok {
-		return nil
+		return nil, false
 	}
-	resp := value.getResp()
+	// may wait for refreshing expired entry, not hold lock
+	resp, stale = value.getResp(r.Msg)
 	if resp == nil {
-		c.cache.Remove(key)
+		c.Lock()
+		if current, ok := c.cache.Peek(key); ok && current == value {
+			c.cache.Remove(key)
+		}
+		c.Unlock()
+		return nil, false
 	}
-	return resp
+	value.RLock()
+	r.SpeedCheckResults = value.speedCheckResults
+	value.RUnlock()
+	return resp, stale
 }
 
-func (c *DnsQueryCache) StoreCache(r, resp *dns.Msg) {
-	key, err := getKey(r)
+func (c *DnsQueryCache) StoreCache(r *model.Message, resp *dns.Msg) {
+	key, scopes, scope, err := getStoreKey(r.Msg, resp)
 	if err != nil {
 		return
 	}
 	c.Lock()
-	defer c.Unlock()
 	if c.cache.Contains(key) {
+		c.Unlock()
 		return
 	}
-	c.cache.Add(key, newCacheEntry(r.Copy(), resp.Copy(), c.updateinvoke, c.cfg))
+	e := newCacheEntry(r.Copy(), resp.Copy(), c.updateinvoke, c.prefetchLimiter, c.cfg)
+	e.scopes, e.scope = scopes, scope
+	e.speedCheckResults = r.SpeedCheckResults
+	c.add(key, e)
+	c.Unlock()
+
+	if c.shared != nil {
+		c.shared.enforce()
+	}
+}
+
+// must hold lock
+func (c *DnsQueryCache) add(key string, e *CacheEntry) {
+	c.addScope(e)
+	e.Lock()
+	e.size = estimateEntrySize(key, e.request, e.resp)
+	e.cache = c
+	c.addMemory(e.size)
+	e.Unlock()
+	c.cache.Add(key, e)
+	c.evictOverLimit()
+}
+
+// evict the oldest entries until the memory is under limit if sized by memory, must hold lock
+func (c *DnsQueryCache) evictOverLimit() {
+	for c.memoryLimit > 0 && c.MemoryUsed() > c.memoryLimit {
+		if _, _, ok := c.cache.RemoveOldest(); !ok {
+			break
+		}
+	}
+}
+
+// evict entries over the memory limit and the shared budget, must not hold any cache lock
+func (c *DnsQueryCache) enforceMemory() {
+	c.Lock()
+	c.evictOverLimit()
+	c.Unlock()
+	if c.shared != nil {
+		c.shared.enforce()
+	}
+}
+
+func (c *DnsQueryCache) addMemory(delta int64) {
+	atomic.AddInt64(&c.memoryUsed, delta)
+	if c.shared != nil {
+		atomic.AddInt64(&c.shared.memoryUsed, delta)
+	}
+}
+
+// estimated memory(bytes) of all entries
+func (c *DnsQueryCache) MemoryUsed() int64 {
+	return atomic.LoadInt64(&c.memoryUsed)
+}
+
+func (c *DnsQueryCache) Len() int {
+	return c.cache.Len()
+}
+
+// remove the oldest entry, return false if the cache is empty
+func (c *DnsQueryCache) evictOldest() bool {
+	c.Lock()
+	defer c.Unlock()
+	_, _, ok := c.cache.RemoveOldest()
+	return ok
 }
 
 func (c *DnsQueryCache) Shutdown() {
 	c.updateinvoke.Shutdown()
 	c.checkTimer.Stop()
+	if c.persistTimer != nil {
+		c.persistTimer.Stop()
+	}
+	if c.cfg.CachePersist && !c.handedOver.Load() {
+		c.persist()
+	}
+	if c.shared != nil {
+		c.shared.unregister(c)
+	}
+}
+
+// persist the entries for the replacement cache to restore from the same file before it is created,
+// the cache is not persisted again so the file is not overwritten by the older entries
+func (c *DnsQueryCache) Handover() {
+	if !c.cfg.CachePersist || c.handedOver.Swap(true) {
+		return
+	}
+	if c.persistTimer != nil {
+		c.persistTimer.Stop()
+	}
+	c.persist()
+}
+
+func (c *DnsQueryCache) persistLoop() {
+	for range c.persistTimer.C {
+		if c.handedOver.Load() {
+			return
+		}
+		c.persist()
+	}
+}
+
+// save all entries to cache file, from oldest to newest
+func (c *DnsQueryCache) persist() {
+	c.RLock()
+	entries := make([]*persistEntry, 0, c.cache.Len())
+	for _, key := range c.cache.Keys() {
+		value, ok := c.cache.Peek(key)
+		if !ok {
+			continue
+		}
+		entry, err := value.toPersistEntry()
+		if err != nil {
+			log.Warnf("persist cache:%s error:%v", key, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	c.RUnlock()
+	if err := writePersistFile(c.cfg.CacheFile, entries); err != nil {
+		log.Errorf("persist cache to file:%s error:%v", c.cfg.CacheFile, err)
+		return
+	}
+	log.Infof("persist %d cache entries to file:%s", len(entries), c.cfg.CacheFile)
+}
+
+// load entries from cache file, start with an empty cache if the file is missing or incompatible
+func (c *DnsQueryCache) restore() {
+	entries, err := readPersistFile(c.cfg.CacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("restore cache from file:%s error:%v, ignore it", c.cfg.CacheFile, err)
+		}
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	restored := 0
+	for _, p := range entries {
+		e, err := restoreCacheEntry(p, c.updateinvoke, c.prefetchLimiter, c.cfg)
+		if err != nil {
+			log.Warnf("restore cache entry error:%v", err)
+			continue
+		}
+		key, scopes, scope, err := getStoreKey(e.request, e.resp)
+		if err != nil || e.vistiedExpired() || (c.cfg.DisableCacheExpired && e.ttlExpired()) {
+			e.clear()
+			continue
+		}
+		e.scopes, e.scope = scopes, scope
+		c.add(key, e)
+		restored++
+	}
+	log.Infof("restore %d cache entries from file:%s", restored, c.cfg.CacheFile)
+	if c.shared != nil {
+		go c.shared.enforce()
+	}
 }
 
 func (c *DnsQueryCache) checkExpiredCacheLoop() {
@@ -115,16 +316,6 @@ func (c *DnsQueryCache) clearExpiredCache() {
 }
 
 func (c *DnsQueryCache) onEvicted(key string, value *CacheEntry) {
-	value.clear()
-}
-
-func getKey(r *dns.Msg) (string, error) {
-	// Make sure msg has been decompressed
-	r.Len()
-	question, err := util.GetQuestion(r)
-	if err != nil {
-		log.Errorf("cache get msg:%v question error:%v", r, err)
-		return "", err
-	}
-	return util.GetQuestionKey(question), nil
+	c.removeScope(value)
+	c.addMemory(-value.clear())
 }
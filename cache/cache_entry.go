@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/xsmartdns/xsmartdns/log"
 	"github.com/xsmartdns/xsmartdns/model"
 	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
 	"github.com/xsmartdns/xsmartdns/util/timeutil"
 )
 
@@ -28,8 +30,12 @@ type CacheEntry struct {
 	cfg             *config.CacheConfig
 	storeTimeSecond int64
 	updateinvoke    *updateinvoke.UpdateInvoker
+	prefetchLimiter *ratelimit.Limiter
 	request         *dns.Msg
 	host            string
+	// ECS scope of the entry, scopes is empty if the entry is not scoped
+	scopes string
+	scope  uint8
 
 	// update by RWMutex
 	sync.RWMutex
@@ -37,14 +43,27 @@ type CacheEntry struct {
 	ttl              uint32
 	updateTimeSecond int64
 	ti               *time.Timer
+	// estimated memory(bytes)
+	size int64
+	// the cache counting the size, nil if not added
+	cache *DnsQueryCache
+	// decaying hit count since hitTimeSecond
+	hits          float64
+	hitTimeSecond int64
+	// speed check results of the last update
+	speedCheckResults []*model.SpeedCheckResult
+	// current refresh, nil if not refreshing
+	refreshing              *refreshCall
+	refreshFailedTimeSecond int64
 
-	// update by atomic
+	// update by atomic, cleared is stored under the lock to keep the size counted by cache
 	vistiedTimeSecond int64
 	cleared           int32
-	updating          int32
+	// hits since the last prefetch, not folded into hits yet
+	recentHits int64
 }
 
-func newCacheEntry(request, resp *dns.Msg, updateinvoke *updateinvoke.UpdateInvoker, cfg *config.CacheConfig) *CacheEntry {
+func newCacheEntry(request, resp *dns.Msg, updateinvoke *updateinvoke.UpdateInvoker, prefetchLimiter *ratelimit.Limiter, cfg *config.CacheConfig) *CacheEntry {
 	host, _ := util.GetHost(resp)
 	now := timeutil.NowSecond()
 	e := &CacheEntry{
@@ -56,54 +75,160 @@ func newCacheEntry(request, resp *dns.Msg, updateinvoke *updateinvoke.UpdateInvo
 		storeTimeSecond:   now,
 		updateTimeSecond:  now,
 		vistiedTimeSecond: now,
+		hits:              1,
+		hitTimeSecond:     now,
 		updateinvoke:      updateinvoke,
+		prefetchLimiter:   prefetchLimiter,
 	}
-	if cfg.PrefetchDomain {
+	e.startPrefetch()
+	return e
+}
+
+// restore cache entry from persisted data, the prefetch timer is rescheduled by the remaining ttl
+func restoreCacheEntry(p *persistEntry, updateinvoke *updateinvoke.UpdateInvoker, prefetchLimiter *ratelimit.Limiter, cfg *config.CacheConfig) (*CacheEntry, error) {
+	request := new(dns.Msg)
+	if err := request.Unpack(p.Request); err != nil {
+		return nil, fmt.Errorf("unpack request error:%v", err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(p.Resp); err != nil {
+		return nil, fmt.Errorf("unpack resp error:%v", err)
+	}
+	host, _ := util.GetHost(resp)
+	e := &CacheEntry{
+		cfg:               cfg,
+		request:           request,
+		host:              host,
+		resp:              resp,
+		ttl:               p.Ttl,
+		storeTimeSecond:   p.StoreTimeSecond,
+		updateTimeSecond:  p.UpdateTimeSecond,
+		vistiedTimeSecond: p.VistiedTimeSecond,
+		hits:              p.Hits,
+		hitTimeSecond:     p.HitTimeSecond,
+		updateinvoke:      updateinvoke,
+		prefetchLimiter:   prefetchLimiter,
+	}
+	e.startPrefetch()
+	return e, nil
+}
+
+func (e *CacheEntry) startPrefetch() {
+	if e.cfg.PrefetchDomain {
 		e.startUpdate(func() time.Duration {
 			e.RLock()
-			ttl := e.ttl
+			ttl := int64(e.ttl)
+			updateTimeSecond := e.updateTimeSecond
 			e.RUnlock()
-			afterUpdateTime := (time.Duration(ttl) - MIN_UPDATE_DELAY_SECOND) * time.Second
+			// remaining ttl, restored entry may have been stored for a while
+			ttl -= timeutil.NowSecond() - updateTimeSecond
+			afterUpdateTime := time.Duration(ttl-MIN_UPDATE_DELAY_SECOND) * time.Second
 			return afterUpdateTime
 		})
-	} else if !cfg.DisableCacheExpired {
+	} else if !e.cfg.DisableCacheExpired {
 		e.startUpdate(func() time.Duration {
-			return time.Duration(*cfg.CacheExpiredPrefetchTimeSecond) * time.Second
+			return time.Duration(*e.cfg.CacheExpiredPrefetchTimeSecond) * time.Second
 		})
 	}
-	go e.updateResp()
-	return e
+}
+
+// snapshot entry to persist data
+func (e *CacheEntry) toPersistEntry() (*persistEntry, error) {
+	request, err := e.request.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack request error:%v", err)
+	}
+	e.RLock()
+	resp, err := e.resp.Pack()
+	ttl := e.ttl
+	updateTimeSecond := e.updateTimeSecond
+	hits := e.hits + float64(atomic.LoadInt64(&e.recentHits))
+	hitTimeSecond := e.hitTimeSecond
+	e.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("pack resp error:%v", err)
+	}
+	return &persistEntry{
+		Request:           request,
+		Resp:              resp,
+		Ttl:               ttl,
+		StoreTimeSecond:   e.storeTimeSecond,
+		UpdateTimeSecond:  updateTimeSecond,
+		VistiedTimeSecond: atomic.LoadInt64(&e.vistiedTimeSecond),
+		Hits:              hits,
+		HitTimeSecond:     hitTimeSecond,
+	}, nil
 }
 
 // get cache resp, if return nil the cache will be delete
-func (e *CacheEntry) getResp() *dns.Msg {
+// expired data is served as RFC 8767 when the refresh is failed or slower than client response timer
+// stale is true if the expired resp is served
+func (e *CacheEntry) getResp(r *dns.Msg) (resp *dns.Msg, stale bool) {
+	atomic.StoreInt64(&e.vistiedTimeSecond, timeutil.NowSecond())
+	e.hit()
+	if e.vistiedExpired() {
+		return nil, false
+	}
+	if !e.ttlExpired() {
+		return e.respWithTtl(), false
+	}
+	if e.cfg.DisableCacheExpired || e.staleExpired() {
+		return nil, false
+	}
+	if !e.refreshFailedRecently() {
+		call := e.refresh()
+		timer := time.NewTimer(time.Duration(*e.cfg.CacheExpiredClientTimeoutMs) * time.Millisecond)
+		select {
+		case <-call.done:
+			timer.Stop()
+			if call.err == nil {
+				return e.respWithTtl(), false
+			}
+		case <-timer.C:
+		}
+	}
+	// serve stale
+	e.RLock()
+	resp = e.resp.Copy()
+	e.RUnlock()
+	util.SetExtendedError(r, resp, dns.ExtendedErrorCodeStaleAnswer)
+	return util.RewriteMsgTTL(resp, uint32(*e.cfg.CacheExpiredReplyTtl)), true
+}
+
+// copy of resp with the remaining ttl
+func (e *CacheEntry) respWithTtl() *dns.Msg {
 	e.RLock()
 	resp := e.resp.Copy()
 	ttl := e.ttl
 	updateTimeSecond := e.updateTimeSecond
 	e.RUnlock()
-	atomic.StoreInt64(&e.vistiedTimeSecond, timeutil.NowSecond())
 	// rewrite ttl
 	nowTtl := int64(ttl) - (timeutil.NowSecond() - updateTimeSecond)
 	if nowTtl < MIN_UPDATE_DELAY_SECOND {
 		nowTtl = MIN_UPDATE_DELAY_SECOND
 	}
-	if e.vistiedExpired() {
-		return nil
-	}
-	if e.ttlExpired() {
-		if e.cfg.DisableCacheExpired {
-			return nil
-		}
-		// Accessing the expired cache returns ttl of 3
-		if !e.cfg.PrefetchDomain {
-			go e.updateResp()
-		}
-		nowTtl = *e.cfg.CacheExpiredReplyTtl
-	}
 	return util.RewriteMsgTTL(resp, uint32(nowTtl))
 }
 
+// expired longer than max stale timer
+func (e *CacheEntry) staleExpired() bool {
+	maxStale := *e.cfg.CacheExpiredMaxStaleSecond
+	if maxStale <= 0 {
+		return false
+	}
+	e.RLock()
+	expiredTimeSecond := e.updateTimeSecond + int64(e.ttl)
+	e.RUnlock()
+	return timeutil.NowSecond()-expiredTimeSecond > maxStale
+}
+
+func (e *CacheEntry) refreshFailedRecently() bool {
+	e.RLock()
+	refreshFailedTimeSecond := e.refreshFailedTimeSecond
+	e.RUnlock()
+	return refreshFailedTimeSecond > 0 && timeutil.NowSecond()-refreshFailedTimeSecond < *e.cfg.CacheExpiredFailureRecheckSecond
+}
+
 func (e *CacheEntry) ttlExpired() bool {
 	e.RLock()
 	updateTimeSecond := e.updateTimeSecond
@@ -122,17 +247,20 @@ func (e *CacheEntry) vistiedExpired() bool {
 	return timeutil.NowSecond()-vistiedTimeSecond > e.cfg.CacheExpiredTimeout
 }
 
-func (e *CacheEntry) clear() {
+// stop the entry and return its memory size
+func (e *CacheEntry) clear() int64 {
+	e.Lock()
 	atomic.StoreInt32(&e.cleared, 1)
-	e.RLock()
 	ti := e.ti
-	e.RUnlock()
+	size := e.size
+	e.Unlock()
 	if ti != nil {
 		ti.Stop()
 	}
 	if log.IsLevelEnabled(logrus.DebugLevel) {
 		log.Debuf("[%s]cleaned", e.host)
 	}
+	return size
 }
 
 func (e *CacheEntry) stoped() bool {
@@ -154,21 +282,90 @@ func (e *CacheEntry) startUpdate(getAfterTime func() time.Duration) {
 		if e.stoped() {
 			return
 		}
-		e.updateResp()
+		e.prefetch()
 		e.startUpdate(getAfterTime)
 	})
 	e.Unlock()
 }
 
+// prefetch popular entry, rarely used entries and the entries not hit since the last prefetch expire normally
+func (e *CacheEntry) prefetch() {
+	if !e.popular() {
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.Debuf("[%s] is not popular, skip prefetch", e.host)
+		}
+		return
+	}
+	if !e.prefetchLimiter.Allow() {
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.Debuf("[%s] prefetch rate limited", e.host)
+		}
+		return
+	}
+	e.updateResp()
+}
+
+func (e *CacheEntry) hit() {
+	atomic.AddInt64(&e.recentHits, 1)
+}
+
+// hit since the last prefetch and the decayed hits reach PrefetchMinHits, the recent hits are folded into the hits
+func (e *CacheEntry) popular() bool {
+	now := timeutil.NowSecond()
+	e.Lock()
+	defer e.Unlock()
+	recentHits := atomic.SwapInt64(&e.recentHits, 0)
+	e.hits = e.decayedHits(now) + float64(recentHits)
+	e.hitTimeSecond = now
+	return recentHits > 0 && e.hits >= *e.cfg.PrefetchMinHits
+}
+
+// hits decay by half every PrefetchHitDecaySecond, the recent hits are not included, must hold lock
+func (e *CacheEntry) decayedHits(now int64) float64 {
+	elapsed := now - e.hitTimeSecond
+	if elapsed <= 0 {
+		return e.hits
+	}
+	return e.hits * math.Exp2(-float64(elapsed)/float64(*e.cfg.PrefetchHitDecaySecond))
+}
+
+// update resp and wait it done
 func (e *CacheEntry) updateResp() error {
-	if !atomic.CompareAndSwapInt32(&e.updating, 0, 1) {
+	call := e.refresh()
+	<-call.done
+	return call.err
+}
+
+// start updating resp if not updating, the returned call is done when updated
+func (e *CacheEntry) refresh() *refreshCall {
+	e.Lock()
+	if call := e.refreshing; call != nil {
+		e.Unlock()
 		if log.IsLevelEnabled(logrus.DebugLevel) {
 			log.Debuf("[%s] is updating", e.host)
 		}
-		return nil
+		return call
 	}
-	defer atomic.StoreInt32(&e.updating, 0)
+	call := &refreshCall{done: make(chan struct{})}
+	e.refreshing = call
+	e.Unlock()
 
+	go func() {
+		defer close(call.done)
+		call.err = e.doUpdateResp()
+		e.Lock()
+		defer e.Unlock()
+		e.refreshing = nil
+		if call.err != nil {
+			e.refreshFailedTimeSecond = timeutil.NowSecond()
+		} else {
+			e.refreshFailedTimeSecond = 0
+		}
+	}()
+	return call
+}
+
+func (e *CacheEntry) doUpdateResp() error {
 	req := model.WrapDnsMsg(e.request)
 	// not first update and multiPrefetchSpeedCheck enabled
 	if e.cfg.MultiPrefetchSpeedCheck && e.storeTimeSecond != e.updateTimeSecond {
@@ -178,15 +375,36 @@ func (e *CacheEntry) updateResp() error {
 	if err != nil {
 		return fmt.Errorf("update invoke req:%s error:%v", e.request, err)
 	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("update invoke req:%s rcode:%s", e.request, dns.RcodeToString[resp.Rcode])
+	}
 	if log.IsLevelEnabled(logrus.DebugLevel) {
 		host, _ := util.GetHost(resp)
 		log.Debuf("[%s] updated:%s", host, resp.String())
 	}
 
 	e.Lock()
-	defer e.Unlock()
+	// cleared entry is not counted by cache
+	cache, delta := e.cache, int64(0)
+	if cache != nil && !e.stoped() {
+		delta = int64(UNPACKED_MSG_FACTOR * (resp.Len() - e.resp.Len()))
+		cache.addMemory(delta)
+		e.size += delta
+	}
 	e.resp = resp
 	e.ttl = util.GetAnswerTTL(resp)
 	e.updateTimeSecond = timeutil.NowSecond()
+	e.speedCheckResults = req.SpeedCheckResults
+	e.Unlock()
+
+	// the grown entry may exceed the memory limit, evict without the entry lock
+	if delta > 0 {
+		cache.enforceMemory()
+	}
 	return nil
 }
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
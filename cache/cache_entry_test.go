@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/cache/updateinvoke"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
+	"github.com/xsmartdns/xsmartdns/util/timeutil"
+)
+
+// local udp dns server, answer the nth query with A 10.0.0.n
+type testUpstream struct {
+	srv     *dns.Server
+	addr    string
+	queried int32
+	// answer SERVFAIL if 1
+	failed int32
+	// answer after the milliseconds
+	delayMs int64
+}
+
+func startTestUpstream() *testUpstream {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+	u := &testUpstream{addr: pc.LocalAddr().String()}
+	started := make(chan struct{})
+	u.srv = &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := atomic.AddInt32(&u.queried, 1)
+		time.Sleep(time.Duration(atomic.LoadInt64(&u.delayMs)) * time.Millisecond)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		if atomic.LoadInt32(&u.failed) == 1 {
+			resp.Rcode = dns.RcodeServerFailure
+		} else {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.0.%d", r.Question[0].Name, n))
+			resp.Answer = append(resp.Answer, rr)
+		}
+		w.WriteMsg(resp)
+	})}
+	go u.srv.ActivateAndServe()
+	<-started
+	return u
+}
+
+// entry of example.com. A 10.0.0.0 updated by the upstream
+func newTestEntry(u *testUpstream, setup func(cfg *config.CacheConfig)) *CacheEntry {
+	cfg, err := config.Parse([]byte(fmt.Sprintf(`{
+		"inbounds": [{"listen": "127.0.0.1:0"}],
+		"groups": [{"outbounds": [{"setting": {"addr": "%s"}}], "speedChecks": "none", "disableDualstackIpSelection": true}]
+	}`, u.addr)))
+	So(err, ShouldBeNil)
+	group := cfg.Groups[0]
+	setup(group.CacheConfig)
+	invoker, err := updateinvoke.NewUpdateInvoker(group)
+	So(err, ShouldBeNil)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR("example.com. 60 IN A 10.0.0.0")
+	resp.Answer = append(resp.Answer, rr)
+	return newCacheEntry(req, resp, invoker, ratelimit.NewLimiter(100, 100), group.CacheConfig)
+}
+
+// answer ip of the entry
+func entryIp(e *CacheEntry) string {
+	e.RLock()
+	defer e.RUnlock()
+	return e.resp.Answer[0].(*dns.A).A.String()
+}
+
+// expire the ttl of the entry for the seconds
+func expireEntry(e *CacheEntry, second int64) {
+	e.Lock()
+	defer e.Unlock()
+	e.updateTimeSecond = timeutil.NowSecond() - int64(e.ttl) - second
+}
+
+// request with edns0 to get the extended error
+func newTestRequest() *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	return r
+}
+
+// extended error code of resp, 0 if not found
+func extendedError(resp *dns.Msg) uint16 {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede.InfoCode
+			}
+		}
+	}
+	return 0
+}
+
+func TestCacheEntry(t *testing.T) {
+	Convey("TestPrefetch", t, func() {
+		u := startTestUpstream()
+		defer u.srv.Shutdown()
+		e := newTestEntry(u, func(cfg *config.CacheConfig) {
+			cfg.PrefetchDomain = true
+		})
+		defer e.clear()
+
+		// not hit since stored
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 0)
+
+		e.hit()
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+		So(entryIp(e), ShouldEqual, "10.0.0.1")
+
+		// the cold entry is not refreshed again
+		e.prefetch()
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+		So(e.info().Hits, ShouldAlmostEqual, 2, 0.01)
+
+		e.hit()
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 2)
+		So(entryIp(e), ShouldEqual, "10.0.0.2")
+	})
+
+	Convey("TestPrefetchMinHits", t, func() {
+		u := startTestUpstream()
+		defer u.srv.Shutdown()
+		minHits := float64(3)
+		e := newTestEntry(u, func(cfg *config.CacheConfig) {
+			cfg.PrefetchDomain = true
+			cfg.PrefetchMinHits = &minHits
+		})
+		defer e.clear()
+
+		e.hit()
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 0)
+		e.hit()
+		e.prefetch()
+		So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+	})
+
+	Convey("TestServeExpired", t, func() {
+		u := startTestUpstream()
+		defer u.srv.Shutdown()
+		clientTimeoutMs, maxStale, recheck := int64(100), int64(60), int64(30)
+		e := newTestEntry(u, func(cfg *config.CacheConfig) {
+			cfg.CacheExpiredClientTimeoutMs = &clientTimeoutMs
+			cfg.CacheExpiredMaxStaleSecond = &maxStale
+			cfg.CacheExpiredFailureRecheckSecond = &recheck
+		})
+		defer e.clear()
+
+		Convey("refreshed in the client response timer", func() {
+			expireEntry(e, 10)
+			resp, stale := e.getResp(newTestRequest())
+			So(stale, ShouldBeFalse)
+			So(resp.Answer[0].(*dns.A).A.String(), ShouldEqual, "10.0.0.1")
+			So(extendedError(resp), ShouldEqual, 0)
+		})
+
+		Convey("serve stale after the client response timer", func() {
+			atomic.StoreInt64(&u.delayMs, 300)
+			expireEntry(e, 10)
+			resp, stale := e.getResp(newTestRequest())
+			So(stale, ShouldBeTrue)
+			So(resp.Answer[0].(*dns.A).A.String(), ShouldEqual, "10.0.0.0")
+			So(resp.Answer[0].Header().Ttl, ShouldEqual, *e.cfg.CacheExpiredReplyTtl)
+			So(extendedError(resp), ShouldEqual, dns.ExtendedErrorCodeStaleAnswer)
+			// refreshed in background
+			So(e.updateResp(), ShouldBeNil)
+			So(entryIp(e), ShouldEqual, "10.0.0.1")
+		})
+
+		Convey("expired longer than max stale", func() {
+			expireEntry(e, maxStale+10)
+			resp, _ := e.getResp(newTestRequest())
+			So(resp, ShouldBeNil)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 0)
+		})
+
+		Convey("no max stale limit", func() {
+			noLimit := int64(0)
+			e.cfg.CacheExpiredMaxStaleSecond = &noLimit
+			atomic.StoreInt32(&u.failed, 1)
+			expireEntry(e, maxStale*100)
+			resp, stale := e.getResp(newTestRequest())
+			So(stale, ShouldBeTrue)
+			So(resp.Answer[0].(*dns.A).A.String(), ShouldEqual, "10.0.0.0")
+			So(extendedError(resp), ShouldEqual, dns.ExtendedErrorCodeStaleAnswer)
+		})
+
+		Convey("not serve expired if disabled", func() {
+			e.cfg.DisableCacheExpired = true
+			expireEntry(e, 10)
+			resp, _ := e.getResp(newTestRequest())
+			So(resp, ShouldBeNil)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 0)
+		})
+
+		Convey("not refresh again in failure recheck interval", func() {
+			atomic.StoreInt32(&u.failed, 1)
+			expireEntry(e, 10)
+			resp, stale := e.getResp(newTestRequest())
+			So(stale, ShouldBeTrue)
+			So(resp.Answer[0].(*dns.A).A.String(), ShouldEqual, "10.0.0.0")
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+
+			atomic.StoreInt32(&u.failed, 0)
+			_, stale = e.getResp(newTestRequest())
+			So(stale, ShouldBeTrue)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+
+			// recheck after the interval
+			e.Lock()
+			e.refreshFailedTimeSecond -= recheck
+			e.Unlock()
+			_, stale = e.getResp(newTestRequest())
+			So(stale, ShouldBeFalse)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/util"
+)
+
+// scoped entries of one base key and address family, key:scope prefix length value:entries number
+type ecsScopes map[uint8]int
+
+// Get the key of a request, requests with the same key can share one upstream resolution
+func GetRequestKey(r *dns.Msg) (string, error) {
+	base, err := getKey(r)
+	if err != nil {
+		return "", err
+	}
+	subnet := util.GetEdns0Subnet(r)
+	if subnet == nil {
+		return base, nil
+	}
+	return scopedKey(base, subnet, subnet.SourceNetmask), nil
+}
+
+// base key of a request: question, DNSSEC OK bit and Checking Disabled bit
+func getKey(r *dns.Msg) (string, error) {
+	// Make sure msg has been decompressed
+	r.Len()
+	question, err := util.GetQuestion(r)
+	if err != nil {
+		log.Errorf("cache get msg:%v question error:%v", r, err)
+		return "", err
+	}
+	return fmt.Sprintf("%s\tdo=%t\tcd=%t", util.GetQuestionKey(question), util.IsDnssecOk(r), r.CheckingDisabled), nil
+}
+
+// key of an entry that is only valid for clients in subnet/scope
+func scopedKey(base string, subnet *dns.EDNS0_SUBNET, scope uint8) string {
+	ip := subnet.Address.Mask(net.CIDRMask(int(scope), subnetBits(subnet)))
+	return fmt.Sprintf("%s\tecs=%s/%d", base, ip, scope)
+}
+
+func scopesKey(base string, family uint16) string {
+	return fmt.Sprintf("%s\tfamily=%d", base, family)
+}
+
+func subnetBits(subnet *dns.EDNS0_SUBNET) int {
+	if subnet.Family == 2 {
+		return net.IPv6len * 8
+	}
+	return net.IPv4len * 8
+}
+
+// get the key to store resp, the entry is scoped when the upstream returns an ECS scope prefix
+func getStoreKey(r, resp *dns.Msg) (key, scopes string, scope uint8, err error) {
+	base, err := getKey(r)
+	if err != nil {
+		return "", "", 0, err
+	}
+	subnet := util.GetEdns0Subnet(resp)
+	if subnet == nil || subnet.SourceScope == 0 || subnet.Address == nil {
+		return base, "", 0, nil
+	}
+	scope = util.Min(subnet.SourceScope, uint8(subnetBits(subnet)))
+	return scopedKey(base, subnet, scope), scopesKey(base, subnet.Family), scope, nil
+}
+
+// find the key of the most specific entry matching the client subnet, must hold lock
+func (c *DnsQueryCache) lookupKey(r *dns.Msg) (string, bool) {
+	base, err := getKey(r)
+	if err != nil {
+		return "", false
+	}
+	if subnet := util.GetEdns0Subnet(r); subnet != nil && subnet.Address != nil {
+		scopes := c.scopes[scopesKey(base, subnet.Family)]
+		prefixes := make([]int, 0, len(scopes))
+		for scope := range scopes {
+			// the answer is more specific than the client subnet
+			if scope > subnet.SourceNetmask {
+				continue
+			}
+			prefixes = append(prefixes, int(scope))
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(prefixes)))
+		for _, scope := range prefixes {
+			key := scopedKey(base, subnet, uint8(scope))
+			if c.cache.Contains(key) {
+				return key, true
+			}
+		}
+	}
+	return base, c.cache.Contains(base)
+}
+
+// must hold lock
+func (c *DnsQueryCache) addScope(e *CacheEntry) {
+	if len(e.scopes) == 0 {
+		return
+	}
+	scopes := c.scopes[e.scopes]
+	if scopes == nil {
+		scopes = make(ecsScopes)
+		c.scopes[e.scopes] = scopes
+	}
+	scopes[e.scope]++
+}
+
+// must hold lock
+func (c *DnsQueryCache) removeScope(e *CacheEntry) {
+	if len(e.scopes) == 0 {
+		return
+	}
+	scopes := c.scopes[e.scopes]
+	if scopes == nil {
+		return
+	}
+	if scopes[e.scope]--; scopes[e.scope] <= 0 {
+		delete(scopes, e.scope)
+	}
+	if len(scopes) == 0 {
+		delete(c.scopes, e.scopes)
+	}
+}
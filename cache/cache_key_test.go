@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"net"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+func newTestMsg(do, cd bool, subnet string, scope uint8) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.CheckingDisabled = cd
+	if do || len(subnet) > 0 {
+		m.SetEdns0(4096, do)
+	}
+	if len(subnet) > 0 {
+		_, ipNet, _ := net.ParseCIDR(subnet)
+		ones, _ := ipNet.Mask.Size()
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			SourceScope:   scope,
+			Address:       ipNet.IP,
+		})
+	}
+	return m
+}
+
+func TestCacheKey(t *testing.T) {
+	Convey("TestCacheKey", t, func() {
+		plain, _ := getKey(newTestMsg(false, false, "", 0))
+		do, _ := getKey(newTestMsg(true, false, "", 0))
+		cd, _ := getKey(newTestMsg(false, true, "", 0))
+		So(plain, ShouldNotEqual, do)
+		So(plain, ShouldNotEqual, cd)
+		So(do, ShouldNotEqual, cd)
+	})
+
+	Convey("TestScopedLookup", t, func() {
+		c := &DnsQueryCache{scopes: make(map[string]ecsScopes)}
+		c.cache, _ = lru.NewWithEvict(10, c.onEvicted)
+		store := func(r, resp *dns.Msg) string {
+			key, scopes, scope, err := getStoreKey(r, resp)
+			So(err, ShouldBeNil)
+			c.add(key, &CacheEntry{request: r, resp: resp, scopes: scopes, scope: scope, cleared: 1})
+			return key
+		}
+
+		// upstream answers 1.2.3.0/24 with scope 16
+		scopedKey := store(newTestMsg(false, false, "1.2.3.0/24", 0), newTestMsg(false, false, "1.2.3.0/24", 16))
+		key, ok := c.lookupKey(newTestMsg(false, false, "1.2.99.0/24", 0))
+		So(ok, ShouldBeTrue)
+		So(key, ShouldEqual, scopedKey)
+		// other subnet
+		_, ok = c.lookupKey(newTestMsg(false, false, "1.3.3.0/24", 0))
+		So(ok, ShouldBeFalse)
+		// no ECS
+		_, ok = c.lookupKey(newTestMsg(false, false, "", 0))
+		So(ok, ShouldBeFalse)
+
+		// global entry is served to everyone
+		globalKey := store(newTestMsg(false, false, "", 0), newTestMsg(false, false, "", 0))
+		key, ok = c.lookupKey(newTestMsg(false, false, "1.3.3.0/24", 0))
+		So(ok, ShouldBeTrue)
+		So(key, ShouldEqual, globalKey)
+
+		// scopes are released on eviction
+		c.cache.Remove(scopedKey)
+		So(len(c.scopes), ShouldEqual, 0)
+	})
+}
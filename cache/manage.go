@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/timeutil"
+)
+
+// cache entry info for inspection
+type EntryInfo struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Scope string `json:"scope,omitempty"`
+	// seconds of ttl left, negative if expired
+	TtlLeft           int64                     `json:"ttlLeft"`
+	UpdateTime        time.Time                 `json:"updateTime"`
+	VisitedTime       time.Time                 `json:"visitedTime"`
+	Hits              float64                   `json:"hits"`
+	Answers           []string                  `json:"answers"`
+	SpeedCheckResults []*model.SpeedCheckResult `json:"speedCheckResults"`
+}
+
+func (e *CacheEntry) info() *EntryInfo {
+	question, _ := util.GetQuestion(e.request)
+	now := timeutil.NowSecond()
+	e.RLock()
+	defer e.RUnlock()
+	info := &EntryInfo{
+		Name:              question.Name,
+		Type:              dns.Type(question.Qtype).String(),
+		TtlLeft:           int64(e.ttl) - (now - e.updateTimeSecond),
+		UpdateTime:        time.Unix(e.updateTimeSecond, 0),
+		VisitedTime:       time.Unix(atomic.LoadInt64(&e.vistiedTimeSecond), 0),
+		Hits:              e.decayedHits(now) + float64(atomic.LoadInt64(&e.recentHits)),
+		Answers:           make([]string, 0, len(e.resp.Answer)),
+		SpeedCheckResults: e.speedCheckResults,
+	}
+	if len(e.scopes) > 0 {
+		if subnet := util.GetEdns0Subnet(e.resp); subnet != nil {
+			info.Scope = fmt.Sprintf("%s/%d", subnet.Address, e.scope)
+		}
+	}
+	for _, rr := range e.resp.Answer {
+		info.Answers = append(info.Answers, rr.String())
+	}
+	return info
+}
+
+// match question name of entry, the name is matched as a domain suffix if suffix is true
+func (e *CacheEntry) matchName(name string, suffix bool) bool {
+	question, err := util.GetQuestion(e.request)
+	if err != nil {
+		return false
+	}
+	qname := strings.ToLower(question.Name)
+	name = strings.ToLower(dns.Fqdn(name))
+	if qname == name {
+		return true
+	}
+	return suffix && (name == "." || strings.HasSuffix(qname, "."+name))
+}
+
+// list entries which name contains search, at most limit entries if limit > 0, newest first
+func (c *DnsQueryCache) List(search string, limit int) []*EntryInfo {
+	search = strings.ToLower(search)
+	c.RLock()
+	values := c.cache.Values()
+	c.RUnlock()
+	infos := make([]*EntryInfo, 0)
+	for i := len(values) - 1; i >= 0; i-- {
+		if limit > 0 && len(infos) >= limit {
+			break
+		}
+		if len(search) > 0 && !strings.Contains(strings.ToLower(values[i].host), search) {
+			continue
+		}
+		infos = append(infos, values[i].info())
+	}
+	return infos
+}
+
+// remove entries by name, return the removed number
+func (c *DnsQueryCache) Remove(name string, suffix bool) int {
+	c.Lock()
+	defer c.Unlock()
+	removed := 0
+	for _, key := range c.cache.Keys() {
+		value, ok := c.cache.Peek(key)
+		if ok && value.matchName(name, suffix) {
+			c.cache.Remove(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// remove all entries, return the removed number
+func (c *DnsQueryCache) Flush() int {
+	c.Lock()
+	defer c.Unlock()
+	removed := c.cache.Len()
+	c.cache.Purge()
+	return removed
+}
+
+// refresh entries of the name and type through update invoker, return the refreshed number
+func (c *DnsQueryCache) Refresh(name string, qtype uint16) (int, error) {
+	c.RLock()
+	values := c.cache.Values()
+	c.RUnlock()
+	refreshed := 0
+	for _, value := range values {
+		question, err := util.GetQuestion(value.request)
+		if err != nil || question.Qtype != qtype || !value.matchName(name, false) {
+			continue
+		}
+		if err := value.updateResp(); err != nil {
+			return refreshed, err
+		}
+		refreshed++
+	}
+	return refreshed, nil
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// store the answer of name and qtype
+func storeTestEntry(c *DnsQueryCache, name string, qtype uint16, answer string) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	rr, err := dns.NewRR(fmt.Sprintf("%s 60 IN %s %s", name, dns.TypeToString[qtype], answer))
+	So(err, ShouldBeNil)
+	resp.Answer = append(resp.Answer, rr)
+	c.StoreCache(model.WrapDnsMsg(r), resp)
+}
+
+func listNames(infos []*EntryInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name+" "+info.Type)
+	}
+	return names
+}
+
+func TestManage(t *testing.T) {
+	Convey("TestManage", t, func() {
+		u := startTestUpstream()
+		defer u.srv.Shutdown()
+		cfg, err := config.Parse([]byte(fmt.Sprintf(`{
+			"inbounds": [{"listen": "127.0.0.1:0"}],
+			"groups": [{"outbounds": [{"setting": {"addr": "%s"}}], "speedChecks": "none", "disableDualstackIpSelection": true}]
+		}`, u.addr)))
+		So(err, ShouldBeNil)
+		c, err := NewDnsQueryCache(cfg.Groups[0])
+		So(err, ShouldBeNil)
+		defer c.Shutdown()
+
+		storeTestEntry(c, "example.com.", dns.TypeA, "10.0.0.0")
+		storeTestEntry(c, "www.example.com.", dns.TypeA, "10.0.0.0")
+		storeTestEntry(c, "example.com.", dns.TypeAAAA, "::1")
+		storeTestEntry(c, "example.org.", dns.TypeA, "10.0.0.0")
+
+		Convey("list newest first", func() {
+			So(listNames(c.List("", 0)), ShouldResemble, []string{"example.org. A", "example.com. AAAA", "www.example.com. A", "example.com. A"})
+			So(listNames(c.List("", 2)), ShouldResemble, []string{"example.org. A", "example.com. AAAA"})
+			So(listNames(c.List("EXAMPLE.COM", 0)), ShouldResemble, []string{"example.com. AAAA", "www.example.com. A", "example.com. A"})
+			So(listNames(c.List("www", 0)), ShouldResemble, []string{"www.example.com. A"})
+			So(c.List("example.net", 0), ShouldBeEmpty)
+		})
+
+		Convey("remove the name", func() {
+			So(c.Remove("example.com", false), ShouldEqual, 2)
+			So(listNames(c.List("", 0)), ShouldResemble, []string{"example.org. A", "www.example.com. A"})
+			So(c.Remove("example.com", false), ShouldEqual, 0)
+		})
+
+		Convey("remove the domain suffix", func() {
+			So(c.Remove("example.com.", true), ShouldEqual, 3)
+			So(listNames(c.List("", 0)), ShouldResemble, []string{"example.org. A"})
+			// not matched as a part of the label
+			So(c.Remove("ample.org", true), ShouldEqual, 0)
+			So(c.Remove(".", true), ShouldEqual, 1)
+			So(c.Len(), ShouldEqual, 0)
+		})
+
+		Convey("flush all", func() {
+			So(c.Flush(), ShouldEqual, 4)
+			So(c.Len(), ShouldEqual, 0)
+			So(c.MemoryUsed(), ShouldEqual, 0)
+			So(c.Flush(), ShouldEqual, 0)
+		})
+
+		Convey("refresh the name and type", func() {
+			n, err := c.Refresh("example.com", dns.TypeA)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 1)
+			infos := c.List("", 0)
+			So(listNames(infos), ShouldResemble, []string{"example.org. A", "example.com. AAAA", "www.example.com. A", "example.com. A"})
+			So(infos[3].Answers[0], ShouldEndWith, "10.0.0.1")
+			// the others are not refreshed
+			So(infos[2].Answers[0], ShouldEndWith, "10.0.0.0")
+			So(infos[1].Answers[0], ShouldEndWith, "::1")
+		})
+
+		Convey("refresh the missing key", func() {
+			n, err := c.Refresh("example.net", dns.TypeA)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			n, err = c.Refresh("example.org", dns.TypeAAAA)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			So(atomic.LoadInt32(&u.queried), ShouldEqual, 0)
+		})
+
+		Convey("refresh failed", func() {
+			atomic.StoreInt32(&u.failed, 1)
+			_, err := c.Refresh("example.com", dns.TypeA)
+			So(err, ShouldNotBeNil)
+			So(c.List("", 0)[3].Answers[0], ShouldEndWith, "10.0.0.0")
+		})
+	})
+}
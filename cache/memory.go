@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+const (
+	// struct, timer, lru element and key of an entry
+	ENTRY_MEMORY_OVERHEAD = 512
+	// unpacked dns msg takes several times memory of the packed one
+	UNPACKED_MSG_FACTOR = 4
+)
+
+var sharedCache *SharedCache
+
+// memory budget shared by the group caches which enabled useSharedCache
+type SharedCache struct {
+	sync.Mutex
+	memorySize int64
+	memoryUsed int64
+	caches     []*DnsQueryCache
+}
+
+// init the shared cache, should be called before creating group caches
+func Init(cfg *config.SharedCache) {
+	if cfg.MemorySize <= 0 {
+		sharedCache = nil
+		return
+	}
+	if sharedCache == nil {
+		sharedCache = &SharedCache{}
+	}
+	// keep registered caches on reinit
+	sharedCache.Lock()
+	sharedCache.memorySize = cfg.MemorySize
+	sharedCache.Unlock()
+}
+
+func getSharedCache() (*SharedCache, error) {
+	if sharedCache == nil {
+		return nil, fmt.Errorf("shared cache is disabled")
+	}
+	return sharedCache, nil
+}
+
+func (s *SharedCache) register(c *DnsQueryCache) {
+	s.Lock()
+	defer s.Unlock()
+	s.caches = append(s.caches, c)
+}
+
+func (s *SharedCache) unregister(c *DnsQueryCache) {
+	s.Lock()
+	defer s.Unlock()
+	for i, cache := range s.caches {
+		if cache == c {
+			s.caches = append(s.caches[:i], s.caches[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *SharedCache) MemoryUsed() int64 {
+	return atomic.LoadInt64(&s.memoryUsed)
+}
+
+// evict the oldest entry of the cache most over its quota until the memory is under limit,
+// must not hold any cache lock
+func (s *SharedCache) enforce() {
+	s.Lock()
+	defer s.Unlock()
+	for atomic.LoadInt64(&s.memoryUsed) > s.memorySize {
+		victim := s.findVictim()
+		if victim == nil || !victim.evictOldest() {
+			return
+		}
+	}
+}
+
+// the cache with the max used/quota ratio, must hold lock
+func (s *SharedCache) findVictim() *DnsQueryCache {
+	var victim *DnsQueryCache
+	maxRatio := float64(0)
+	for _, c := range s.caches {
+		used := c.MemoryUsed()
+		if used <= 0 {
+			continue
+		}
+		quota := c.cfg.SharedCacheQuota
+		if quota <= 0 {
+			quota = s.memorySize
+		}
+		if ratio := float64(used) / float64(quota); ratio > maxRatio {
+			maxRatio = ratio
+			victim = c
+		}
+	}
+	return victim
+}
+
+// estimate memory of an entry by packed message length
+func estimateEntrySize(key string, request, resp *dns.Msg) int64 {
+	return int64(ENTRY_MEMORY_OVERHEAD + len(key) + UNPACKED_MSG_FACTOR*(request.Len()+resp.Len()))
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func newTestMemoryCache(shared *SharedCache, cfg *config.CacheConfig, memoryLimit int64) *DnsQueryCache {
+	c := &DnsQueryCache{cfg: cfg, scopes: make(map[string]ecsScopes), memoryLimit: memoryLimit, shared: shared}
+	c.cache, _ = lru.NewWithEvict(1024, c.onEvicted)
+	if shared != nil {
+		shared.register(c)
+	}
+	return c
+}
+
+func addTestEntry(c *DnsQueryCache, i int) {
+	m := new(dns.Msg)
+	m.SetQuestion(fmt.Sprintf("www%d.example.com.", i), dns.TypeA)
+	c.Lock()
+	c.add(fmt.Sprintf("key%d", i), &CacheEntry{request: m, resp: m, cleared: 1})
+	c.Unlock()
+	if c.shared != nil {
+		c.shared.enforce()
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	Convey("TestMemoryLimit", t, func() {
+		c := newTestMemoryCache(nil, &config.CacheConfig{}, 0)
+		addTestEntry(c, 0)
+		entrySize := c.MemoryUsed()
+		So(entrySize, ShouldBeGreaterThan, ENTRY_MEMORY_OVERHEAD)
+
+		c = newTestMemoryCache(nil, &config.CacheConfig{}, entrySize*3)
+		for i := 0; i < 10; i++ {
+			addTestEntry(c, i)
+		}
+		So(c.Len(), ShouldEqual, 3)
+		So(c.MemoryUsed(), ShouldEqual, entrySize*3)
+	})
+
+	Convey("TestSharedCache", t, func() {
+		probe := newTestMemoryCache(nil, &config.CacheConfig{}, 0)
+		addTestEntry(probe, 0)
+		entrySize := probe.MemoryUsed()
+
+		shared := &SharedCache{memorySize: entrySize * 6}
+		// a is allowed to use 1/3 of the shared memory, b is not limited
+		a := newTestMemoryCache(shared, &config.CacheConfig{SharedCacheQuota: entrySize * 2}, entrySize*2)
+		b := newTestMemoryCache(shared, &config.CacheConfig{}, 0)
+		for i := 0; i < 10; i++ {
+			addTestEntry(a, i)
+		}
+		So(a.Len(), ShouldEqual, 2)
+		for i := 0; i < 10; i++ {
+			addTestEntry(b, i)
+		}
+		So(shared.MemoryUsed(), ShouldBeLessThanOrEqualTo, entrySize*6)
+		So(shared.MemoryUsed(), ShouldEqual, a.MemoryUsed()+b.MemoryUsed())
+		So(b.Len(), ShouldBeGreaterThan, 0)
+	})
+	Convey("TestUpdateResized", t, func() {
+		u := startTestUpstream()
+		defer u.srv.Shutdown()
+		e := newTestEntry(u, func(cfg *config.CacheConfig) {})
+		// grown by the update
+		e.resp.Answer = nil
+		shared := &SharedCache{memorySize: math.MaxInt64}
+		c := newTestMemoryCache(shared, &config.CacheConfig{}, 0)
+		addTestEntry(c, 0)
+		c.Lock()
+		c.add("example.com", e)
+		c.Unlock()
+		// the shared memory is full
+		shared.memorySize = shared.MemoryUsed()
+
+		So(e.updateResp(), ShouldBeNil)
+		So(entryIp(e), ShouldEqual, "10.0.0.1")
+		// the oldest entry is evicted for the grown one
+		So(c.Len(), ShouldEqual, 1)
+		So(c.MemoryUsed(), ShouldEqual, estimateEntrySize("example.com", e.request, e.resp))
+		So(shared.MemoryUsed(), ShouldEqual, c.MemoryUsed())
+
+		So(c.Flush(), ShouldEqual, 1)
+		So(c.MemoryUsed(), ShouldEqual, 0)
+		So(shared.MemoryUsed(), ShouldEqual, 0)
+		// the cleared entry is not counted
+		So(e.updateResp(), ShouldBeNil)
+		So(shared.MemoryUsed(), ShouldEqual, 0)
+	})
+}
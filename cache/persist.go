@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PERSIST_MAGIC = "XSDNSCACHE"
+	// bump when persistFile or persistEntry changes incompatibly
+	PERSIST_VERSION = uint16(1)
+)
+
+var ErrIncompatiblePersistFile = errors.New("incompatible cache persist file")
+
+// on-disk layout: magic | version(uint16 big endian) | gob(persistFile)
+type persistFile struct {
+	Entries []*persistEntry
+}
+
+type persistEntry struct {
+	// packed dns msg
+	Request []byte
+	Resp    []byte
+
+	Ttl               uint32
+	StoreTimeSecond   int64
+	UpdateTimeSecond  int64
+	VistiedTimeSecond int64
+	Hits              float64
+	HitTimeSecond     int64
+}
+
+// write entries to file, the file is replaced atomically
+func writePersistFile(filename string, entries []*persistEntry) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(PERSIST_MAGIC)
+	binary.Write(w, binary.BigEndian, PERSIST_VERSION)
+	if err := gob.NewEncoder(w).Encode(&persistFile{Entries: entries}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("encode cache error:%v", err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// read entries from file, return ErrIncompatiblePersistFile if the file is not written by this version
+func readPersistFile(filename string) ([]*persistEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(PERSIST_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, []byte(PERSIST_MAGIC)) {
+		return nil, fmt.Errorf("%w: bad magic", ErrIncompatiblePersistFile)
+	}
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("%w: read version error:%v", ErrIncompatiblePersistFile, err)
+	}
+	if version != PERSIST_VERSION {
+		return nil, fmt.Errorf("%w: version %d, want %d", ErrIncompatiblePersistFile, version, PERSIST_VERSION)
+	}
+	data := &persistFile{}
+	if err := gob.NewDecoder(r).Decode(data); err != nil {
+		return nil, fmt.Errorf("decode cache error:%v", err)
+	}
+	return data.Entries, nil
+}
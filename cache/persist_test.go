@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func TestPersistFile(t *testing.T) {
+	Convey("TestPersistFile", t, func() {
+		filename := filepath.Join(t.TempDir(), "test.cache")
+		entries := []*persistEntry{
+			{Request: []byte{1, 2}, Resp: []byte{3, 4}, Ttl: 60, StoreTimeSecond: 1, UpdateTimeSecond: 2, VistiedTimeSecond: 3},
+			{Request: []byte{5}, Resp: []byte{6}, Ttl: 30},
+		}
+		So(writePersistFile(filename, entries), ShouldBeNil)
+		ret, err := readPersistFile(filename)
+		So(err, ShouldBeNil)
+		So(ret, ShouldResemble, entries)
+
+		// incompatible version
+		b, _ := os.ReadFile(filename)
+		binary.BigEndian.PutUint16(b[len(PERSIST_MAGIC):], PERSIST_VERSION+1)
+		So(os.WriteFile(filename, b, 0o644), ShouldBeNil)
+		_, err = readPersistFile(filename)
+		So(err, ShouldWrap, ErrIncompatiblePersistFile)
+
+		// not a cache file
+		So(os.WriteFile(filename, []byte("{}"), 0o644), ShouldBeNil)
+		_, err = readPersistFile(filename)
+		So(err, ShouldWrap, ErrIncompatiblePersistFile)
+	})
+}
+
+func TestHandover(t *testing.T) {
+	Convey("TestHandover", t, func() {
+		cfg, err := config.Parse([]byte(fmt.Sprintf(`{
+			"inbounds": [{"listen": "127.0.0.1:0"}],
+			"groups": [{"outbounds": [{"setting": {"addr": "127.0.0.1:53"}}], "speedChecks": "none", "cache": {"cachePersist": true, "cacheFile": %q}}]
+		}`, filepath.Join(t.TempDir(), "test.cache"))))
+		So(err, ShouldBeNil)
+		old, err := NewDnsQueryCache(cfg.Groups[0])
+		So(err, ShouldBeNil)
+		storeTestEntry(old, "example.com.", dns.TypeA, "10.0.0.0")
+
+		// the entries cached since the last checkpoint are restored by the replacement
+		old.Handover()
+		c, err := NewDnsQueryCache(cfg.Groups[0])
+		So(err, ShouldBeNil)
+		So(listNames(c.List("", 0)), ShouldResemble, []string{"example.com. A"})
+
+		// the old cache does not overwrite the file on shutdown
+		storeTestEntry(old, "example.net.", dns.TypeA, "10.0.0.0")
+		old.Shutdown()
+		entries, err := readPersistFile(cfg.Groups[0].CacheConfig.CacheFile)
+		So(err, ShouldBeNil)
+		So(entries, ShouldHaveLength, 1)
+
+		storeTestEntry(c, "example.org.", dns.TypeA, "10.0.0.0")
+		c.Shutdown()
+		entries, err = readPersistFile(cfg.Groups[0].CacheConfig.CacheFile)
+		So(err, ShouldBeNil)
+		So(entries, ShouldHaveLength, 2)
+	})
+}
@@ -23,7 +23,8 @@ func NewUpdateInvoker(cfg *config.Group) (*UpdateInvoker, error) {
 	if err := cfg.Verify(); err != nil {
 		return nil, err
 	}
-	// force use fastest-ip in cache async update
+	// force use fastest-ip in cache async update,
+	// the entries keep the answers of both types, the dualstack chain before the cache selects them
 	cfg.CacheMissResponseMode = config.FASTEST_IP_RESPONSEMODE
 
 	handleInvoke, chains := chain.BuildChain(
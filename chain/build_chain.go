@@ -1,7 +1,12 @@
 package chain
 
 import (
+	"reflect"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/metrics"
 	"github.com/xsmartdns/xsmartdns/model"
 )
 
@@ -19,10 +24,66 @@ func BuildChain(chains ...Chain) (HandleInvoke, []Chain) {
 	for i := len(chains) - 1; i >= 0; i-- {
 		currentChain := chains[i]
 		nextChain := next
+		name := chainName(currentChain)
 		next = func(r *model.Message) (*dns.Msg, error) {
-			return currentChain.HandleRequest(r, nextChain)
+			// the duration excludes the following chains
+			start := time.Now()
+			timer := &nextTimer{}
+			defer func() {
+				metrics.ObserveChain(name, time.Since(start)-timer.elapsed())
+			}()
+			return currentChain.HandleRequest(r, func(r *model.Message) (*dns.Msg, error) {
+				timer.start()
+				defer timer.stop()
+				return nextChain(r)
+			})
 		}
 	}
 
 	return next, chains
 }
+
+// type name of the chain, such as cacheChain
+func chainName(c Chain) string {
+	t := reflect.TypeOf(c)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// time the following chains run, the parallel calls are counted once
+type nextTimer struct {
+	sync.Mutex
+	running int
+	since   time.Time
+	total   time.Duration
+}
+
+func (t *nextTimer) start() {
+	t.Lock()
+	defer t.Unlock()
+	if t.running == 0 {
+		t.since = time.Now()
+	}
+	t.running++
+}
+
+func (t *nextTimer) stop() {
+	t.Lock()
+	defer t.Unlock()
+	t.running--
+	if t.running == 0 {
+		t.total += time.Since(t.since)
+	}
+}
+
+// include the calls still running
+func (t *nextTimer) elapsed() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	if t.running > 0 {
+		return t.total + time.Since(t.since)
+	}
+	return t.total
+}
@@ -2,6 +2,7 @@ package chain
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	. "github.com/smartystreets/goconvey/convey"
@@ -53,4 +54,18 @@ func TestChainList(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(ret.Id, ShouldEqual, 1)
 	})
+	Convey("TestNextTimer", t, func() {
+		timer := &nextTimer{}
+		timer.start()
+		timer.start()
+		time.Sleep(20 * time.Millisecond)
+		timer.stop()
+		So(timer.elapsed(), ShouldBeGreaterThanOrEqualTo, 20*time.Millisecond)
+		timer.stop()
+		// the parallel calls are counted once
+		So(timer.elapsed(), ShouldBeLessThan, 40*time.Millisecond)
+		elapsed := timer.elapsed()
+		time.Sleep(10 * time.Millisecond)
+		So(timer.elapsed(), ShouldEqual, elapsed)
+	})
 }
@@ -7,14 +7,28 @@ import (
 	"github.com/xsmartdns/xsmartdns/cache"
 	"github.com/xsmartdns/xsmartdns/chain"
 	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/metrics"
 	"github.com/xsmartdns/xsmartdns/model"
 	"github.com/xsmartdns/xsmartdns/util"
+	"golang.org/x/sync/singleflight"
 )
 
 type cacheChain struct {
 	cfg *config.Group
 
 	cache *cache.DnsQueryCache
+	// unregister the cache size metrics
+	unregisterMetrics func()
+	// coalesce concurrent cache misses of the same question into one upstream resolution
+	missGroup singleflight.Group
+}
+
+// resolved by the leader of the coalesced requests
+type missResult struct {
+	resp   *dns.Msg
+	leader *model.Message
+	// events of the leader before resolving
+	mark int
 }
 
 func NewCacheChain(cfg *config.Group) chain.Chain {
@@ -22,27 +36,72 @@ func NewCacheChain(cfg *config.Group) chain.Chain {
 	if err != nil {
 		panic(fmt.Sprintf("create DnsQueryCache error:%v", err))
 	}
-	return &cacheChain{cfg: cfg, cache: dc}
+	unregister := metrics.RegisterCacheSize(cfg.Tag, func() (int, int64) {
+		return dc.Len(), dc.MemoryUsed()
+	})
+	return &cacheChain{cfg: cfg, cache: dc, unregisterMetrics: unregister}
 }
 
 func (c *cacheChain) HandleRequest(r *model.Message, nextChain chain.HandleInvoke) (*dns.Msg, error) {
 	// find cache
-	resp := c.cache.FindCacheResp(r.Msg)
+	resp, stale := c.cache.FindCacheResp(r)
 	if resp != nil {
+		if stale {
+			metrics.ObserveCache(c.cfg.Tag, metrics.STALE_CACHE_RESULT)
+		} else {
+			metrics.ObserveCache(c.cfg.Tag, metrics.HIT_CACHE_RESULT)
+		}
+		r.Trace.SetCacheHit(stale)
+		if stale {
+			r.Trace.Addf("cache", "serve expired, reply ttl rewritten to %d", util.GetAnswerTTL(resp))
+		} else {
+			r.Trace.Addf("cache", "hit, remaining ttl %d", util.GetAnswerTTL(resp))
+		}
 		resp.Id = r.Id
 		return resp, nil
 	}
 
 	// miss cache
-	resp, err := nextChain(r)
+	metrics.ObserveCache(c.cfg.Tag, metrics.MISS_CACHE_RESULT)
+	key, err := cache.GetRequestKey(r.Msg)
+	if err != nil {
+		return nil, err
+	}
+	r.Trace.Addf("cache", "miss")
+	v, err, shared := c.missGroup.Do(key, func() (interface{}, error) {
+		// the followers copy the trace of the leader if both are traced
+		mark := r.Trace.Mark()
+		resp, err := nextChain(r)
+		if err != nil {
+			return nil, err
+		}
+		c.cache.StoreCache(r, resp)
+		return &missResult{resp: resp, leader: r, mark: mark}, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	c.cache.StoreCache(r.Msg, resp)
+	result := v.(*missResult)
+	if result.leader != r {
+		r.Trace.CopyFrom(result.leader.Trace, result.mark)
+		r.SpeedCheckResults = append([]*model.SpeedCheckResult(nil), result.leader.SpeedCheckResults...)
+	}
+	// the resp is shared by all coalesced requests
+	resp = result.resp.Copy()
+	resp.Id = r.Id
 	util.RewriteMsgTTL(resp, 3)
+	if shared {
+		r.Trace.Addf("cache", "resolved once with the concurrent same queries")
+	}
+	r.Trace.Addf("cache", "reply ttl rewritten to 3")
 	return resp, nil
 }
 
+func (c *cacheChain) Cache() *cache.DnsQueryCache {
+	return c.cache
+}
+
 func (c *cacheChain) Shutdown() {
+	c.unregisterMetrics()
 	c.cache.Shutdown()
 }
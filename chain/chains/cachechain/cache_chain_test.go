@@ -0,0 +1,219 @@
+package cachechain
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/chain"
+	"github.com/xsmartdns/xsmartdns/chain/chains"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+// answer one ip by qtype, ipv4 is faster
+type dualstackUpstream struct {
+	invokedA    int32
+	invokedAAAA int32
+}
+
+func (u *dualstackUpstream) HandleRequest(r *model.Message, nextChain chain.HandleInvoke) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(r.Msg)
+	var rr dns.RR
+	switch r.Question[0].Qtype {
+	case dns.TypeA:
+		atomic.AddInt32(&u.invokedA, 1)
+		rr, _ = dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1.1")
+		r.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "1.1.1.1", RtMs: 10}}
+	case dns.TypeAAAA:
+		atomic.AddInt32(&u.invokedAAAA, 1)
+		rr, _ = dns.NewRR(r.Question[0].Name + " 60 IN AAAA ::1")
+		r.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "::1", RtMs: 50}}
+	}
+	resp.Answer = append(resp.Answer, rr)
+	return resp, nil
+}
+
+func (u *dualstackUpstream) Shutdown() {
+}
+
+func TestCacheChain(t *testing.T) {
+	Convey("TestCacheChain", t, func() {
+		cfg, err := config.Parse([]byte(`{"inbounds": [{"listen": "127.0.0.1:0"}], "groups": [{"tag": "cachechain_test", "outbounds": [{"setting": {"addr": "127.0.0.1:1"}}]}]}`))
+		So(err, ShouldBeNil)
+		c := NewCacheChain(cfg.Groups[0]).(*cacheChain)
+		defer c.Shutdown()
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		invoked := int32(0)
+		failed := int32(0)
+		next := func(r *model.Message) (*dns.Msg, error) {
+			r.Trace.Addf("speedSort", "resolved by the leader")
+			r.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "1.1.1.1", RtMs: 10}}
+			if atomic.AddInt32(&invoked, 1) == 1 {
+				close(started)
+			}
+			<-release
+			if atomic.LoadInt32(&failed) == 1 {
+				return nil, errors.New("upstream failed")
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(r.Msg)
+			rr, _ := dns.NewRR("example.com. 60 IN A 1.1.1.1")
+			resp.Answer = append(resp.Answer, rr)
+			return resp, nil
+		}
+		// called in goroutines, the error is asserted by the caller
+		query := func(id uint16, trace *model.Trace) (*model.Message, *dns.Msg, error) {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = id
+			r := model.WrapDnsMsg(req)
+			r.Trace = trace
+			resp, err := c.HandleRequest(r, next)
+			return r, resp, err
+		}
+
+		Convey("the concurrent same queries resolve once", func() {
+			wg := sync.WaitGroup{}
+			msgs := make([]*model.Message, 5)
+			resps := make([]*dns.Msg, 5)
+			errs := make([]error, 5)
+			for i := range resps {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					msgs[i], resps[i], errs[i] = query(uint16(i+1), nil)
+				}()
+				if i == 0 {
+					<-started
+				}
+			}
+			// the followers join the pending resolution
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&invoked), ShouldEqual, 1)
+			for i, resp := range resps {
+				So(errs[i], ShouldBeNil)
+				So(resp.Id, ShouldEqual, i+1)
+				So(resp.Answer[0].Header().Ttl, ShouldEqual, 3)
+				// not traced if the trace is not requested
+				So(msgs[i].Trace, ShouldBeNil)
+			}
+			// copies of the shared resp
+			resps[1].Answer[0].(*dns.A).A = nil
+			So(resps[2].Answer[0].(*dns.A).A.String(), ShouldEqual, "1.1.1.1")
+		})
+
+		Convey("the followers share the failure of the leader", func() {
+			atomic.StoreInt32(&failed, 1)
+			wg := sync.WaitGroup{}
+			errs := make([]error, 3)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, _, errs[i] = query(uint16(i+1), nil)
+				}()
+				if i == 0 {
+					<-started
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(atomic.LoadInt32(&invoked), ShouldEqual, 1)
+			for _, err := range errs {
+				So(err, ShouldNotBeNil)
+			}
+			// the failure is not cached
+			atomic.StoreInt32(&failed, 0)
+			_, resp, err := query(4, nil)
+			So(err, ShouldBeNil)
+			So(resp.Id, ShouldEqual, 4)
+			So(atomic.LoadInt32(&invoked), ShouldEqual, 2)
+		})
+
+		Convey("the followers copy the trace of the leader", func() {
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				query(1, model.NewTrace())
+			}()
+			<-started
+			var follower *model.Message
+			var resp *dns.Msg
+			var err error
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				follower, resp, err = query(2, model.NewTrace())
+			}()
+			// the follower joins the pending resolution
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			So(err, ShouldBeNil)
+			So(resp.Id, ShouldEqual, 2)
+			So(follower.SpeedCheckResults, ShouldHaveLength, 1)
+			messages := make([]string, 0)
+			for _, e := range follower.Trace.Events() {
+				messages = append(messages, e.Message)
+			}
+			So(messages, ShouldContain, "resolved by the leader")
+			So(messages, ShouldContain, "resolved once with the concurrent same queries")
+			// the miss of the leader is not copied
+			misses := 0
+			for _, m := range messages {
+				if m == "miss" {
+					misses++
+				}
+			}
+			So(misses, ShouldEqual, 1)
+		})
+	})
+	Convey("the dualstack preferred query through the cache", t, func() {
+		cfg, err := config.Parse([]byte(`{"inbounds": [{"listen": "127.0.0.1:0"}], "groups": [{"tag": "cachechain_dualstack_test", "outbounds": [{"setting": {"addr": "127.0.0.1:1"}}]}]}`))
+		So(err, ShouldBeNil)
+		u := &dualstackUpstream{}
+		handleInvoke, built := chain.BuildChain(chains.NewDualstackChain(cfg.Groups[0]), NewCacheChain(cfg.Groups[0]), u)
+		defer built[1].Shutdown()
+		query := func(qtype uint16) *dns.Msg {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", qtype)
+			resp, err := handleInvoke(model.WrapDnsMsg(req))
+			So(err, ShouldBeNil)
+			return resp
+		}
+
+		So(query(dns.TypeA).Answer, ShouldHaveLength, 1)
+		So(atomic.LoadInt32(&u.invokedA), ShouldEqual, 1)
+		// the preferred A is served by the cache with its speed check results
+		So(query(dns.TypeAAAA).Answer, ShouldBeEmpty)
+		So(atomic.LoadInt32(&u.invokedA), ShouldEqual, 1)
+		So(atomic.LoadInt32(&u.invokedAAAA), ShouldEqual, 1)
+		// the AAAA answer is cached, the decision answers empty
+		So(query(dns.TypeAAAA).Answer, ShouldBeEmpty)
+		So(atomic.LoadInt32(&u.invokedAAAA), ShouldEqual, 1)
+		entries := built[1].(*cacheChain).Cache().List("", 0)
+		So(entries, ShouldHaveLength, 2)
+		So(entries[0].Answers, ShouldHaveLength, 1)
+	})
+}
@@ -0,0 +1,160 @@
+package chains
+
+import (
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/chain"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+	"github.com/xsmartdns/xsmartdns/util/timeutil"
+)
+
+const (
+	// min seconds to keep a dualstack decision
+	MIN_DUALSTACK_DECISION_TTL = 30
+	// sweep expired decisions every this number of new decisions
+	DUALSTACK_DECISION_SWEEP_INTERVAL = 1024
+)
+
+// like smartdns dualstack-ip-selection
+// query the preferred ip type in parallel when query the other one,
+// answer the other type empty if the preferred type is faster than the threshold,
+// placed before the cache chain so both queries are served by the cache and the decisions are made in one place
+type dualstackChain struct {
+	sync.Mutex
+	cfg           *config.Group
+	preferredType uint16
+	otherType     uint16
+	// decisions by lower host, keep the answers of both types consistent
+	decisions map[string]*dualstackDecision
+	added     int
+}
+
+type dualstackDecision struct {
+	// answer the other type empty
+	empty            bool
+	ttl              uint32
+	expireTimeSecond int64
+}
+
+func NewDualstackChain(cfg *config.Group) chain.Chain {
+	c := &dualstackChain{cfg: cfg, preferredType: dns.TypeA, otherType: dns.TypeAAAA, decisions: make(map[string]*dualstackDecision)}
+	if cfg.DualstackIpPreference == config.IPV6_IP_FAMILY {
+		c.preferredType, c.otherType = dns.TypeAAAA, dns.TypeA
+	}
+	return c
+}
+
+func (c *dualstackChain) HandleRequest(r *model.Message, nextChain chain.HandleInvoke) (*dns.Msg, error) {
+	// need speed check to select
+	if c.cfg.DisableDualstackIpSelection || c.cfg.CacheMissResponseMode == config.FASTEST_RESPONSE_RESPONSEMODE || c.cfg.SpeedChecks.Disabled() {
+		return nextChain(r)
+	}
+	question, err := util.GetQuestion(r.Msg)
+	if err != nil || question.Qtype != c.otherType {
+		return nextChain(r)
+	}
+	host := strings.ToLower(question.Name)
+	if decision, ok := c.getDecision(host); ok {
+		if decision.empty {
+			r.Trace.Addf("dualstack", "answer empty %s by the decision of %s faster, ttl %d", dns.Type(c.otherType).String(),
+				dns.Type(c.preferredType).String(), decision.ttl)
+			return util.EmptyReply(r.Msg, decision.ttl), nil
+		}
+		return nextChain(r)
+	}
+
+	// query the preferred type in parallel
+	preferred := &model.Message{Msg: r.Copy(), InvokeConfig: r.InvokeConfig}
+	preferred.Question[0].Qtype = c.preferredType
+	preferredDone := make(chan *dns.Msg, 1)
+	go func() {
+		resp, err := nextChain(preferred)
+		if err != nil {
+			log.Debuf("dualstack query %s %s error:%v", question.Name, dns.Type(c.preferredType).String(), err)
+		}
+		preferredDone <- resp
+	}()
+
+	resp, err := nextChain(r)
+	if err != nil {
+		return resp, err
+	}
+	preferredResp := <-preferredDone
+	if preferredResp == nil {
+		return resp, nil
+	}
+	preferredRtMs, preferredMeasured := minRtMs(preferred.SpeedCheckResults)
+	otherRtMs, otherMeasured := minRtMs(r.SpeedCheckResults)
+	// can not compare, such as the probes are saturated
+	if !preferredMeasured || !otherMeasured || preferredRtMs == math.MaxInt64 {
+		r.Trace.Addf("dualstack", "can not compare %s %s with %s %s", dns.Type(c.preferredType).String(), formatRtMs(preferredRtMs),
+			dns.Type(c.otherType).String(), formatRtMs(otherRtMs))
+		return resp, nil
+	}
+	ttl := max(min(util.GetAnswerTTL(preferredResp), util.GetAnswerTTL(resp)), MIN_DUALSTACK_DECISION_TTL)
+	decision := &dualstackDecision{
+		empty:            otherRtMs == math.MaxInt64 || preferredRtMs+*c.cfg.DualstackIpSelectionThreshold < otherRtMs,
+		ttl:              ttl,
+		expireTimeSecond: timeutil.NowSecond() + int64(ttl),
+	}
+	c.setDecision(host, decision)
+	r.Trace.Addf("dualstack", "%s %s, %s %s, threshold %dms, answer empty %s: %t", dns.Type(c.preferredType).String(), formatRtMs(preferredRtMs),
+		dns.Type(c.otherType).String(), formatRtMs(otherRtMs), *c.cfg.DualstackIpSelectionThreshold, dns.Type(c.otherType).String(), decision.empty)
+	if !decision.empty {
+		return resp, nil
+	}
+	log.Debuf("dualstack select %s %s %dms, answer empty %s %dms", question.Name, dns.Type(c.preferredType).String(), preferredRtMs,
+		dns.Type(c.otherType).String(), otherRtMs)
+	return util.EmptyReply(r.Msg, ttl), nil
+}
+
+func (c *dualstackChain) Shutdown() {
+}
+
+func (c *dualstackChain) getDecision(host string) (*dualstackDecision, bool) {
+	c.Lock()
+	defer c.Unlock()
+	decision, ok := c.decisions[host]
+	if !ok || decision.expireTimeSecond < timeutil.NowSecond() {
+		return nil, false
+	}
+	return decision, true
+}
+
+func (c *dualstackChain) setDecision(host string, decision *dualstackDecision) {
+	c.Lock()
+	defer c.Unlock()
+	c.added++
+	if c.added >= DUALSTACK_DECISION_SWEEP_INTERVAL {
+		c.added = 0
+		now := timeutil.NowSecond()
+		for k, v := range c.decisions {
+			if v.expireTimeSecond < now {
+				delete(c.decisions, k)
+			}
+		}
+	}
+	c.decisions[host] = decision
+}
+
+// min rt of the checked results, math.MaxInt64 if all checked ones failed, measured is false if none checked
+func minRtMs(results []*model.SpeedCheckResult) (rtMs int64, measured bool) {
+	rtMs = math.MaxInt64
+	for _, result := range results {
+		if result.RtMs == speedcheck.UNKNOWN_RT_MS {
+			continue
+		}
+		measured = true
+		if result.RtMs >= 0 && result.RtMs < math.MaxInt32 && result.RtMs < rtMs {
+			rtMs = result.RtMs
+		}
+	}
+	return rtMs, measured
+}
@@ -0,0 +1,127 @@
+package chains
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+func TestDualstackChain(t *testing.T) {
+	Convey("TestDualstackChain", t, func() {
+		newCfg := func() *config.Group {
+			cfg := &config.Group{Outbounds: []*config.Outbound{{}}}
+			cfg.FillDefault()
+			return cfg
+		}
+		// answer one ip with rt by qtype
+		mockNext := func(rtA, rtAAAA int64, invoked *int32) func(r *model.Message) (*dns.Msg, error) {
+			return func(r *model.Message) (*dns.Msg, error) {
+				atomic.AddInt32(invoked, 1)
+				resp := new(dns.Msg)
+				resp.SetReply(r.Msg)
+				switch r.Question[0].Qtype {
+				case dns.TypeA:
+					rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 1.1.1.1")
+					resp.Answer = append(resp.Answer, rr)
+					r.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "1.1.1.1", RtMs: rtA}}
+				case dns.TypeAAAA:
+					rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN AAAA ::1")
+					resp.Answer = append(resp.Answer, rr)
+					r.SpeedCheckResults = []*model.SpeedCheckResult{{Ip: "::1", RtMs: rtAAAA}}
+				}
+				return resp, nil
+			}
+		}
+		query := func(c *dualstackChain, qtype uint16, next func(r *model.Message) (*dns.Msg, error)) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", qtype)
+			resp, err := c.HandleRequest(model.WrapDnsMsg(r), next)
+			So(err, ShouldBeNil)
+			return resp
+		}
+
+		Convey("ipv4 faster", func() {
+			c := NewDualstackChain(newCfg()).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(10, 50, &invoked))
+			So(resp.Answer, ShouldBeEmpty)
+			So(resp.Ns, ShouldHaveLength, 1)
+			So(invoked, ShouldEqual, 2)
+			// decision cached
+			resp = query(c, dns.TypeAAAA, mockNext(10, 50, &invoked))
+			So(resp.Answer, ShouldBeEmpty)
+			So(invoked, ShouldEqual, 2)
+			// preferred type not changed
+			resp = query(c, dns.TypeA, mockNext(10, 50, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("within threshold", func() {
+			c := NewDualstackChain(newCfg()).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(10, 15, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			resp = query(c, dns.TypeAAAA, mockNext(10, 15, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			So(invoked, ShouldEqual, 3)
+		})
+
+		Convey("the other type is unknown", func() {
+			c := NewDualstackChain(newCfg()).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(10, speedcheck.UNKNOWN_RT_MS, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			// not decided
+			resp = query(c, dns.TypeAAAA, mockNext(10, speedcheck.UNKNOWN_RT_MS, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			So(invoked, ShouldEqual, 4)
+		})
+
+		Convey("the preferred type is unknown", func() {
+			c := NewDualstackChain(newCfg()).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(speedcheck.UNKNOWN_RT_MS, 50, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("the other type failed", func() {
+			c := NewDualstackChain(newCfg()).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(10, math.MaxInt64, &invoked))
+			So(resp.Answer, ShouldBeEmpty)
+		})
+
+		Convey("prefer ipv6", func() {
+			cfg := newCfg()
+			cfg.DualstackIpPreference = config.IPV6_IP_FAMILY
+			c := NewDualstackChain(cfg).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(50, 10, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			resp = query(c, dns.TypeA, mockNext(50, 10, &invoked))
+			So(resp.Answer, ShouldBeEmpty)
+		})
+
+		Convey("disabled", func() {
+			cfg := newCfg()
+			cfg.DisableDualstackIpSelection = true
+			c := NewDualstackChain(cfg).(*dualstackChain)
+			invoked := int32(0)
+			resp := query(c, dns.TypeAAAA, mockNext(10, 50, &invoked))
+			So(resp.Answer, ShouldHaveLength, 1)
+			So(invoked, ShouldEqual, 1)
+		})
+	})
+}
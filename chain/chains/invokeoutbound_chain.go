@@ -3,11 +3,14 @@ package chains
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/xsmartdns/xsmartdns/chain"
 	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/dnstap"
 	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
 	"github.com/xsmartdns/xsmartdns/model"
 	"github.com/xsmartdns/xsmartdns/outbound"
 	"github.com/xsmartdns/xsmartdns/util"
@@ -16,14 +19,22 @@ import (
 type invokeOutboundChain struct {
 	cfg       *config.Group
 	outbounds []outbound.Outbound
+	// outbound names for trace and metrics
+	names []string
+	// dnstap of the outbounds
+	forwarders []*dnstap.Forwarder
 }
 
 func NewInvokeOutboundChain(cfg *config.Group) chain.Chain {
 	outbounds := make([]outbound.Outbound, 0, len(cfg.Outbounds))
+	names := make([]string, 0, len(cfg.Outbounds))
+	forwarders := make([]*dnstap.Forwarder, 0, len(cfg.Outbounds))
 	for _, c := range cfg.Outbounds {
 		outbounds = append(outbounds, initOutbound(c))
+		names = append(names, OutboundName(c))
+		forwarders = append(forwarders, dnstap.NewForwarder(c))
 	}
-	return &invokeOutboundChain{cfg: cfg, outbounds: outbounds}
+	return &invokeOutboundChain{cfg: cfg, outbounds: outbounds, names: names, forwarders: forwarders}
 }
 
 func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.HandleInvoke) (*dns.Msg, error) {
@@ -31,15 +42,23 @@ func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.Ha
 	ch := make(chan *invokeResp, len(c.outbounds))
 	for i, o := range c.outbounds {
 		wg.Add(1)
-		go func(idx int) {
+		// count the pending upstream before the trace may be waited
+		done := r.Trace.StartUpstream(i, c.names[i])
+		go func(idx int, done func(*dns.Msg, error)) {
 			defer wg.Done()
+			start := time.Now()
+			c.forwarders[idx].Query(r.Msg, start)
 			resp, err := o.Invoke(r)
+			end := time.Now()
+			c.forwarders[idx].Response(resp, start, end)
+			metrics.ObserveOutbound(c.cfg.Tag, c.names[idx], end.Sub(start), err)
+			done(resp, err)
 			ch <- &invokeResp{
 				outboundIdx: idx,
 				resp:        resp,
 				err:         err,
 			}
-		}(i)
+		}(i, done)
 	}
 
 	switch c.cfg.CacheMissResponseMode {
@@ -48,6 +67,8 @@ func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.Ha
 		if firstResp.err != nil {
 			return nil, fmt.Errorf("[FIRST_PING_RESPONSEMODE]invoke outbound[%d] error:%v", firstResp.outboundIdx, firstResp.err)
 		}
+		metrics.ObserveOutboundWin(c.cfg.Tag, c.names[firstResp.outboundIdx])
+		r.Trace.SetWinner(c.names[firstResp.outboundIdx])
 		// must last chain
 		return firstResp.resp, nil
 	case config.FASTEST_IP_RESPONSEMODE:
@@ -59,6 +80,11 @@ func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.Ha
 				log.Warnf("[FASTEST_IP_RESPONSEMODE]invoke outbound[%d] error:%v", resp.outboundIdx, resp.err)
 				continue
 			}
+			// the first succeed resp is the base of the merged answer
+			if len(msgs) == 0 {
+				metrics.ObserveOutboundWin(c.cfg.Tag, c.names[resp.outboundIdx])
+				r.Trace.SetWinner(c.names[resp.outboundIdx])
+			}
 			msgs = append(msgs, resp.resp)
 		}
 		// not any resp succeed
@@ -67,7 +93,8 @@ func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.Ha
 		}
 		// merge all msgs
 		if len(msgs) > 1 {
-			util.MergeAllAnswer(msgs[0], msgs[1:]...)
+			r.Trace.Addf("invokeOutbound", "merge the answers of %d outbounds", len(msgs))
+			return util.MergeAllAnswer(msgs[0], msgs[1:]...), nil
 		}
 		// must last chain
 		return msgs[0], nil
@@ -76,6 +103,8 @@ func (c *invokeOutboundChain) HandleRequest(r *model.Message, nextChain chain.Ha
 		if firstResp.err != nil {
 			return nil, fmt.Errorf("[FASTEST_RESPONSE_RESPONSEMODE]invoke outbound[%d] error:%v", firstResp.outboundIdx, firstResp.err)
 		}
+		metrics.ObserveOutboundWin(c.cfg.Tag, c.names[firstResp.outboundIdx])
+		r.Trace.SetWinner(c.names[firstResp.outboundIdx])
 		// must last chain
 		return firstResp.resp, nil
 	default:
@@ -92,6 +121,19 @@ type invokeResp struct {
 	err         error
 }
 
+// name of the outbound for trace, eg: udp://223.5.5.5:53
+func OutboundName(c *config.Outbound) string {
+	switch {
+	case c.DnsSetting != nil:
+		return fmt.Sprintf("%s://%s", c.DnsSetting.Net, c.DnsSetting.Addr)
+	case c.Sock5Setting != nil:
+		return c.Sock5Setting.Addr
+	case c.HttpsSetting != nil:
+		return c.HttpsSetting.Addr
+	}
+	return string(c.Protocol)
+}
+
 func initOutbound(c *config.Outbound) outbound.Outbound {
 	switch c.Protocol {
 	case config.DNS_PROTOCOL:
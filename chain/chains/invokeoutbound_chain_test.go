@@ -0,0 +1,53 @@
+package chains
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/dnstap"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/outbound"
+)
+
+type mockOutbound struct {
+	// block until closed if not nil
+	release chan struct{}
+}
+
+func (o *mockOutbound) Invoke(r *model.Message) (*dns.Msg, error) {
+	if o.release != nil {
+		<-o.release
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(r.Msg)
+	return resp, nil
+}
+
+func TestInvokeOutboundChain(t *testing.T) {
+	Convey("wait the upstreams still running after answered", t, func() {
+		cfg := &config.Group{Outbounds: []*config.Outbound{{}, {}}}
+		cfg.FillDefault()
+		slow := &mockOutbound{release: make(chan struct{})}
+		c := &invokeOutboundChain{
+			cfg:        cfg,
+			outbounds:  []outbound.Outbound{&mockOutbound{}, slow},
+			names:      []string{"fast", "slow"},
+			forwarders: make([]*dnstap.Forwarder, 2),
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		msg := model.WrapDnsMsg(r)
+		msg.Trace = model.NewTrace()
+		_, err := c.HandleRequest(msg, nil)
+		So(err, ShouldBeNil)
+		So(msg.Trace.Winner(), ShouldEqual, "fast")
+		So(msg.Trace.Wait(10*time.Millisecond), ShouldBeFalse)
+
+		close(slow.release)
+		So(msg.Trace.Wait(time.Second), ShouldBeTrue)
+		So(msg.Trace.Upstreams(), ShouldHaveLength, 2)
+	})
+}
@@ -23,6 +23,9 @@ func (c *removeruplicateChain) HandleRequest(r *model.Message, nextChain chain.H
 	}
 	resp.Answer = util.RemoveDuplicateRR(resp.Answer)
 	if c.cfg.MaxIpsNumber != nil {
+		if n := len(resp.Answer); int64(n) > *c.cfg.MaxIpsNumber {
+			r.Trace.Addf("removeDuplicate", "limit %d answers to maxIpsNumber %d", n, *c.cfg.MaxIpsNumber)
+		}
 		resp.Answer = util.LenLimit(resp.Answer, *c.cfg.MaxIpsNumber)
 	}
 	resp.Ns = util.RemoveDuplicateRR(resp.Ns)
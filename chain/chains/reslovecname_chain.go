@@ -34,6 +34,9 @@ func (c *resloveCnameChain) HandleRequest(r *model.Message, nextChain chain.Hand
 	}
 	// remove all cname answers if have any ip answer
 	if haveIp {
+		if removed := len(resp.Answer) - len(others); removed > 0 {
+			r.Trace.Addf("resolveCname", "remove %d cname answers", removed)
+		}
 		resp.Answer = others
 	}
 	return resp, nil
@@ -2,9 +2,9 @@ package chains
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sort"
-	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/xsmartdns/xsmartdns/chain"
@@ -29,7 +29,7 @@ func NewSpeedSortChain(cfg *config.Group) chain.Chain {
 
 func (c *speedSortChain) HandleRequest(r *model.Message, nextChain chain.HandleInvoke) (*dns.Msg, error) {
 	// FASTEST_RESPONSE_RESPONSEMODE not should speedtest
-	if c.cfg.CacheMissResponseMode == config.FASTEST_RESPONSE_RESPONSEMODE {
+	if c.cfg.CacheMissResponseMode == config.FASTEST_RESPONSE_RESPONSEMODE || c.cfg.SpeedChecks.Disabled() {
 		return nextChain(r)
 	}
 	resp, err := nextChain(r)
@@ -43,20 +43,37 @@ func (c *speedSortChain) HandleRequest(r *model.Message, nextChain chain.HandleI
 	}
 
 	// speed check
-	resaults := c.speedCheck(r, ipRRs, c.cfg.CacheMissResponseMode == config.FIRST_PING_RESPONSEMODE)
-	// sort rr by rt
-	sort.Slice(resaults, func(i, j int) bool {
-		return resaults[i].rtMs < resaults[j].rtMs
+	onlyfirstResponse := c.cfg.CacheMissResponseMode == config.FIRST_PING_RESPONSEMODE
+	resaults := c.speedCheck(r, ipRRs, onlyfirstResponse)
+	succeeded := false
+	for _, ret := range resaults {
+		succeeded = succeeded || (ret.rtMs >= 0 && ret.rtMs < math.MaxInt32)
+	}
+	// sort rr by rt, the unknown ones keep the upstream order
+	sort.SliceStable(resaults, func(i, j int) bool {
+		return sortRtMs(resaults[i].rtMs) < sortRtMs(resaults[j].rtMs)
 	})
+	r.SpeedCheckResults = make([]*model.SpeedCheckResult, 0, len(resaults))
+	for _, ret := range resaults {
+		r.SpeedCheckResults = append(r.SpeedCheckResults, &model.SpeedCheckResult{Ip: util.GetIp(ret.rr), RtMs: ret.rtMs})
+	}
 	minRtMs := resaults[0].rtMs
 	ipRRs = make([]dns.RR, 0, len(ipRRs))
 	for i := 0; i < len(resaults); i++ {
 		ret := resaults[i]
 		rtRise := ret.rtMs - minRtMs
-		// ip too slow
-		if i > 0 && rtRise > MIN_SLOW_LATENCY_MILL && float64(rtRise)/float64(minRtMs) > float64(SLOW_LATENCY_PERCENT_THRESHOLD) {
+		// first ping answers the checked ones, all kept if none succeeded
+		if onlyfirstResponse && succeeded && ret.rtMs == speedcheck.UNKNOWN_RT_MS {
+			r.Trace.Addf("speedSort", "drop %s not checked", util.GetIp(ret.rr))
+			continue
+		}
+		// ip too slow, the unknown ones are kept
+		if i > 0 && minRtMs >= 0 && ret.rtMs >= 0 && rtRise > MIN_SLOW_LATENCY_MILL && float64(rtRise)/float64(minRtMs) > float64(SLOW_LATENCY_PERCENT_THRESHOLD) {
+			r.Trace.Addf("speedSort", "drop %s %s, slower than the fastest %dms by over %dms and %.0f%%",
+				util.GetIp(ret.rr), formatRtMs(ret.rtMs), minRtMs, MIN_SLOW_LATENCY_MILL, SLOW_LATENCY_PERCENT_THRESHOLD*100)
 			continue
 		}
+		r.Trace.Addf("speedSort", "keep %s %s", util.GetIp(ret.rr), formatRtMs(ret.rtMs))
 		ipRRs = append(ipRRs, ret.rr)
 	}
 
@@ -67,46 +84,102 @@ func (c *speedSortChain) HandleRequest(r *model.Message, nextChain chain.HandleI
 func (c *speedSortChain) Shutdown() {
 }
 
+// results in order of ipRRs
 func (c *speedSortChain) speedCheck(msg *model.Message, ipRRs []dns.RR, onlyfirstResponse bool) []*sppedTestResault {
+	resaults := make([]*sppedTestResault, len(ipRRs))
+	unchecked := make([]dns.RR, 0, len(ipRRs))
+	for i, rr := range ipRRs {
+		// multi speed check(cache prefetch) always probe to refresh the latency cache
+		if msg.InvokeConfig.SpeedCheckTimes <= 1 {
+			if rtMs, ok := speedcheck.GetLatency(util.GetIp(rr), c.cfg.SpeedChecks); ok {
+				msg.Trace.Addf("speedSort", "%s %dms by cached latency", util.GetIp(rr), rtMs)
+				resaults[i] = &sppedTestResault{rr: rr, rtMs: rtMs}
+				continue
+			}
+		}
+		unchecked = append(unchecked, rr)
+	}
+	if len(unchecked) == 0 {
+		return resaults
+	}
+	var probed []*sppedTestResault
+	if onlyfirstResponse && len(unchecked) < len(ipRRs) {
+		// answer by cached latency, probe the others in background to fill the latency cache
+		msg.Trace.Addf("speedSort", "answer by cached latency, probe %d ips in background", len(unchecked))
+		probed = make([]*sppedTestResault, 0, len(unchecked))
+		for _, rr := range unchecked {
+			speedcheck.SpeedCheckAsync(msg, rr, c.cfg)
+			probed = append(probed, &sppedTestResault{rr: rr, rtMs: speedcheck.UNKNOWN_RT_MS})
+		}
+	} else {
+		probed = c.probe(msg, unchecked, onlyfirstResponse)
+	}
+	for i := range resaults {
+		if resaults[i] == nil {
+			resaults[i], probed = probed[0], probed[1:]
+		}
+	}
+	return resaults
+}
+
+// results in order of ipRRs
+func (c *speedSortChain) probe(msg *model.Message, ipRRs []dns.RR, onlyfirstResponse bool) []*sppedTestResault {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	wg := sync.WaitGroup{}
-	ch := make(chan *sppedTestResault, len(ipRRs))
-	for _, rr := range ipRRs {
-		wg.Add(1)
-		go func(rr dns.RR) {
-			defer wg.Done()
+	type probed struct {
+		idx     int
+		resault *sppedTestResault
+	}
+	ch := make(chan *probed, len(ipRRs))
+	for i, rr := range ipRRs {
+		go func() {
+			ip := util.GetIp(rr)
 			rtMs := speedcheck.SpeedCheckSync(ctx, msg, rr, c.cfg)
-			ch <- &sppedTestResault{
-				rr:   rr,
-				rtMs: rtMs,
+			if rtMs == speedcheck.UNKNOWN_RT_MS {
+				// the probes are saturated, reuse the cached latency
+				if cached, ok := speedcheck.GetLatency(ip, c.cfg.SpeedChecks); ok {
+					msg.Trace.Addf("speedSort", "%s %dms by cached latency, the probes are saturated", ip, cached)
+					rtMs = cached
+				}
 			}
-		}(rr)
+			ch <- &probed{idx: i, resault: &sppedTestResault{rr: rr, rtMs: rtMs}}
+		}()
 	}
 	resaults := make([]*sppedTestResault, 0, len(ipRRs))
-	if onlyfirstResponse {
-		firstResp := <-ch
-		for _, rr := range ipRRs {
-			rtMs := int64(math.MaxInt64)
-			if firstResp.rr == rr {
-				rtMs = firstResp.rtMs
-			}
-			resaults = append(resaults, &sppedTestResault{
-				rr:   rr,
-				rtMs: rtMs,
-			})
-		}
-	} else {
-		wg.Wait()
-		close(ch)
-		for ret := range ch {
-			resaults = append(resaults, ret)
+	for _, rr := range ipRRs {
+		resaults = append(resaults, &sppedTestResault{rr: rr, rtMs: speedcheck.UNKNOWN_RT_MS})
+	}
+	for range ipRRs {
+		ret := <-ch
+		resaults[ret.idx] = ret.resault
+		// the unknown and failed ones not answer the first response
+		if onlyfirstResponse && ret.resault.rtMs >= 0 && ret.resault.rtMs < math.MaxInt32 {
+			msg.Trace.Addf("speedSort", "answer by the first checked ip %s %s", util.GetIp(ret.resault.rr), formatRtMs(ret.resault.rtMs))
+			break
 		}
 	}
-
 	return resaults
 }
 
+// the sort key of rt, the unknown ones after the checked ones and before the failed ones
+func sortRtMs(rtMs int64) int64 {
+	if rtMs == speedcheck.UNKNOWN_RT_MS {
+		return math.MaxInt32 - 1
+	}
+	return rtMs
+}
+
+// rt, unknown or failed
+func formatRtMs(rtMs int64) string {
+	if rtMs == speedcheck.UNKNOWN_RT_MS {
+		return "unknown"
+	}
+	if rtMs < 0 || rtMs >= math.MaxInt32 {
+		return "failed"
+	}
+	return fmt.Sprintf("%dms", rtMs)
+}
+
 type sppedTestResault struct {
 	rr   dns.RR
 	rtMs int64
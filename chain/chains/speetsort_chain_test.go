@@ -0,0 +1,104 @@
+package chains
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+const SLOW_SPEED_CHECK_TYPE = config.SpeedCheckType("slow")
+
+// 192.0.2.1 is never answered in time
+type slowChecker struct {
+}
+
+func (slowChecker) Check(ctx context.Context, target *speedcheck.Target) (int64, error) {
+	if target.Ip != "192.0.2.1" {
+		return 5, nil
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+	return 0, errors.New("timeout")
+}
+
+func TestSpeedSortChain(t *testing.T) {
+	Convey("TestSpeedSortChain", t, func() {
+		Convey("saturated probes keep the upstream order", func() {
+			// drop all probes
+			saturated := config.SpeedCheck{MaxInflightProbes: new(int64), MaxQueuedProbes: new(int64)}
+			saturated.FillDefault()
+			speedcheck.Init(&saturated)
+			defer func() {
+				cfg := config.SpeedCheck{}
+				cfg.FillDefault()
+				speedcheck.Init(&cfg)
+			}()
+
+			cfg := &config.Group{Outbounds: []*config.Outbound{{}}}
+			cfg.FillDefault()
+			cfg.CacheMissResponseMode = config.FASTEST_IP_RESPONSEMODE
+			cfg.SpeedChecks = config.SpeedChecks{{SpeedCheckType: config.TCP_SPEED_CHECK_TYPE, Port: 80}}
+			speedcheck.FeedLatency("10.0.0.3", cfg.SpeedChecks[0], 20)
+			// not the check of the group
+			speedcheck.FeedLatency("10.0.0.2", &config.SpeedCheckConfig{SpeedCheckType: config.TCP_SPEED_CHECK_TYPE, Port: 443}, 10)
+			c := NewSpeedSortChain(cfg)
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			msg := model.WrapDnsMsg(r)
+			// the prefetch skips the cached latency before probing
+			msg.InvokeConfig.SpeedCheckTimes = 2
+			resp, err := c.HandleRequest(msg, func(r *model.Message) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.SetReply(r.Msg)
+				for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+					rr, _ := dns.NewRR("example.com. 60 IN A " + ip)
+					resp.Answer = append(resp.Answer, rr)
+				}
+				return resp, nil
+			})
+			So(err, ShouldBeNil)
+			ips := make([]string, 0)
+			for _, rr := range resp.Answer {
+				ips = append(ips, util.GetIp(rr))
+			}
+			So(ips, ShouldResemble, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"})
+			So(msg.SpeedCheckResults[0].RtMs, ShouldEqual, 20)
+			So(msg.SpeedCheckResults[1].RtMs, ShouldEqual, speedcheck.UNKNOWN_RT_MS)
+		})
+
+		Convey("first ping reports the not checked ips unknown", func() {
+			speedcheck.Register(SLOW_SPEED_CHECK_TYPE, slowChecker{})
+			cfg := &config.Group{Outbounds: []*config.Outbound{{}}}
+			cfg.FillDefault()
+			cfg.SpeedChecks = config.SpeedChecks{{SpeedCheckType: SLOW_SPEED_CHECK_TYPE}}
+			c := NewSpeedSortChain(cfg)
+			r := new(dns.Msg)
+			r.SetQuestion("example.org.", dns.TypeA)
+			msg := model.WrapDnsMsg(r)
+			resp, err := c.HandleRequest(msg, func(r *model.Message) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.SetReply(r.Msg)
+				for _, ip := range []string{"192.0.2.1", "127.0.0.1"} {
+					rr, _ := dns.NewRR("example.org. 60 IN A " + ip)
+					resp.Answer = append(resp.Answer, rr)
+				}
+				return resp, nil
+			})
+			So(err, ShouldBeNil)
+			So(resp.Answer, ShouldHaveLength, 1)
+			So(util.GetIp(resp.Answer[0]), ShouldEqual, "127.0.0.1")
+			So(msg.SpeedCheckResults[1].Ip, ShouldEqual, "192.0.2.1")
+			So(msg.SpeedCheckResults[1].RtMs, ShouldEqual, speedcheck.UNKNOWN_RT_MS)
+		})
+	})
+}
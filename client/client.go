@@ -0,0 +1,99 @@
+package client
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/arp"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
+)
+
+// match the client group of a client ip, reloadable
+type Matcher struct {
+	groups atomic.Pointer[[]*Group]
+}
+
+// policy of the matched clients
+type Group struct {
+	Cfg      *config.ClientGroup
+	prefixes []netip.Prefix
+	// normalized macs
+	macs    map[string]struct{}
+	limiter *ratelimit.KeyedLimiter[netip.Addr]
+}
+
+func NewMatcher(cfgs []*config.ClientGroup) *Matcher {
+	m := &Matcher{}
+	m.Reload(cfgs)
+	return m
+}
+
+// the rate limit counters restart
+func (m *Matcher) Reload(cfgs []*config.ClientGroup) {
+	groups := make([]*Group, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		groups = append(groups, newGroup(cfg))
+	}
+	m.groups.Store(&groups)
+}
+
+func newGroup(cfg *config.ClientGroup) *Group {
+	// verified by config
+	prefixes, _ := util.ParsePrefixes(cfg.Cidrs)
+	g := &Group{Cfg: cfg, prefixes: prefixes, macs: make(map[string]struct{}, len(cfg.Macs))}
+	for _, mac := range cfg.Macs {
+		if hw, err := net.ParseMAC(mac); err == nil {
+			g.macs[hw.String()] = struct{}{}
+		}
+	}
+	if len(g.macs) > 0 {
+		arp.Start()
+	}
+	if cfg.RateLimit != nil && cfg.RateLimit.Qps > 0 {
+		g.limiter = ratelimit.NewKeyedLimiter[netip.Addr](cfg.RateLimit.Qps, int(min(cfg.RateLimit.Burst, math.MaxInt32)))
+	}
+	return g
+}
+
+// the first matched group, nil if not any matched
+func (m *Matcher) Match(ip netip.Addr) *Group {
+	if m == nil {
+		return nil
+	}
+	var mac string
+	var macLoaded bool
+	for _, g := range *m.groups.Load() {
+		if util.PrefixesContain(g.prefixes, ip) {
+			return g
+		}
+		if len(g.macs) == 0 {
+			continue
+		}
+		// lookup once and only if needed
+		if !macLoaded {
+			macLoaded = true
+			mac, _ = arp.Lookup(ip)
+		}
+		if _, ok := g.macs[mac]; ok && len(mac) > 0 {
+			return g
+		}
+	}
+	return nil
+}
+
+// take a token of the client ip
+func (g *Group) Allow(ip netip.Addr) bool {
+	if g.limiter == nil {
+		return true
+	}
+	return g.limiter.Allow(ip)
+}
+
+func (g *Group) RouteOptions() *router.RouteOptions {
+	return &router.RouteOptions{Group: g.Cfg.GroupTag, DisableBlocking: !*g.Cfg.Blocking}
+}
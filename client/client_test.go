@@ -0,0 +1,42 @@
+package client
+
+import (
+	"net/netip"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func TestMatcher(t *testing.T) {
+	Convey("TestMatcher", t, func() {
+		blocking := false
+		clients := []*config.ClientGroup{
+			{Tag: "kids", Cidrs: []string{"192.168.1.100/30"}, GroupTag: "kids", RateLimit: &config.RateLimit{Qps: 1}},
+			{Tag: "admin", Cidrs: []string{"192.168.1.0/24", "fd00::1"}, Blocking: &blocking},
+		}
+		for _, c := range clients {
+			c.FillDefault()
+		}
+		m := NewMatcher(clients)
+
+		kids := m.Match(netip.MustParseAddr("192.168.1.101"))
+		So(kids.Cfg.Tag, ShouldEqual, "kids")
+		So(kids.RouteOptions().Group, ShouldEqual, "kids")
+		So(kids.RouteOptions().DisableBlocking, ShouldBeFalse)
+		// burst 1 of each client ip
+		So(kids.Allow(netip.MustParseAddr("192.168.1.101")), ShouldBeTrue)
+		So(kids.Allow(netip.MustParseAddr("192.168.1.101")), ShouldBeFalse)
+		So(kids.Allow(netip.MustParseAddr("192.168.1.102")), ShouldBeTrue)
+
+		admin := m.Match(netip.MustParseAddr("fd00::1"))
+		So(admin.Cfg.Tag, ShouldEqual, "admin")
+		So(admin.RouteOptions().Group, ShouldBeEmpty)
+		So(admin.RouteOptions().DisableBlocking, ShouldBeTrue)
+		So(admin.Allow(netip.MustParseAddr("fd00::1")), ShouldBeTrue)
+
+		So(m.Match(netip.MustParseAddr("10.0.0.1")), ShouldBeNil)
+		m.Reload(nil)
+		So(m.Match(netip.MustParseAddr("192.168.1.101")), ShouldBeNil)
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/cache"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+// set by -ldflags "-X main.version=v1.0.0"
+var version = "dev"
+
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"run":     {usage: "run -c <config>\n\tstart the dns server", run: runCommand},
+		"check":   {usage: "check [-format json|yaml|toml] <config>\n\tvalidate the config and print it with defaults filled in", run: checkCommand},
+		"query":   {usage: "query -c <config> [-group tag] [-timeout 5s] <name> [type]\n\tresolve in process and print the rule, group, upstream answers and speed checks", run: queryCommand},
+		"convert": {usage: "convert [-format json|yaml|toml] <config> [output]\n\tconvert json, yaml, toml or smartdns.conf config, the format is detected by output extension", run: convertCommand},
+		// deprecated, replaced by convert
+		"convert-smartdns": {usage: "convert-smartdns <smartdns.conf>\n\tdeprecated, the same as convert", run: convertSmartdnsCommand},
+		"version":          {usage: "version\n\tprint build info", run: versionCommand},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [args]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(out, "\nWithout command, the flags are the same as run:\n")
+	flag.PrintDefaults()
+}
+
+// parse flags mixed with positional args
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", os.Args[0], commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse config with warnings to stderr
+func loadConfig(file string) (*config.Config, error) {
+	if config.IsSmartdnsFile(file) {
+		cfg, warnings, err := config.ParseSmartdnsFile(file)
+		printWarnings(warnings)
+		return cfg, err
+	}
+	return config.ParseFile(file)
+}
+
+func printWarnings(warnings []string) {
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+}
+
+func printError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func runCommand(args []string) int {
+	fs := newFlagSet("run")
+	fs.StringVar(&configFile, "c", "", "config file, json, yaml, toml or smartdns.conf by extension")
+	if _, err := parseArgs(fs, args); err != nil {
+		return 2
+	}
+	if len(configFile) == 0 {
+		fs.Usage()
+		return 2
+	}
+	return run()
+}
+
+func checkCommand(args []string) int {
+	fs := newFlagSet("check")
+	format := fs.String("format", string(config.JSON_FORMAT), "output format: json, yaml or toml")
+	file := fs.String("c", "", "config file, the same as the positional arg")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 1 && len(*file) == 0 {
+		*file = positional[0]
+	}
+	if len(*file) == 0 || len(positional) > 1 {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadConfig(*file)
+	if err != nil {
+		return printError(err)
+	}
+	b, err := config.Marshal(cfg, config.Format(*format))
+	if err != nil {
+		return printError(err)
+	}
+	os.Stdout.Write(b)
+	fmt.Fprintln(os.Stderr, "config is ok")
+	return 0
+}
+
+func convertCommand(args []string) int {
+	fs := newFlagSet("convert")
+	format := fs.String("format", "", "output format: json, yaml or toml, default by output extension or json")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		fs.Usage()
+		return 2
+	}
+	cfg, warnings, verify, err := config.LoadFile(positional[0])
+	printWarnings(warnings)
+	if err != nil {
+		return printError(err)
+	}
+	if len(*format) == 0 {
+		*format = string(config.JSON_FORMAT)
+		if len(positional) == 2 {
+			*format = string(config.FormatOf(positional[1]))
+		}
+	}
+	b, err := config.Marshal(cfg, config.Format(*format))
+	if err != nil {
+		return printError(err)
+	}
+	if len(positional) == 1 {
+		os.Stdout.Write(b)
+	} else if err := os.WriteFile(positional[1], b, 0o644); err != nil {
+		return printError(err)
+	}
+	// converted anyway, fix the errors in the output
+	if err := verify(); err != nil {
+		printWarnings(strings.Split(err.Error(), "\n"))
+	}
+	return 0
+}
+
+func convertSmartdnsCommand(args []string) int {
+	fmt.Fprintln(os.Stderr, "warning: convert-smartdns is deprecated, use convert")
+	return convertCommand(args)
+}
+
+func queryCommand(args []string) int {
+	fs := newFlagSet("query")
+	file := fs.String("c", "", "config file")
+	groupTag := fs.String("group", "", "query the group instead of routing")
+	timeout := fs.Duration("timeout", 5*time.Second, "max time to wait the outbounds after answered")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(*file) == 0 || len(positional) == 0 || len(positional) > 2 {
+		fs.Usage()
+		return 2
+	}
+	qtype := dns.TypeA
+	if len(positional) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(positional[1])]
+		if !ok {
+			return printError(fmt.Errorf("unknown type:%s", positional[1]))
+		}
+		qtype = t
+	}
+	cfg, err := loadConfig(*file)
+	if err != nil {
+		return printError(err)
+	}
+	// only errors to keep the output clean
+	log.Init(&config.Log{Level: "error"})
+	// not touch the cache files of the server
+	for _, g := range cfg.Groups {
+		g.CacheConfig.CachePersist = false
+	}
+	cache.Init(&cfg.Cache)
+	speedcheck.Init(&cfg.SpeedCheck)
+	groupRouter := router.NewGroupRouter(cfg)
+	defer groupRouter.Shutdown()
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(positional[0]), qtype)
+	e, err := router.Explain(groupRouter, req, *groupTag, nil, *timeout)
+	if err != nil {
+		return printError(err)
+	}
+	if e.Timeout {
+		fmt.Fprintln(os.Stderr, "warning: wait outbounds timeout")
+	}
+	printQuery(os.Stdout, e)
+	if len(e.Error) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printQuery(w io.Writer, e *router.Explanation) {
+	rule := e.Rule
+	if len(rule) == 0 {
+		rule = "not any matched"
+	}
+	fmt.Fprintf(w, ";; rule: %s\n", rule)
+	if len(e.Group) > 0 {
+		fmt.Fprintf(w, ";; group: %s\n", e.Group)
+	} else {
+		fmt.Fprintf(w, ";; group: answered by address rule\n")
+	}
+	if hit, stale := e.Trace.CacheHit(); stale {
+		fmt.Fprintf(w, ";; cache: stale\n")
+	} else if hit {
+		fmt.Fprintf(w, ";; cache: hit\n")
+	}
+	for _, u := range e.Trace.Upstreams() {
+		if len(u.Error) > 0 {
+			fmt.Fprintf(w, ";; upstream[%d] %s %dms error: %s\n", u.Index, u.Outbound, u.RtMs, u.Error)
+			continue
+		}
+		fmt.Fprintf(w, ";; upstream[%d] %s %dms %s\n", u.Index, u.Outbound, u.RtMs, u.Rcode)
+		for _, rr := range u.Answer {
+			fmt.Fprintln(w, rr)
+		}
+	}
+	if len(e.SpeedCheckResults) > 0 {
+		fmt.Fprintf(w, ";; speed check:\n")
+		for _, ret := range e.SpeedCheckResults {
+			if ret.RtMs == speedcheck.UNKNOWN_RT_MS {
+				fmt.Fprintf(w, "%s\tunknown\n", ret.Ip)
+				continue
+			}
+			if ret.RtMs < 0 || ret.RtMs >= math.MaxInt32 {
+				fmt.Fprintf(w, "%s\tfailed\n", ret.Ip)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%dms\n", ret.Ip, ret.RtMs)
+		}
+	}
+	if probes := e.Trace.SpeedChecks(); len(probes) > 0 {
+		fmt.Fprintf(w, ";; speed check probes:\n")
+		for _, p := range probes {
+			if len(p.Error) > 0 {
+				fmt.Fprintf(w, "%s\t%s\terror: %s\n", p.Ip, p.Method, p.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%dms\n", p.Ip, p.Method, p.RtMs)
+		}
+	}
+	if events := e.Trace.Events(); len(events) > 0 {
+		fmt.Fprintf(w, ";; trace:\n")
+		for _, event := range events {
+			fmt.Fprintf(w, "+%.1fms\t%s\t%s\n", event.ElapsedMs, event.Chain, event.Message)
+		}
+	}
+	if len(e.Error) > 0 {
+		fmt.Fprintf(w, ";; answer in %.0fms error: %s\n", e.DurationMs, e.Error)
+		return
+	}
+	fmt.Fprintf(w, ";; answer in %.0fms: %s\n", e.DurationMs, e.Rcode)
+	for _, rr := range e.Resp.Answer {
+		fmt.Fprintln(w, rr)
+	}
+	for _, rr := range e.Resp.Ns {
+		fmt.Fprintln(w, rr)
+	}
+}
+
+func versionCommand(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], commands["version"].usage)
+		return 2
+	}
+	info, ok := debug.ReadBuildInfo()
+	v := version
+	if ok && v == "dev" && len(info.Main.Version) > 0 && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	fmt.Printf("xsmartdns %s\n", v)
+	if ok {
+		settings := make(map[string]string)
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		if revision, ok := settings["vcs.revision"]; ok {
+			if settings["vcs.modified"] == "true" {
+				revision += "-dirty"
+			}
+			fmt.Printf("revision: %s %s\n", revision, settings["vcs.time"])
+		}
+		fmt.Printf("go: %s\n", info.GoVersion)
+	}
+	fmt.Printf("platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	return 0
+}
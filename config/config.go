@@ -8,7 +8,21 @@ type Config struct {
 	Inbounds []*Inbound `json:"inbounds"`
 	Groups   []*Group   `json:"groups"`
 	Routing  []*Rule    `json:"routing"`
-	Log      Log        `json:"log"`
+	// policies of the clients, the first matched one is used
+	Clients []*ClientGroup `json:"clients"`
+	Log     Log            `json:"log"`
+	// cache shared by groups
+	Cache SharedCache `json:"cache"`
+	// admin http api
+	Api Api `json:"api"`
+	// speed check setting shared by groups
+	SpeedCheck SpeedCheck `json:"speedCheck"`
+	// one record per query
+	QueryLog QueryLog `json:"queryLog"`
+	// dnstap of the client and forwarder messages
+	Dnstap Dnstap `json:"dnstap"`
+	// directory of the state files such as the cache files, default the working directory
+	StateDir string `json:"stateDir"`
 }
 
 type Inbound struct {
@@ -22,6 +36,14 @@ type Inbound struct {
 	TlsCert string `json:"tls_cert"`
 	// if use "tcp-tls" Net or "https" protocol, should set tls cert and tls key
 	TlsKey string `json:"tls_key"`
+	// clients allowed to get the trace of a query by CH TXT query (A of the name, or AAAA of aaaa.example.com.trace.) or EDNS option 65300, ip or CIDR, default empty disable
+	TraceClients []string `json:"traceClients"`
+	// clients allowed to query, ip or CIDR, default empty allow all
+	Allow []string `json:"allow"`
+	// clients refused, ip or CIDR, checked before allow
+	Deny []string `json:"deny"`
+	// rate limits of the clients, default no limit
+	RateLimit *InboundRateLimit `json:"rateLimit"`
 }
 
 type Group struct {
@@ -30,9 +52,10 @@ type Group struct {
 	Outbounds []*Outbound `json:"outbounds"`
 	// like smartdns response-mode. default is first-ping
 	CacheMissResponseMode CacheMissResponseMode `json:"cacheMissResponseMode"`
-	// speedChecks like xmartdns speed-check-mode, default is ping,tcp:80,tcp:443,udp:443
+	// speedChecks like smartdns speed-check-mode, default is ping,tcp:80,tcp:443
+	// a list of check config or a smartdns speed-check-mode string, "none" disable speed check
 	// execute in order until success
-	SpeedChecks []*SpeedCheckConfig `json:"speedChecks"`
+	SpeedChecks SpeedChecks `json:"speedChecks"`
 	// max number of ips to answer,default no limit
 	MaxIpsNumber *int64 `json:"maxIpsNumber"`
 	// cache config
@@ -41,17 +64,39 @@ type Group struct {
 	DisableDualstackIpSelection bool `json:"disableDualstackIpSelection"`
 	// Dualstack ip select thresholds(ms), default is 10ms
 	DualstackIpSelectionThreshold *int64 `json:"dualstackIpSelectionThreshold"`
+	// "ipv4" answer empty AAAA when ipv4 is faster, "ipv6" answer empty A when ipv6 is faster, default ipv4
+	DualstackIpPreference IpFamily `json:"dualstackIpPreference"`
 }
 
 type SpeedCheckConfig struct {
 	SpeedCheckType SpeedCheckType `json:"speedCheckType"`
 	Port           int64          `json:"port"`
+	// timeout(ms) of one check, default 2000
+	TimeoutMs *int64 `json:"timeoutMs"`
+	// http request path, only for http, default "/"
+	Path string `json:"path,omitempty"`
+	// http status codes treated as success, only for http, default empty any status
+	ExpectedStatus []int `json:"expectedStatus,omitempty"`
+	// "ttfb" time to first response byte or "connect" time to connected(include tls handshake), only for http, default ttfb
+	Measure HttpMeasure `json:"measure,omitempty"`
 }
 
 type CacheConfig struct {
 	CacheSize *int32 `json:"cacheSize"`
+	// max memory(bytes) of the cache estimated by packed message length, cacheSize is ignored when set, default 0
+	CacheMemorySize int64 `json:"cacheMemorySize"`
+	// store entries in the shared cache and limit memory by the shared cache, default false
+	UseSharedCache bool `json:"useSharedCache"`
+	// max memory(bytes) the group can use in the shared cache, default 0 no quota
+	SharedCacheQuota int64 `json:"sharedCacheQuota"`
 	// domain prefetch feature default false
 	PrefetchDomain bool `json:"prefetchDomain"`
+	// only prefetch the entries hit since the last prefetch and hit at least the times in decay window, default 2
+	PrefetchMinHits *float64 `json:"prefetchMinHits"`
+	// hits of an entry decay by half every the seconds, default 3600
+	PrefetchHitDecaySecond *int64 `json:"prefetchHitDecaySecond"`
+	// max prefetch number per second of the group, default 20, 0 no limit
+	MaxPrefetchPerSecond *int64 `json:"maxPrefetchPerSecond"`
 	// multi speed test when cache prefetchDomain
 	MultiPrefetchSpeedCheck bool `json:"multiPrefetchSpeedCheck"`
 	// cache expired feature, default false
@@ -62,6 +107,18 @@ type CacheConfig struct {
 	CacheExpiredReplyTtl *int64 `json:"cacheExpiredReplyTtl"`
 	// Prefetch time when serve expired, default 28800
 	CacheExpiredPrefetchTimeSecond *int64 `json:"cacheExpiredPrefetchTimeSecond"`
+	// max seconds to serve expired data after ttl expired(RFC 8767 max stale timer), default 259200, 0 no limit
+	CacheExpiredMaxStaleSecond *int64 `json:"cacheExpiredMaxStaleSecond"`
+	// wait refresh of expired data for the milliseconds before serving it(RFC 8767 client response timer), default 1800
+	CacheExpiredClientTimeoutMs *int64 `json:"cacheExpiredClientTimeoutMs"`
+	// serve expired data without refreshing for the seconds after a refresh failed(RFC 8767 failure recheck timer), default 30
+	CacheExpiredFailureRecheckSecond *int64 `json:"cacheExpiredFailureRecheckSecond"`
+	// persist cache to file on shutdown and restore it on startup, default false
+	CachePersist bool `json:"cachePersist"`
+	// cache persist file, default is xsmartdns.{group tag}.cache in the state dir
+	CacheFile string `json:"cacheFile"`
+	// interval(second) to save cache to file, default 86400, 0 only save on shutdown
+	CacheCheckpointTimeSecond *int64 `json:"cacheCheckpointTimeSecond"`
 }
 
 type Outbound struct {
@@ -89,29 +146,113 @@ type Sock5Setting struct {
 	Addr string `json:"addr"`
 }
 
-func (c *Sock5Setting) FillDefault() {
-}
-func (c *Sock5Setting) Verify() error {
-	return nil
-}
-
 type HttpsSetting struct {
 	// https://doh.pub/dns-query
 	Addr               string `json:"addr"`
 	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
-func (c *HttpsSetting) FillDefault() {
+type ClientGroup struct {
+	Tag string `json:"tag"`
+	// client ips or CIDRs, eg: 192.168.1.0/24
+	Cidrs []string `json:"cidrs"`
+	// client MACs looked up in the ARP table, only for the IPv4 clients in the same LAN, eg: 00:11:22:33:44:55
+	Macs []string `json:"macs"`
+	// forward to the group instead of the matched group of routing, the address rules still apply, default empty
+	GroupTag string `json:"groupTag"`
+	// answer the block address rules "#", "#4" and "#6", default true
+	Blocking *bool `json:"blocking"`
+	// queries of each client ip, default no limit
+	RateLimit *RateLimit `json:"rateLimit"`
 }
-func (c *HttpsSetting) Verify() error {
-	return nil
+
+type RateLimit struct {
+	// queries per second, 0 no limit
+	Qps float64 `json:"qps"`
+	// max queries at once, default the qps and at least 1
+	Burst int64 `json:"burst"`
+}
+
+type InboundRateLimit struct {
+	// queries of each client ip, default no limit
+	Client *RateLimit `json:"client"`
+	// queries of each client subnet, default no limit
+	Subnet *RateLimit `json:"subnet"`
+	// prefix length of the ipv4 subnets, default 24
+	Ipv4PrefixLength *int64 `json:"ipv4PrefixLength"`
+	// prefix length of the ipv6 subnets, default 56
+	Ipv6PrefixLength *int64 `json:"ipv6PrefixLength"`
+	// "refuse" answer REFUSED or "drop" not answer the queries over the limits, also for the rate limit of client groups, default refuse
+	Action RateLimitAction `json:"action"`
+	// response rate limiting of udp, default disable
+	Rrl *Rrl `json:"rrl"`
+}
+
+// limit the identical responses to a client subnet like bind rate-limit, the qps is responses per second
+type Rrl struct {
+	RateLimit
+	// every slip-th response over the limit is answered empty with TC=1 to retry by tcp, others are dropped,
+	// 0 drop all, 1 truncate all, default 2
+	Slip *int64 `json:"slip"`
 }
 
 type Rule struct {
-	// dns query domain filter, eg: geosite:cn, *.taobao.com, www.taobao.com
+	// dns query domain filter, eg: taobao.com(and subdomains), *.taobao.com, full:www.taobao.com, keyword:taobao, regexp:^taobao\.com$
 	Domain []string `json:"domain"`
 	// forward traffic to group
-	GroupTag string `json:"groupTag"`
+	GroupTag string `json:"groupTag,omitempty"`
+	// like smartdns address, answer the ips directly instead of forwarding to group,
+	// "#" answer empty for all types, "#4" empty A, "#6" empty AAAA
+	Address []string `json:"address,omitempty"`
+}
+
+type SharedCache struct {
+	// total memory(bytes) of the groups that use shared cache, default 0 disable the shared cache
+	MemorySize int64 `json:"memorySize"`
+}
+
+type SpeedCheck struct {
+	// ttl(second) of the ip latency cache shared by groups, default 300, 0 disable the cache
+	LatencyCacheTtlSecond *int64 `json:"latencyCacheTtlSecond"`
+	// EWMA smoothing factor of the new latency in (0, 1], default 0.3
+	LatencyEwmaAlpha *float64 `json:"latencyEwmaAlpha"`
+	// max number of probes running at the same time, default 64
+	MaxInflightProbes *int64 `json:"maxInflightProbes"`
+	// max number of probes waiting to run, default 1024
+	MaxQueuedProbes *int64 `json:"maxQueuedProbes"`
+	// "drop-newest" or "drop-oldest" when the queue is full, default drop-newest
+	QueueDropPolicy QueueDropPolicy `json:"queueDropPolicy"`
+	// max probes per second to one ip, default 5, 0 no limit
+	PerDestinationRate *float64 `json:"perDestinationRate"`
+	// burst probes to one ip, default 10
+	PerDestinationBurst *int64 `json:"perDestinationBurst"`
+}
+
+type Api struct {
+	// Address to listen on, eg: 127.0.0.1:8080, default empty disable the api and the /metrics of prometheus
+	Listen string `json:"listen"`
+	// token to access the api by "Authorization: Bearer {token}" header, required if listen is set
+	Token string `json:"token"`
+}
+
+type QueryLog struct {
+	// json lines file of the query records, default empty disable
+	Filename string `json:"filename"`
+	// max megabytes of the file before rotated, default 10
+	MaxSizeMb *int64 `json:"maxSizeMb"`
+	// max number of rotated files to keep, default 3
+	MaxBackups *int64 `json:"maxBackups"`
+	// number of the latest records kept in memory for the api, default 0 disable
+	MemoryRecords *int64 `json:"memoryRecords"`
+}
+
+type Dnstap struct {
+	// unix:///var/run/dnstap.sock, tcp://127.0.0.1:6000 or a file path, default empty disable
+	Output string `json:"output"`
+	// identity of the messages, default hostname
+	Identity string `json:"identity"`
+	// messages waiting to write, dropped if full, default 4096
+	BufferSize *int64 `json:"bufferSize"`
 }
 
 type Log struct {
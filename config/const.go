@@ -4,6 +4,11 @@ const (
 	DEFAULT_NET      = UDP_NET
 	DEFAULT_TAG      = "default"
 	DEFAULT_PROTOCOL = DNS_PROTOCOL
+	// schemes of the dnstap output, others are file paths
+	UNIX_DNSTAP_SCHEME = "unix://"
+	TCP_DNSTAP_SCHEME  = "tcp://"
+	// audit-file of smartdns if audit-enable without it
+	DEFAULT_SMARTDNS_AUDIT_FILE = "/var/log/smartdns/smartdns-audit.log"
 )
 
 var (
@@ -12,6 +17,28 @@ var (
 	DEFAULT_CACHEEXPIRED_REPLY_TTL_MULTIPREFETCHSPEEDCHECK = int64(15)
 	DEFAULT_CACHEEXPIRED_PREFETCH_TIMESECOND               = int64(28800)
 	DEFAULT_DUALSTACK_IP_SELECTION_THRESHOLD               = int64(10)
+	DEFAULT_SPEED_CHECK_TIMEOUT_MS                         = int64(2000)
+	DEFAULT_CACHEEXPIRED_MAX_STALE_SECOND                  = int64(259200)
+	DEFAULT_CACHEEXPIRED_CLIENT_TIMEOUT_MS                 = int64(1800)
+	DEFAULT_CACHEEXPIRED_FAILURE_RECHECK_SECOND            = int64(30)
+	DEFAULT_CACHE_CHECKPOINT_TIMESECOND                    = int64(86400)
+	DEFAULT_LATENCY_CACHE_TTL_SECOND                       = int64(300)
+	DEFAULT_LATENCY_EWMA_ALPHA                             = float64(0.3)
+	DEFAULT_MAX_INFLIGHT_PROBES                            = int64(64)
+	DEFAULT_MAX_QUEUED_PROBES                              = int64(1024)
+	DEFAULT_PER_DESTINATION_RATE                           = float64(5)
+	DEFAULT_PER_DESTINATION_BURST                          = int64(10)
+	DEFAULT_PREFETCH_MIN_HITS                              = float64(2)
+	DEFAULT_PREFETCH_HIT_DECAY_SECOND                      = int64(3600)
+	DEFAULT_MAX_PREFETCH_PER_SECOND                        = int64(20)
+	DEFAULT_ADDRESS_TTL                                    = uint32(600)
+	DEFAULT_QUERY_LOG_MAX_SIZE_MB                          = int64(10)
+	DEFAULT_QUERY_LOG_MAX_BACKUPS                          = int64(3)
+	DEFAULT_QUERY_LOG_MEMORY_RECORDS                       = int64(0)
+	DEFAULT_DNSTAP_BUFFER_SIZE                             = int64(4096)
+	DEFAULT_RATE_LIMIT_IPV4_PREFIX_LENGTH                  = int64(24)
+	DEFAULT_RATE_LIMIT_IPV6_PREFIX_LENGTH                  = int64(56)
+	DEFAULT_RRL_SLIP                                       = int64(2)
 )
 
 type Protocol string
@@ -48,8 +75,67 @@ const (
 	PING_SPEED_CHECK_TYPE SpeedCheckType = "ping"
 	HTTP_SPEED_CHECK_TYPE SpeedCheckType = "http"
 	TCP_SPEED_CHECK_TYPE  SpeedCheckType = "tcp"
-	// At present, there are not many HTTP3, but it will be implemented in the future.
-	// UDP_SPEED_CHECK_TYPE  SpeedCheckType = "udp"
+	// QUIC(HTTP3) version negotiation round trip, not a full handshake
+	UDP_SPEED_CHECK_TYPE SpeedCheckType = "udp"
+	// TLS handshake with the queried host as SNI
+	TLS_SPEED_CHECK_TYPE SpeedCheckType = "tls"
+	// ICMP echo by unprivileged datagram socket
+	ICMP_SPEED_CHECK_TYPE SpeedCheckType = "icmp"
+	// disable speed check
+	NONE_SPEED_CHECK_TYPE SpeedCheckType = "none"
 )
 
 type SpeedCheckType string
+
+const (
+	// answer empty for all types
+	BLOCK_ADDRESS = "#"
+	// answer empty A
+	BLOCK_IPV4_ADDRESS = "#4"
+	// answer empty AAAA
+	BLOCK_IPV6_ADDRESS = "#6"
+)
+
+type IpFamily string
+
+const (
+	IPV4_IP_FAMILY IpFamily = "ipv4"
+	IPV6_IP_FAMILY IpFamily = "ipv6"
+)
+
+type QueueDropPolicy string
+
+const (
+	DROP_NEWEST_QUEUE_DROP_POLICY QueueDropPolicy = "drop-newest"
+	DROP_OLDEST_QUEUE_DROP_POLICY QueueDropPolicy = "drop-oldest"
+)
+
+type RateLimitAction string
+
+const (
+	REFUSE_RATE_LIMIT_ACTION RateLimitAction = "refuse"
+	DROP_RATE_LIMIT_ACTION   RateLimitAction = "drop"
+)
+
+type HttpMeasure string
+
+const (
+	TTFB_HTTP_MEASURE    HttpMeasure = "ttfb"
+	CONNECT_HTTP_MEASURE HttpMeasure = "connect"
+)
+
+const (
+	DEFAULT_HTTP_SPEED_CHECK_PATH = "/"
+	// use https when check the port
+	HTTPS_SPEED_CHECK_PORT = 443
+)
+
+// config file format
+type Format string
+
+const (
+	JSON_FORMAT     Format = "json"
+	YAML_FORMAT     Format = "yaml"
+	TOML_FORMAT     Format = "toml"
+	SMARTDNS_FORMAT Format = "smartdns"
+)
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// error of a config field
+type FieldError struct {
+	// json path of the field, eg: groups[0].outbounds[1]
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// prefix the path of err with path
+func fieldError(path string, err error) error {
+	if errs, ok := err.(Errors); ok {
+		prefixed := make(Errors, 0, len(errs))
+		for _, e := range errs {
+			prefixed = append(prefixed, fieldError(path, e))
+		}
+		return prefixed
+	}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) && fieldErr == err {
+		sep := "."
+		if strings.HasPrefix(fieldErr.Path, "[") {
+			sep = ""
+		}
+		return &FieldError{Path: path + sep + fieldErr.Path, Err: fieldErr.Err}
+	}
+	return &FieldError{Path: path, Err: err}
+}
+
+// all the errors of the config, one per line
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// collect errors to report all of them at once
+type errorList struct {
+	errs Errors
+}
+
+// add err with the path prefixed, nil err is ignored
+func (l *errorList) add(path string, err error) {
+	if err == nil {
+		return
+	}
+	if len(path) > 0 {
+		err = fieldError(path, err)
+	}
+	if errs, ok := err.(Errors); ok {
+		l.errs = append(l.errs, errs...)
+		return
+	}
+	l.errs = append(l.errs, err)
+}
+
+// nil if no error, the error itself if only one
+func (l *errorList) err() error {
+	switch len(l.errs) {
+	case 0:
+		return nil
+	case 1:
+		return l.errs[0]
+	}
+	return l.errs
+}
+
+// error of the config file with the position
+type ParseError struct {
+	File string
+	// 0 if unknown
+	Line int
+	// json path of the field, empty if unknown
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	if len(e.File) > 0 {
+		b.WriteString(e.File)
+	} else {
+		b.WriteString("config")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if len(e.Path) > 0 {
+		fmt.Fprintf(&b, ": %s", e.Path)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	return b.String()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// marshal config by format, nulls, false and empty values are omitted unless set to a pointer field
+func Marshal(cfg *Config, format Format) ([]byte, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	v, _ = compactValue(v, reflect.TypeOf(cfg))
+	switch format {
+	case JSON_FORMAT:
+		return json.MarshalIndent(v, "", "  ")
+	case YAML_FORMAT:
+		return yaml.Marshal(v)
+	case TOML_FORMAT:
+		buf := &bytes.Buffer{}
+		if err := toml.NewEncoder(buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported format:%s", format)
+}
+
+// compact by the go type t, nil if unknown, numbers and the values of pointer fields are kept
+// because a zero of a pointer field is not the default, such as blocking: false of clients
+func compactValue(v any, t reflect.Type) (any, bool) {
+	pointer := false
+	for t != nil && t.Kind() == reflect.Pointer {
+		pointer, t = true, t.Elem()
+	}
+	switch value := v.(type) {
+	case nil:
+		return nil, false
+	case bool:
+		return value, value || pointer
+	case string:
+		return value, len(value) > 0 || pointer
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n, true
+		}
+		f, _ := value.Float64()
+		return f, true
+	case map[string]any:
+		for k, item := range value {
+			if item, ok := compactValue(item, jsonFieldType(t, k)); ok {
+				value[k] = item
+			} else {
+				delete(value, k)
+			}
+		}
+		return value, len(value) > 0
+	case []any:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		items := value[:0]
+		for _, item := range value {
+			// keep array items to keep indexes
+			item, _ = compactValue(item, elem)
+			items = append(items, item)
+		}
+		return items, len(items) > 0
+	}
+	return v, true
+}
+
+// type of the json key in struct or map t, nil if unknown
+func jsonFieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+	default:
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// fields of the embedded struct
+		if field.Anonymous && len(name) == 0 {
+			if ft := jsonFieldType(field.Type, key); ft != nil {
+				return ft
+			}
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
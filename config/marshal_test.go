@@ -0,0 +1,44 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMarshal(t *testing.T) {
+	Convey("TestMarshal", t, func() {
+		cfg, err := Parse([]byte(`{
+			"inbounds": [{"listen": "127.0.0.1:8053"}],
+			"groups": [
+				{"outbounds": [{"setting": {"addr": "223.5.5.5"}}]},
+				{"tag": "doh", "outbounds": [{"protocol": "https", "setting": {"addr": "https://doh.pub/dns-query"}}], "cache": {"cacheExpiredMaxStaleSecond": 0}}
+			],
+			"routing": [{"domain": ["a.com"], "groupTag": "doh"}, {"domain": ["b.com"], "address": ["#6"]}],
+			"clients": [{"tag": "kids", "cidrs": ["192.168.1.0/24"], "blocking": false}, {"tag": "tv", "cidrs": ["192.168.2.0/24"]}],
+			"speedCheck": {"latencyEwmaAlpha": 0.5}
+		}`))
+		So(err, ShouldBeNil)
+		want, err := json.Marshal(cfg)
+		So(err, ShouldBeNil)
+
+		dir := t.TempDir()
+		for _, format := range []Format{JSON_FORMAT, YAML_FORMAT, TOML_FORMAT} {
+			b, err := Marshal(cfg, format)
+			So(err, ShouldBeNil)
+			file := filepath.Join(dir, "config."+string(format))
+			So(os.WriteFile(file, b, 0o644), ShouldBeNil)
+			parsed, err := ParseFile(file)
+			So(err, ShouldBeNil)
+			got, err := json.Marshal(parsed)
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, string(want))
+			// the explicitly set false is not the default
+			So(*parsed.Clients[0].Blocking, ShouldBeFalse)
+			So(*parsed.Clients[1].Blocking, ShouldBeTrue)
+		}
+	})
+}
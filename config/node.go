@@ -0,0 +1,416 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	objectNode
+	arrayNode
+)
+
+// decoded config value with the source position
+type node struct {
+	kind nodeKind
+	file string
+	// 0 if unknown
+	line int
+	// object keys in order
+	keys   []string
+	fields map[string]*node
+	items  []*node
+	// string, bool, nil or number
+	value any
+}
+
+func newObjectNode(file string, line int) *node {
+	return &node{kind: objectNode, file: file, line: line, fields: make(map[string]*node)}
+}
+
+func (n *node) set(key string, child *node) {
+	if _, ok := n.fields[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.fields[key] = child
+}
+
+func (n *node) remove(key string) {
+	delete(n.fields, key)
+	for i, k := range n.keys {
+		if k == key {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// merge src into n, arrays are appended and the values of n win
+func (n *node) merge(src *node) {
+	switch {
+	case n.kind == objectNode && src.kind == objectNode:
+		for _, key := range src.keys {
+			if child, ok := n.fields[key]; ok {
+				child.merge(src.fields[key])
+			} else {
+				n.set(key, src.fields[key])
+			}
+		}
+	case n.kind == arrayNode && src.kind == arrayNode:
+		n.items = append(n.items, src.items...)
+	}
+}
+
+// walk all nodes with the json path
+func (n *node) walk(path string, fn func(path string, n *node) error) error {
+	if err := fn(path, n); err != nil {
+		return err
+	}
+	switch n.kind {
+	case objectNode:
+		for _, key := range n.keys {
+			if err := n.fields[key].walk(joinPath(path, key), fn); err != nil {
+				return err
+			}
+		}
+	case arrayNode:
+		for i, item := range n.items {
+			if err := item.walk(fmt.Sprintf("%s[%d]", path, i), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// find the position of the json path, the nearest ancestor with position if not found
+func (n *node) position(path string) (file string, line int) {
+	file, line = n.file, n.line
+	cur := n
+	for _, seg := range splitPath(path) {
+		var next *node
+		if idx, err := strconv.Atoi(seg); err == nil && cur.kind == arrayNode {
+			if idx >= 0 && idx < len(cur.items) {
+				next = cur.items[idx]
+			}
+		} else if cur.kind == objectNode {
+			next = cur.fields[seg]
+		}
+		if next == nil {
+			break
+		}
+		cur = next
+		if cur.line > 0 {
+			file, line = cur.file, cur.line
+		}
+	}
+	return
+}
+
+type nodeSpan struct {
+	start, end int
+	path       string
+}
+
+// marshal to json, record the spans of values to find the path by the offset of json errors
+func (n *node) marshal(buf *bytes.Buffer, path string, spans *[]nodeSpan) error {
+	start := buf.Len()
+	switch n.kind {
+	case objectNode:
+		buf.WriteByte('{')
+		for i, key := range n.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			b, _ := json.Marshal(key)
+			buf.Write(b)
+			buf.WriteByte(':')
+			if err := n.fields[key].marshal(buf, joinPath(path, key), spans); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case arrayNode:
+		buf.WriteByte('[')
+		for i, item := range n.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := item.marshal(buf, fmt.Sprintf("%s[%d]", path, i), spans); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := json.Marshal(n.value)
+		if err != nil {
+			return &FieldError{Path: path, Err: err}
+		}
+		buf.Write(b)
+	}
+	*spans = append(*spans, nodeSpan{start: start, end: buf.Len(), path: path})
+	return nil
+}
+
+// find the path of the value ending at offset, or the last value starting before offset
+func findSpanPath(spans []nodeSpan, offset int64) string {
+	path, start := "", -1
+	for _, span := range spans {
+		if int64(span.end) == offset {
+			return span.path
+		}
+		if int64(span.start) < offset && span.start > start {
+			path, start = span.path, span.start
+		}
+	}
+	return path
+}
+
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// split json path to keys and indexes, eg: groups[0].tag => groups 0 tag
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool {
+		return r == '.' || r == '[' || r == ']'
+	})
+}
+
+// line numbers by byte offset
+type lineIndex []int
+
+func newLineIndex(b []byte) lineIndex {
+	index := lineIndex{}
+	for i, c := range b {
+		if c == '\n' {
+			index = append(index, i)
+		}
+	}
+	return index
+}
+
+func (l lineIndex) line(offset int64) int {
+	return sort.Search(len(l), func(i int) bool { return int64(l[i]) >= offset }) + 1
+}
+
+// decode json
+func decodeJsonNode(b []byte, file string) (*node, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	lines := newLineIndex(b)
+	n, err := readJsonNode(dec, file, lines)
+	if err == nil {
+		if _, err = dec.Token(); err != io.EOF {
+			err = errors.New("invalid data after top-level value")
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		line := lines.line(dec.InputOffset())
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line = lines.line(syntaxErr.Offset)
+		}
+		return nil, &ParseError{File: file, Line: line, Err: err}
+	}
+	return n, nil
+}
+
+func readJsonNode(dec *json.Decoder, file string, lines lineIndex) (*node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	line := lines.line(dec.InputOffset())
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return &node{kind: scalarNode, file: file, line: line, value: tok}, nil
+	}
+	switch delim {
+	case '{':
+		n := newObjectNode(file, line)
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := keyTok.(string)
+			child, err := readJsonNode(dec, file, lines)
+			if err != nil {
+				return nil, err
+			}
+			n.set(key, child)
+		}
+		_, err := dec.Token()
+		return n, err
+	case '[':
+		n := &node{kind: arrayNode, file: file, line: line}
+		for dec.More() {
+			item, err := readJsonNode(dec, file, lines)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+		}
+		_, err := dec.Token()
+		return n, err
+	}
+	return nil, fmt.Errorf("unexpected %v", delim)
+}
+
+// decode yaml
+func decodeYamlNode(b []byte, file string) (*node, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	if len(doc.Content) == 0 {
+		return newObjectNode(file, 1), nil
+	}
+	return convertYamlNode(doc.Content[0], file)
+}
+
+func convertYamlNode(y *yaml.Node, file string) (*node, error) {
+	switch y.Kind {
+	case yaml.DocumentNode:
+		return convertYamlNode(y.Content[0], file)
+	case yaml.AliasNode:
+		return convertYamlNode(y.Alias, file)
+	case yaml.MappingNode:
+		n := newObjectNode(file, y.Line)
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			child, err := convertYamlNode(y.Content[i+1], file)
+			if err != nil {
+				return nil, err
+			}
+			child.line = y.Content[i].Line
+			n.set(y.Content[i].Value, child)
+		}
+		return n, nil
+	case yaml.SequenceNode:
+		n := &node{kind: arrayNode, file: file, line: y.Line}
+		for _, item := range y.Content {
+			child, err := convertYamlNode(item, file)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, child)
+		}
+		return n, nil
+	default:
+		var value any
+		if err := y.Decode(&value); err != nil {
+			return nil, &ParseError{File: file, Line: y.Line, Err: err}
+		}
+		return &node{kind: scalarNode, file: file, line: y.Line, value: value}, nil
+	}
+}
+
+// decode toml, the lines of keys are found by the keys of the decoder metadata
+func decodeTomlNode(b []byte, file string) (*node, error) {
+	values := make(map[string]any)
+	md, err := toml.Decode(string(b), &values)
+	if err != nil {
+		line := 0
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			line = parseErr.Position.Line
+		}
+		return nil, &ParseError{File: file, Line: line, Err: err}
+	}
+	keys := make(map[string]int)
+	for i, key := range md.Keys() {
+		keys[key.String()] = i
+	}
+	return convertTomlValue(values, "", "", file, keys, tomlKeyLines(b, md)), nil
+}
+
+func convertTomlValue(v any, path, keyPath, file string, keys map[string]int, lines map[string]int) *node {
+	line := lines[path]
+	switch v := v.(type) {
+	case map[string]any:
+		n := newObjectNode(file, line)
+		names := make([]string, 0, len(v))
+		for key := range v {
+			names = append(names, key)
+		}
+		// keep the order in file
+		sort.SliceStable(names, func(i, j int) bool {
+			return keys[joinPath(keyPath, names[i])] < keys[joinPath(keyPath, names[j])]
+		})
+		for _, key := range names {
+			n.set(key, convertTomlValue(v[key], joinPath(path, key), joinPath(keyPath, key), file, keys, lines))
+		}
+		return n
+	case []map[string]any:
+		n := &node{kind: arrayNode, file: file, line: line}
+		for i, item := range v {
+			n.items = append(n.items, convertTomlValue(item, fmt.Sprintf("%s[%d]", path, i), keyPath, file, keys, lines))
+		}
+		return n
+	case []any:
+		n := &node{kind: arrayNode, file: file, line: line}
+		for i, item := range v {
+			n.items = append(n.items, convertTomlValue(item, fmt.Sprintf("%s[%d]", path, i), keyPath, file, keys, lines))
+		}
+		return n
+	default:
+		return &node{kind: scalarNode, file: file, line: line, value: v}
+	}
+}
+
+// lines of the json paths of the keys in toml, the decoder gives the keys in order without the positions,
+// so each key is located from the line of the previous key
+func tomlKeyLines(b []byte, md toml.MetaData) map[string]int {
+	lines := make(map[string]int)
+	src := strings.Split(string(b), "\n")
+	// count of array tables by path
+	arrays := make(map[string]int)
+	cursor := 0
+	for _, key := range md.Keys() {
+		path := ""
+		for i := range key {
+			path = joinPath(path, key[i])
+			if md.Type(key[:i+1]...) != "ArrayHash" {
+				continue
+			}
+			// a new table of the array
+			if i == len(key)-1 {
+				arrays[path]++
+			}
+			if count := arrays[path]; count > 0 {
+				path = fmt.Sprintf("%s[%d]", path, count-1)
+			}
+		}
+		// the bare or quoted key of a table header, a dotted key or a key/value pair
+		pattern := regexp.MustCompile(`(^|[\s\[{,.])["']?` + regexp.QuoteMeta(key[len(key)-1]) + `["']?\s*[=.\]]`)
+		for i := cursor; i < len(src); i++ {
+			line := strings.TrimSpace(src[i])
+			if strings.HasPrefix(line, "#") || !pattern.MatchString(line) {
+				continue
+			}
+			cursor = i
+			lines[path] = i + 1
+			break
+		}
+	}
+	return lines
+}
@@ -1,18 +1,232 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
+const (
+	// include other config files, a path or a list of paths relative to the file
+	INCLUDE_KEY = "include"
+)
+
+// ${NAME} or ${NAME:-default}, replaced in the strings of all formats including json,
+// an unset variable without default is an error
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// parse json config, the environment variables in strings are substituted too
 func Parse(b []byte) (*Config, error) {
-	cfg := &Config{}
-	if err := json.Unmarshal(b, cfg); err != nil {
+	root, err := decodeJsonNode(b, "")
+	if err != nil {
 		return nil, err
 	}
+	if err := loadIncludes(root, ".", nil); err != nil {
+		return nil, err
+	}
+	return parseNode(root)
+}
+
+// parse config file, the format is detected by extension: .json, .yaml, .yml or .toml,
+// the environment variables in strings are substituted in all formats
+func ParseFile(file string) (*Config, error) {
+	root, err := loadFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseNode(root)
+}
+
+// load config file without defaults and verifying, eg: to convert format,
+// verify fills defaults into cfg and returns the errors with position
+func LoadFile(file string) (cfg *Config, warnings []string, verify func() error, err error) {
+	if IsSmartdnsFile(file) {
+		cfg, warnings, err = ConvertSmartdnsFile(file)
+		if err != nil {
+			return nil, warnings, nil, err
+		}
+		return cfg, warnings, func() error {
+			cfg.FillDefault()
+			if err := cfg.Verify(); err != nil {
+				return &ParseError{File: file, Err: err}
+			}
+			return nil
+		}, nil
+	}
+	root, err := loadFile(file, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cfg, err = decodeConfig(root); err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, nil, func() error { return verifyNode(root, cfg) }, nil
+}
+
+// format of the file by extension, json if unknown
+func FormatOf(file string) Format {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return YAML_FORMAT
+	case ".toml":
+		return TOML_FORMAT
+	case SMARTDNS_CONF_EXT:
+		return SMARTDNS_FORMAT
+	}
+	return JSON_FORMAT
+}
+
+func decodeNode(b []byte, file string) (*node, error) {
+	switch FormatOf(file) {
+	case YAML_FORMAT:
+		return decodeYamlNode(b, file)
+	case TOML_FORMAT:
+		return decodeTomlNode(b, file)
+	default:
+		return decodeJsonNode(b, file)
+	}
+}
+
+// load file and its includes, stack is the including files to find cycles
+func loadFile(file string, stack []string) (*node, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, &ParseError{File: file, Err: fmt.Errorf("include cycle:%s", strings.Join(append(stack, abs), " -> "))}
+		}
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	root, err := decodeNode(b, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadIncludes(root, filepath.Dir(file), append(stack, abs)); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// merge the included files into root, the values of root win and arrays are appended
+func loadIncludes(root *node, dir string, stack []string) error {
+	if root.kind != objectNode {
+		return &ParseError{File: root.file, Line: root.line, Err: errors.New("config is not an object")}
+	}
+	if err := substituteEnv(root); err != nil {
+		return err
+	}
+	include, ok := root.fields[INCLUDE_KEY]
+	if !ok {
+		return nil
+	}
+	root.remove(INCLUDE_KEY)
+	items := []*node{include}
+	if include.kind == arrayNode {
+		items = include.items
+	}
+	for _, item := range items {
+		file, ok := item.value.(string)
+		if item.kind != scalarNode || !ok || len(file) == 0 {
+			return &ParseError{File: item.file, Line: item.line, Path: INCLUDE_KEY, Err: errors.New("include is not a file path")}
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		included, err := loadFile(file, stack)
+		if err != nil {
+			return err
+		}
+		root.merge(included)
+	}
+	return nil
+}
+
+// replace ${NAME} and ${NAME:-default} in strings by environment variables
+func substituteEnv(root *node) error {
+	return root.walk("", func(path string, n *node) error {
+		s, ok := n.value.(string)
+		if n.kind != scalarNode || !ok || !strings.Contains(s, "${") {
+			return nil
+		}
+		var missing string
+		n.value = envPattern.ReplaceAllStringFunc(s, func(m string) string {
+			sub := envPattern.FindStringSubmatch(m)
+			if v, ok := os.LookupEnv(sub[1]); ok {
+				return v
+			}
+			if len(sub[2]) > 0 {
+				return sub[3]
+			}
+			missing = sub[1]
+			return m
+		})
+		if len(missing) > 0 {
+			return &ParseError{File: n.file, Line: n.line, Path: path, Err: fmt.Errorf("environment variable %s is not set", missing)}
+		}
+		return nil
+	})
+}
+
+func parseNode(root *node) (*Config, error) {
+	cfg, err := decodeConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyNode(root, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// fill defaults and verify the config decoded from root
+func verifyNode(root *node, cfg *Config) error {
 	cfg.FillDefault()
 	if err := cfg.Verify(); err != nil {
-		return nil, fmt.Errorf("verify config err:%v", err)
+		return positionError(root, err)
+	}
+	return nil
+}
+
+func decodeConfig(root *node) (*Config, error) {
+	buf := &bytes.Buffer{}
+	spans := make([]nodeSpan, 0)
+	if err := root.marshal(buf, "", &spans); err != nil {
+		return nil, positionError(root, err)
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(buf.Bytes(), cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			err = &FieldError{Path: findSpanPath(spans, typeErr.Offset), Err: err}
+		}
+		return nil, positionError(root, err)
 	}
 	return cfg, nil
 }
+
+// add the position of the field to err
+func positionError(root *node, err error) error {
+	if errs, ok := err.(Errors); ok {
+		positioned := make(Errors, 0, len(errs))
+		for _, e := range errs {
+			positioned = append(positioned, positionError(root, e))
+		}
+		return positioned
+	}
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		return &ParseError{File: root.file, Err: err}
+	}
+	file, line := root.position(fieldErr.Path)
+	return &ParseError{File: file, Line: line, Path: fieldErr.Path, Err: fieldErr.Err}
+}
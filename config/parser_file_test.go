@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseFile(t *testing.T) {
+	Convey("TestParseFile", t, func() {
+		t.Setenv("XSMARTDNS_TEST_DOH", "https://doh.pub/dns-query")
+
+		Convey("yaml with toml and json includes", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"main.yaml": `
+include:
+  - groups.toml
+  - routing.json
+inbounds:
+  - listen: 127.0.0.1:8053
+groups:
+  - tag: default
+    outbounds:
+      - setting:
+          addr: 223.5.5.5
+`,
+				"groups.toml": `
+[[groups]]
+tag = "doh"
+speedChecks = "ping,tcp:443"
+
+[[groups.outbounds]]
+protocol = "https"
+setting = { addr = "${XSMARTDNS_TEST_DOH}" }
+`,
+				"routing.json": `{"routing": [{"domain": ["example.com"], "groupTag": "doh"}]}`,
+			})
+			cfg, err := ParseFile(filepath.Join(dir, "main.yaml"))
+			So(err, ShouldBeNil)
+			So(cfg.Groups, ShouldHaveLength, 2)
+			So(cfg.Groups[0].Tag, ShouldEqual, "default")
+			So(cfg.Groups[1].Tag, ShouldEqual, "doh")
+			So(cfg.Groups[1].SpeedChecks, ShouldHaveLength, 2)
+			So(cfg.Groups[1].Outbounds[0].HttpsSetting.Addr, ShouldEqual, "https://doh.pub/dns-query")
+			So(cfg.Routing[0].GroupTag, ShouldEqual, "doh")
+		})
+
+		Convey("env default and missing", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"default.json": `{"inbounds": [{"listen": "${XSMARTDNS_TEST_LISTEN:-127.0.0.1:8053}"}], "groups": [{"outbounds": [{"setting": {"addr": "223.5.5.5"}}]}]}`,
+				"missing.json": `{"inbounds": [{"listen": "${XSMARTDNS_TEST_LISTEN}"}], "groups": [{"outbounds": [{"setting": {"addr": "223.5.5.5"}}]}]}`,
+			})
+			cfg, err := ParseFile(filepath.Join(dir, "default.json"))
+			So(err, ShouldBeNil)
+			So(cfg.Inbounds[0].Listen, ShouldEqual, "127.0.0.1:8053")
+			_, err = ParseFile(filepath.Join(dir, "missing.json"))
+			var parseErr *ParseError
+			So(errors.As(err, &parseErr), ShouldBeTrue)
+			So(parseErr.Path, ShouldEqual, "inbounds[0].listen")
+			So(parseErr.Line, ShouldEqual, 1)
+		})
+
+		Convey("error position", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"verify.json": `{
+	"inbounds": [{"listen": "127.0.0.1:8053"}],
+	"groups": [
+		{
+			"outbounds": [
+				{"setting": {"addr": "223.5.5.5", "net": "quic"}}
+			]
+		}
+	]
+}`,
+				"type.yaml": `
+inbounds:
+  - listen: 127.0.0.1:8053
+groups:
+  - outbounds:
+      - setting:
+          addr: 223.5.5.5
+    maxIpsNumber: many
+`,
+				"type.toml": `
+[[inbounds]]
+listen = "127.0.0.1:8053"
+
+[[groups]]
+tag = """
+[[groups]]
+maxIpsNumber = 1
+"""
+  [[groups.outbounds]]
+  setting = { addr = "223.5.5.5" }
+
+[[groups]]
+"maxIpsNumber" = "many"
+  [[groups.outbounds]]
+  setting = { addr = "223.5.5.5" }
+`,
+				"syntax.toml": `
+[[inbounds]]
+listen = 127.0.0.1
+`,
+				"include_included.json": `{"groups": [{"outbounds": [{"protocol": "unknown"}]}]}`,
+				"include.json":          `{"include": "include_included.json", "inbounds": [{"listen": "127.0.0.1:8053"}]}`,
+				"cycle.json":            `{"include": "cycle.json"}`,
+			})
+			cases := []struct {
+				file string
+				line int
+				path string
+			}{
+				{file: "verify.json", line: 6, path: "groups[0].outbounds[0].setting"},
+				{file: "type.yaml", line: 8, path: "groups[0].maxIpsNumber"},
+				{file: "type.toml", line: 14, path: "groups[1].maxIpsNumber"},
+				{file: "syntax.toml", line: 3},
+				{file: "include_included.json", line: 1, path: "groups[0].outbounds[0]"},
+				{file: "cycle.json"},
+			}
+			for _, c := range cases {
+				file := c.file
+				if c.file == "include_included.json" {
+					file = "include.json"
+				}
+				_, err := ParseFile(filepath.Join(dir, file))
+				var parseErr *ParseError
+				So(errors.As(err, &parseErr), ShouldBeTrue)
+				So(parseErr.File, ShouldEqual, filepath.Join(dir, c.file))
+				So(parseErr.Line, ShouldEqual, c.line)
+				So(parseErr.Path, ShouldEqual, c.path)
+			}
+		})
+	})
+}
@@ -34,7 +34,11 @@ func TestParse(t *testing.T) {
 					"listen": "127.0.0.1:8053",
 					"net": "udp",
 					"tls_cert": "",
-					"tls_key": ""
+					"tls_key": "",
+					"traceClients": null,
+					"allow": null,
+					"deny": null,
+					"rateLimit": null
 				}
 			],
 			"groups": [
@@ -44,18 +48,79 @@ func TestParse(t *testing.T) {
 						{
 							"protocol": "dns",
 							"setting": {
-								"addr": "223.5.5.5"
+								"addr": "223.5.5.5:53",
+								"net": "udp",
+								"insecure_skip_verify": false
 							}
 						}
 					],
-					"cache": {}
+					"cacheMissResponseMode": "first-ping",
+					"speedChecks": [
+						{"speedCheckType": "ping", "port": 0, "timeoutMs": 2000},
+						{"speedCheckType": "tcp", "port": 80, "timeoutMs": 2000},
+						{"speedCheckType": "tcp", "port": 443, "timeoutMs": 2000}
+					],
+					"maxIpsNumber": null,
+					"cache": {
+						"cacheSize": 10240,
+						"cacheMemorySize": 0,
+						"useSharedCache": false,
+						"sharedCacheQuota": 0,
+						"prefetchDomain": false,
+						"prefetchMinHits": 2,
+						"prefetchHitDecaySecond": 3600,
+						"maxPrefetchPerSecond": 20,
+						"multiPrefetchSpeedCheck": false,
+						"disableCacheExpired": false,
+						"cacheExpiredTimeout": 0,
+						"cacheExpiredReplyTtl": 5,
+						"cacheExpiredPrefetchTimeSecond": 28800,
+						"cacheExpiredMaxStaleSecond": 259200,
+						"cacheExpiredClientTimeoutMs": 1800,
+						"cacheExpiredFailureRecheckSecond": 30,
+						"cachePersist": false,
+						"cacheFile": "",
+						"cacheCheckpointTimeSecond": 86400
+					},
+					"disableDualstackIpSelection": false,
+					"dualstackIpSelectionThreshold": 10,
+					"dualstackIpPreference": "ipv4"
 				}
 			],
 			"routing": null,
+			"clients": null,
 			"log": {
-				"Level": "",
-				"Filename": ""
-			}
+				"level": "",
+				"filename": ""
+			},
+			"cache": {
+				"memorySize": 0
+			},
+			"api": {
+				"listen": "",
+				"token": ""
+			},
+			"speedCheck": {
+				"latencyCacheTtlSecond": 300,
+				"latencyEwmaAlpha": 0.3,
+				"maxInflightProbes": 64,
+				"maxQueuedProbes": 1024,
+				"queueDropPolicy": "drop-newest",
+				"perDestinationRate": 5,
+				"perDestinationBurst": 10
+			},
+			"queryLog": {
+				"filename": "",
+				"maxSizeMb": 10,
+				"maxBackups": 3,
+				"memoryRecords": 0
+			},
+			"dnstap": {
+				"output": "",
+				"identity": "",
+				"bufferSize": 4096
+			},
+			"stateDir": ""
 		}`
 		cfg, err := Parse([]byte(data))
 		So(err, ShouldBeNil)
@@ -63,3 +128,75 @@ func TestParse(t *testing.T) {
 		So(string(b), ShouldEqualJSON, want)
 	})
 }
+
+func TestParseCacheFile(t *testing.T) {
+	Convey("TestParseCacheFile", t, func() {
+		parse := func(stateDir string) *Config {
+			cfg, err := Parse([]byte(`{
+				"inbounds": [{"listen": "127.0.0.1:8053"}],
+				"groups": [
+					{"outbounds": [{"setting": {"addr": "223.5.5.5"}}], "cache": {"cachePersist": true}},
+					{"tag": "cn", "outbounds": [{"setting": {"addr": "223.5.5.5"}}], "cache": {"cachePersist": true, "cacheFile": "/var/lib/cn.cache"}},
+					{"tag": "other", "outbounds": [{"setting": {"addr": "223.5.5.5"}}]}
+				],
+				"routing": [{"domain": ["cn"], "groupTag": "cn"}, {"domain": ["com"], "groupTag": "other"}],
+				"stateDir": "` + stateDir + `"
+			}`))
+			So(err, ShouldBeNil)
+			return cfg
+		}
+
+		// the working directory
+		cfg := parse("")
+		So(cfg.Groups[0].CacheConfig.CacheFile, ShouldEqual, "xsmartdns.default.cache")
+		So(cfg.Groups[1].CacheConfig.CacheFile, ShouldEqual, "/var/lib/cn.cache")
+		So(cfg.Groups[2].CacheConfig.CacheFile, ShouldBeEmpty)
+
+		cfg = parse("/var/lib/xsmartdns")
+		So(cfg.Groups[0].CacheConfig.CacheFile, ShouldEqual, "/var/lib/xsmartdns/xsmartdns.default.cache")
+		So(cfg.Groups[1].CacheConfig.CacheFile, ShouldEqual, "/var/lib/cn.cache")
+		So(cfg.Groups[2].CacheConfig.CacheFile, ShouldBeEmpty)
+	})
+}
+
+func TestParseSpeedCheckMode(t *testing.T) {
+	Convey("TestParseSpeedCheckMode", t, func() {
+		data := `{
+			"inbounds": [{"listen": "127.0.0.1:8053"}],
+			"groups": [
+				{
+					"outbounds": [{"setting": {"addr": "223.5.5.5"}}],
+					"speedChecks": "ping, tcp:80,tcp:443"
+				}
+			]
+		}`
+		cfg, err := Parse([]byte(data))
+		So(err, ShouldBeNil)
+		b, _ := json.Marshal(cfg.Groups[0].SpeedChecks)
+		So(string(b), ShouldEqualJSON, `[
+			{"speedCheckType": "ping", "port": 0, "timeoutMs": 2000},
+			{"speedCheckType": "tcp", "port": 80, "timeoutMs": 2000},
+			{"speedCheckType": "tcp", "port": 443, "timeoutMs": 2000}
+		]`)
+
+		checks, err := ParseSpeedCheckMode("none")
+		So(err, ShouldBeNil)
+		So(checks.Disabled(), ShouldBeTrue)
+
+		_, err = ParseSpeedCheckMode("tcp:http")
+		So(err, ShouldNotBeNil)
+
+		// none with others
+		_, err = Parse([]byte(`{
+			"inbounds": [{"listen": "127.0.0.1:8053"}],
+			"groups": [{"outbounds": [{"setting": {"addr": "223.5.5.5"}}], "speedChecks": "none,ping"}]
+		}`))
+		So(err, ShouldNotBeNil)
+		// tcp without port
+		_, err = Parse([]byte(`{
+			"inbounds": [{"listen": "127.0.0.1:8053"}],
+			"groups": [{"outbounds": [{"setting": {"addr": "223.5.5.5"}}], "speedChecks": "tcp"}]
+		}`))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,525 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SMARTDNS_CONF_EXT = ".conf"
+	// smartdns server group to ignore a domain rule
+	SMARTDNS_IGNORE = "-"
+)
+
+// check if the file is a smartdns.conf by extension
+func IsSmartdnsFile(file string) bool {
+	return strings.EqualFold(filepath.Ext(file), SMARTDNS_CONF_EXT)
+}
+
+// parse smartdns.conf to config with defaults, warnings of the unsupported directives
+func ParseSmartdnsFile(file string) (*Config, []string, error) {
+	cfg, warnings, err := ConvertSmartdnsFile(file)
+	if err != nil {
+		return nil, warnings, err
+	}
+	cfg.FillDefault()
+	if err := cfg.Verify(); err != nil {
+		return nil, warnings, &ParseError{File: file, Err: err}
+	}
+	return cfg, warnings, nil
+}
+
+// convert smartdns.conf to config without defaults, warnings of the unsupported directives
+func ConvertSmartdnsFile(file string) (*Config, []string, error) {
+	c := &smartdnsConverter{cfg: &Config{}, groups: make(map[string]*Group), cache: &CacheConfig{}}
+	c.group(DEFAULT_TAG)
+	if err := c.convertFile(file, nil); err != nil {
+		return nil, c.warnings, err
+	}
+	c.finish()
+	return c.cfg, c.warnings, nil
+}
+
+// smartdns groups share the global settings
+type smartdnsConverter struct {
+	cfg    *Config
+	groups map[string]*Group
+	// global group settings
+	speedChecks        SpeedChecks
+	responseMode       CacheMissResponseMode
+	cache              *CacheConfig
+	disableDualstack   bool
+	dualstackThreshold *int64
+	// tls inbounds use the global cert
+	tlsCert, tlsKey string
+	// audit is the query log of smartdns
+	auditEnable bool
+	auditFile   string
+	warnings    []string
+}
+
+func (c *smartdnsConverter) warnf(file string, line int, format string, args ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf("%s:%d: ", file, line)+fmt.Sprintf(format, args...))
+}
+
+// get or add group by tag
+func (c *smartdnsConverter) group(tag string) *Group {
+	if g, ok := c.groups[tag]; ok {
+		return g
+	}
+	g := &Group{Tag: tag}
+	c.groups[tag] = g
+	c.cfg.Groups = append(c.cfg.Groups, g)
+	return g
+}
+
+func (c *smartdnsConverter) convertFile(file string, stack []string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return &ParseError{File: file, Err: err}
+	}
+	for _, f := range stack {
+		if f == abs {
+			return &ParseError{File: file, Err: fmt.Errorf("conf-file cycle:%s", strings.Join(append(stack, abs), " -> "))}
+		}
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return &ParseError{File: file, Err: err}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		directive, args := fields[0], fields[1:]
+		if directive == "conf-file" {
+			if len(args) == 0 {
+				return &ParseError{File: file, Line: line, Err: fmt.Errorf("conf-file path is empty")}
+			}
+			include := args[0]
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(file), include)
+			}
+			if err := c.convertFile(include, append(stack, abs)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.convertDirective(file, line, directive, args); err != nil {
+			return &ParseError{File: file, Line: line, Err: fmt.Errorf("%s error:%v", directive, err)}
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *smartdnsConverter) convertDirective(file string, line int, directive string, args []string) error {
+	arg := func() (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("value is empty")
+		}
+		if len(args) > 1 {
+			c.warnf(file, line, "%s ignore extra values:%s", directive, strings.Join(args[1:], " "))
+		}
+		return args[0], nil
+	}
+	switch directive {
+	case "bind", "bind-tcp", "bind-tls":
+		return c.convertBind(file, line, directive, args)
+	case "bind-cert-file":
+		v, err := arg()
+		c.tlsCert = v
+		return err
+	case "bind-cert-key-file":
+		v, err := arg()
+		c.tlsKey = v
+		return err
+	case "server", "server-tcp", "server-tls", "server-https":
+		return c.convertServer(file, line, directive, args)
+	case "nameserver":
+		return c.convertNameserver(args)
+	case "address":
+		return c.convertAddress(file, line, args)
+	case "speed-check-mode":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		c.speedChecks, err = ParseSpeedCheckMode(v)
+		return err
+	case "response-mode":
+		v, err := arg()
+		c.responseMode = CacheMissResponseMode(v)
+		return err
+	case "cache-size":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return err
+		}
+		size32 := int32(size)
+		c.cache.CacheSize = &size32
+		return nil
+	case "cache-persist":
+		v, err := arg()
+		c.cache.CachePersist = isYes(v)
+		return err
+	case "prefetch-domain":
+		v, err := arg()
+		c.cache.PrefetchDomain = isYes(v)
+		return err
+	case "serve-expired":
+		v, err := arg()
+		c.cache.DisableCacheExpired = !isYes(v)
+		return err
+	case "serve-expired-ttl":
+		return parseIntArg(args, &c.cache.CacheExpiredMaxStaleSecond)
+	case "serve-expired-reply-ttl":
+		return parseIntArg(args, &c.cache.CacheExpiredReplyTtl)
+	case "serve-expired-prefetch-time":
+		return parseIntArg(args, &c.cache.CacheExpiredPrefetchTimeSecond)
+	case "dualstack-ip-selection":
+		v, err := arg()
+		c.disableDualstack = !isYes(v)
+		return err
+	case "dualstack-ip-selection-threshold":
+		return parseIntArg(args, &c.dualstackThreshold)
+	case "log-level":
+		v, err := arg()
+		c.cfg.Log.Level = v
+		return err
+	case "log-file":
+		v, err := arg()
+		c.cfg.Log.Filename = v
+		return err
+	case "audit-enable":
+		v, err := arg()
+		c.auditEnable = isYes(v)
+		return err
+	case "audit-file":
+		v, err := arg()
+		c.auditFile = v
+		return err
+	case "audit-size":
+		v, err := arg()
+		if err != nil {
+			return err
+		}
+		size, err := parseSizeMb(v)
+		c.cfg.QueryLog.MaxSizeMb = &size
+		return err
+	case "audit-num":
+		return parseIntArg(args, &c.cfg.QueryLog.MaxBackups)
+	default:
+		c.warnf(file, line, "unsupported directive:%s", directive)
+		return nil
+	}
+}
+
+// bind [ip]:port [-option]...
+func (c *smartdnsConverter) convertBind(file string, line int, directive string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("listen is empty")
+	}
+	listen, device, hasDevice := strings.Cut(args[0], "@")
+	if hasDevice {
+		c.warnf(file, line, "%s ignore unsupported device:%s", directive, device)
+	}
+	if len(args) > 1 {
+		c.warnf(file, line, "%s ignore unsupported options:%s", directive, strings.Join(args[1:], " "))
+	}
+	inbound := &Inbound{Listen: listen, Net: UDP_NET}
+	switch directive {
+	case "bind-tcp":
+		inbound.Net = TCP_NET
+	case "bind-tls":
+		inbound.Net = TLS_NET
+	}
+	c.cfg.Inbounds = append(c.cfg.Inbounds, inbound)
+	return nil
+}
+
+// server [scheme://]ip[:port] [-group name]... [-exclude-default-group] [-option]...
+func (c *smartdnsConverter) convertServer(file string, line int, directive string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("server is empty")
+	}
+	addr := args[0]
+	scheme := map[string]string{"server": "udp", "server-tcp": "tcp", "server-tls": "tls", "server-https": "https"}[directive]
+	if s, rest, ok := strings.Cut(addr, "://"); ok {
+		scheme = strings.ToLower(s)
+		if scheme != "https" {
+			addr = rest
+		}
+	}
+	groups := make([]string, 0)
+	excludeDefault, insecure := false, false
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-group", "-g":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s group is empty", args[i])
+			}
+			i++
+			groups = append(groups, args[i])
+		case "-exclude-default-group", "-e":
+			excludeDefault = true
+		case "-no-check-certificate":
+			insecure = true
+		default:
+			c.warnf(file, line, "%s ignore unsupported option:%s", directive, args[i])
+		}
+	}
+
+	outbound := &Outbound{Protocol: DNS_PROTOCOL}
+	var setting any
+	switch scheme {
+	case "udp":
+		setting = &DnsSetting{Addr: withDefaultPort(addr, "53"), Net: UDP_NET}
+	case "tcp":
+		setting = &DnsSetting{Addr: withDefaultPort(addr, "53"), Net: TCP_NET}
+	case "tls":
+		setting = &DnsSetting{Addr: withDefaultPort(addr, "853"), Net: TLS_NET, InsecureSkipVerify: insecure}
+	case "https":
+		if !strings.Contains(addr, "://") {
+			addr = "https://" + addr
+		}
+		if _, err := url.Parse(addr); err != nil {
+			return err
+		}
+		outbound.Protocol = HTTPS_PROTOCOL
+		setting = &HttpsSetting{Addr: addr, InsecureSkipVerify: insecure}
+	default:
+		return fmt.Errorf("unsupported scheme:%s", scheme)
+	}
+	b, err := json.Marshal(setting)
+	if err != nil {
+		return err
+	}
+	outbound.Setting = b
+
+	if !excludeDefault || len(groups) == 0 {
+		g := c.group(DEFAULT_TAG)
+		g.Outbounds = append(g.Outbounds, outbound)
+	}
+	for _, tag := range groups {
+		g := c.group(tag)
+		g.Outbounds = append(g.Outbounds, outbound)
+	}
+	return nil
+}
+
+// nameserver /domain/.../group
+func (c *smartdnsConverter) convertNameserver(args []string) error {
+	domains, value, err := splitDomainRule(args)
+	if err != nil {
+		return err
+	}
+	tag := value
+	if tag == SMARTDNS_IGNORE {
+		tag = DEFAULT_TAG
+	}
+	for _, d := range domains {
+		c.cfg.Routing = append(c.cfg.Routing, &Rule{Domain: []string{d}, GroupTag: tag})
+	}
+	return nil
+}
+
+// address /domain/.../[ip,...|#|#4|#6|-]
+func (c *smartdnsConverter) convertAddress(file string, line int, args []string) error {
+	domains, value, err := splitDomainRule(args)
+	if err != nil {
+		return err
+	}
+	if value == SMARTDNS_IGNORE {
+		c.warnf(file, line, "address ignore rule %s is unsupported", value)
+		return nil
+	}
+	addresses := make([]string, 0)
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	for _, d := range domains {
+		c.cfg.Routing = append(c.cfg.Routing, &Rule{Domain: []string{d}, Address: addresses})
+	}
+	return nil
+}
+
+// apply global settings to groups
+func (c *smartdnsConverter) finish() {
+	c.sortRouting()
+	for _, inbound := range c.cfg.Inbounds {
+		if inbound.Net == TLS_NET {
+			inbound.TlsCert, inbound.TlsKey = c.tlsCert, c.tlsKey
+		}
+	}
+	// groups not used by routing are unreachable
+	used := map[string]bool{DEFAULT_TAG: true}
+	for _, rule := range c.cfg.Routing {
+		used[rule.GroupTag] = true
+	}
+	groups := make([]*Group, 0, len(c.cfg.Groups))
+	for _, g := range c.cfg.Groups {
+		if !used[g.Tag] {
+			c.warnings = append(c.warnings, fmt.Sprintf("group:%s is not used by any nameserver, removed", g.Tag))
+			continue
+		}
+		cacheConfig := *c.cache
+		g.CacheConfig = &cacheConfig
+		g.SpeedChecks = c.speedChecks
+		g.CacheMissResponseMode = c.responseMode
+		g.DisableDualstackIpSelection = c.disableDualstack
+		g.DualstackIpSelectionThreshold = c.dualstackThreshold
+		groups = append(groups, g)
+	}
+	c.cfg.Groups = groups
+	if c.auditEnable {
+		c.cfg.QueryLog.Filename = c.auditFile
+		if len(c.cfg.QueryLog.Filename) == 0 {
+			c.cfg.QueryLog.Filename = DEFAULT_SMARTDNS_AUDIT_FILE
+		}
+	}
+}
+
+// smartdns matches the longest domain, address before nameserver and the last one of the same domain,
+// the routing matches the first rule, so the rules of one domain are sorted by that order
+func (c *smartdnsConverter) sortRouting() {
+	// index of the first rule of each domain, keep the order of the config for the same depth
+	first := make(map[string]int)
+	for i, rule := range c.cfg.Routing {
+		if _, ok := first[normalizeDomain(rule.Domain[0])]; !ok {
+			first[normalizeDomain(rule.Domain[0])] = i
+		}
+	}
+	seen := make(map[string]bool)
+	rules := make([]*Rule, 0, len(c.cfg.Routing))
+	for i := len(c.cfg.Routing) - 1; i >= 0; i-- {
+		rule := c.cfg.Routing[i]
+		key := fmt.Sprintf("%t/%s", len(rule.Address) > 0, normalizeDomain(rule.Domain[0]))
+		if seen[key] {
+			c.warnings = append(c.warnings, fmt.Sprintf("domain:%s rule is overridden by a later one", rule.Domain[0]))
+			continue
+		}
+		seen[key] = true
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		di, dj := domainDepth(rules[i].Domain[0]), domainDepth(rules[j].Domain[0])
+		if di != dj {
+			return di > dj
+		}
+		fi, fj := first[normalizeDomain(rules[i].Domain[0])], first[normalizeDomain(rules[j].Domain[0])]
+		if fi != fj {
+			return fi < fj
+		}
+		return len(rules[i].Address) > 0 && len(rules[j].Address) == 0
+	})
+	// merge the adjacent rules of the same target
+	c.cfg.Routing = c.cfg.Routing[:0]
+	for _, rule := range rules {
+		if n := len(c.cfg.Routing); n > 0 {
+			last := c.cfg.Routing[n-1]
+			if last.GroupTag == rule.GroupTag && slices.Equal(last.Address, rule.Address) {
+				last.Domain = append(last.Domain, rule.Domain...)
+				continue
+			}
+		}
+		c.cfg.Routing = append(c.cfg.Routing, rule)
+	}
+}
+
+func normalizeDomain(d string) string {
+	return strings.ToLower(strings.Trim(d, "."))
+}
+
+func domainDepth(d string) int {
+	d = strings.Trim(d, ".")
+	if len(d) == 0 {
+		return 0
+	}
+	return strings.Count(d, ".") + 1
+}
+
+// split /domain1/domain2/value
+func splitDomainRule(args []string) (domains []string, value string, err error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+		return nil, "", fmt.Errorf("rule is not /domain/value")
+	}
+	parts := strings.Split(args[0][1:], "/")
+	if len(parts) < 2 {
+		return nil, "", fmt.Errorf("rule is not /domain/value")
+	}
+	for _, d := range parts[:len(parts)-1] {
+		if len(d) > 0 {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, "", fmt.Errorf("domain is empty")
+	}
+	value = parts[len(parts)-1]
+	if len(value) == 0 && len(args) > 1 {
+		value = args[1]
+	}
+	if len(value) == 0 {
+		return nil, "", fmt.Errorf("value is empty")
+	}
+	return domains, value, nil
+}
+
+func parseIntArg(args []string, v **int64) error {
+	if len(args) == 0 {
+		return fmt.Errorf("value is empty")
+	}
+	n, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = &n
+	return nil
+}
+
+// smartdns size such as 128k or 1m in megabytes, at least 1
+func parseSizeMb(v string) (int64, error) {
+	unit := int64(1)
+	switch strings.ToLower(v[len(v)-1:]) {
+	case "k":
+		unit = 1 << 10
+	case "m":
+		unit = 1 << 20
+	case "g":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return max((n*unit+(1<<20)-1)>>20, 1), nil
+}
+
+func isYes(v string) bool {
+	switch strings.ToLower(v) {
+	case "yes", "true", "on", "1":
+		return true
+	}
+	return false
+}
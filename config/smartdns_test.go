@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseSmartdnsFile(t *testing.T) {
+	Convey("TestParseSmartdnsFile", t, func() {
+		Convey("directives", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"smartdns.conf": `
+bind [::]:8053
+bind-tcp 127.0.0.1:8053@lo
+server 223.5.5.5
+server-tls 1.1.1.1 -group oversea -exclude-default-group
+server https://dns.google/dns-query -group oversea -e
+server 8.8.8.8 -group unused -e
+nameserver /google.com/youtube.com/oversea
+address /ad.com/#
+address /local.lan/192.168.1.1,fd00::1
+speed-check-mode ping,tcp:80
+response-mode fastest-ip
+cache-size 4096
+prefetch-domain yes
+serve-expired no
+dualstack-ip-selection no
+audit-enable yes
+audit-size 1500k
+audit-num 5
+conf-file extra.conf
+`,
+				"extra.conf": "rr-ttl-min 60\n",
+			})
+			cfg, warnings, err := ParseSmartdnsFile(filepath.Join(dir, "smartdns.conf"))
+			So(err, ShouldBeNil)
+			So(warnings, ShouldHaveLength, 3)
+			So(warnings[1], ShouldEqual, filepath.Join(dir, "extra.conf")+":1: unsupported directive:rr-ttl-min")
+
+			So(cfg.Inbounds, ShouldHaveLength, 2)
+			So(cfg.Inbounds[1].Listen, ShouldEqual, "127.0.0.1:8053")
+			So(cfg.Inbounds[1].Net, ShouldEqual, TCP_NET)
+
+			So(cfg.Groups, ShouldHaveLength, 2)
+			So(cfg.Groups[0].Tag, ShouldEqual, DEFAULT_TAG)
+			So(cfg.Groups[0].Outbounds, ShouldHaveLength, 1)
+			So(cfg.Groups[0].Outbounds[0].DnsSetting.Addr, ShouldEqual, "223.5.5.5:53")
+			oversea := cfg.Groups[1]
+			So(oversea.Tag, ShouldEqual, "oversea")
+			So(oversea.Outbounds[0].DnsSetting.Addr, ShouldEqual, "1.1.1.1:853")
+			So(oversea.Outbounds[0].DnsSetting.Net, ShouldEqual, TLS_NET)
+			So(oversea.Outbounds[1].HttpsSetting.Addr, ShouldEqual, "https://dns.google/dns-query")
+			So(oversea.SpeedChecks, ShouldHaveLength, 2)
+			So(oversea.CacheMissResponseMode, ShouldEqual, FASTEST_IP_RESPONSEMODE)
+			So(*oversea.CacheConfig.CacheSize, ShouldEqual, 4096)
+			So(oversea.CacheConfig.PrefetchDomain, ShouldBeTrue)
+			So(oversea.CacheConfig.DisableCacheExpired, ShouldBeTrue)
+			So(oversea.DisableDualstackIpSelection, ShouldBeTrue)
+
+			So(cfg.QueryLog.Filename, ShouldEqual, DEFAULT_SMARTDNS_AUDIT_FILE)
+			So(*cfg.QueryLog.MaxSizeMb, ShouldEqual, 2)
+			So(*cfg.QueryLog.MaxBackups, ShouldEqual, 5)
+
+			So(cfg.Routing, ShouldHaveLength, 3)
+			So(cfg.Routing[0].Domain, ShouldResemble, []string{"google.com", "youtube.com"})
+			So(cfg.Routing[0].GroupTag, ShouldEqual, "oversea")
+			So(cfg.Routing[1].Address, ShouldResemble, []string{BLOCK_ADDRESS})
+			So(cfg.Routing[2].Address, ShouldResemble, []string{"192.168.1.1", "fd00::1"})
+		})
+
+		Convey("rules sorted not to be shadowed", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"smartdns.conf": `
+bind :8053
+server 223.5.5.5
+server 1.1.1.1 -group oversea -exclude-default-group
+nameserver /google.com/oversea
+address /ads.google.com/#
+address /google.com/#6
+address /ad.com/1.1.1.1
+address /ad.com/#
+`,
+			})
+			cfg, warnings, err := ParseSmartdnsFile(filepath.Join(dir, "smartdns.conf"))
+			So(err, ShouldBeNil)
+			So(warnings, ShouldContain, "domain:ad.com rule is overridden by a later one")
+
+			// the longest domain first, address before nameserver of the same domain
+			So(cfg.Routing, ShouldHaveLength, 4)
+			So(cfg.Routing[0].Domain, ShouldResemble, []string{"ads.google.com"})
+			So(cfg.Routing[0].Address, ShouldResemble, []string{BLOCK_ADDRESS})
+			So(cfg.Routing[1].Domain, ShouldResemble, []string{"google.com"})
+			So(cfg.Routing[1].Address, ShouldResemble, []string{BLOCK_IPV6_ADDRESS})
+			So(cfg.Routing[2].Domain, ShouldResemble, []string{"google.com"})
+			So(cfg.Routing[2].GroupTag, ShouldEqual, "oversea")
+			So(cfg.Routing[3].Domain, ShouldResemble, []string{"ad.com"})
+			So(cfg.Routing[3].Address, ShouldResemble, []string{BLOCK_ADDRESS})
+		})
+
+		Convey("error position", func() {
+			dir := writeTestFiles(t, map[string]string{
+				"smartdns.conf": "bind :8053\nspeed-check-mode tcp:http\n",
+			})
+			_, _, err := ParseSmartdnsFile(filepath.Join(dir, "smartdns.conf"))
+			var parseErr *ParseError
+			So(errors.As(err, &parseErr), ShouldBeTrue)
+			So(parseErr.Line, ShouldEqual, 2)
+		})
+	})
+}
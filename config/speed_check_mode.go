@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type SpeedChecks []*SpeedCheckConfig
+
+// unmarshal from a list of SpeedCheckConfig or a smartdns speed-check-mode string
+func (c *SpeedChecks) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		var mode string
+		if err := json.Unmarshal(b, &mode); err != nil {
+			return err
+		}
+		checks, err := ParseSpeedCheckMode(mode)
+		if err != nil {
+			return err
+		}
+		*c = checks
+		return nil
+	}
+	var checks []*SpeedCheckConfig
+	if err := json.Unmarshal(b, &checks); err != nil {
+		return err
+	}
+	*c = checks
+	return nil
+}
+
+// check if speed check is disabled by "none"
+func (c SpeedChecks) Disabled() bool {
+	return len(c) == 1 && c[0].SpeedCheckType == NONE_SPEED_CHECK_TYPE
+}
+
+// smartdns speed-check-mode, eg: ping,tcp:80,tcp:443
+func (c SpeedChecks) String() string {
+	items := make([]string, 0, len(c))
+	for _, check := range c {
+		items = append(items, check.String())
+	}
+	return strings.Join(items, ",")
+}
+
+// parse smartdns speed-check-mode, eg: ping,tcp:80,tcp:443
+func ParseSpeedCheckMode(mode string) (SpeedChecks, error) {
+	checks := make(SpeedChecks, 0)
+	for _, item := range strings.Split(mode, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		speedCheckType, portStr, hasPort := strings.Cut(item, ":")
+		check := &SpeedCheckConfig{SpeedCheckType: SpeedCheckType(strings.ToLower(speedCheckType))}
+		if hasPort {
+			port, err := strconv.ParseInt(portStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("speed check mode:%s illegal port:%s", item, portStr)
+			}
+			check.Port = port
+		}
+		checks = append(checks, check)
+	}
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("speed check mode is empty")
+	}
+	return checks, nil
+}
+
+// item of speed-check-mode, eg: ping, tcp:80
+func (c *SpeedCheckConfig) String() string {
+	if c.Port == 0 {
+		return string(c.SpeedCheckType)
+	}
+	return fmt.Sprintf("%s:%d", c.SpeedCheckType, c.Port)
+}
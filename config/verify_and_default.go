@@ -2,8 +2,16 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/domain"
 )
 
 // Config
@@ -13,37 +21,58 @@ func (c *Config) FillDefault() {
 	}
 	for _, group := range c.Groups {
 		group.FillDefault()
+		// kept across reboots, not in the temp dir
+		if group.CacheConfig.CachePersist && len(group.CacheConfig.CacheFile) == 0 {
+			group.CacheConfig.CacheFile = filepath.Join(c.StateDir, fmt.Sprintf("xsmartdns.%s.cache", group.Tag))
+		}
 	}
 	for _, rule := range c.Routing {
 		rule.FillDefault()
 	}
+	for _, client := range c.Clients {
+		client.FillDefault()
+	}
+	c.SpeedCheck.FillDefault()
+	c.QueryLog.FillDefault()
+	c.Dnstap.FillDefault()
 }
 func (c *Config) Verify() error {
+	errs := &errorList{}
 	if len(c.Inbounds) == 0 {
-		return fmt.Errorf("inbounds is empty")
+		errs.add("", fmt.Errorf("inbounds is empty"))
 	}
 	if len(c.Groups) == 0 {
-		return fmt.Errorf("groups is empty")
+		errs.add("", fmt.Errorf("groups is empty"))
 	}
-	if len(c.Routing) == 0 && len(c.Groups) != 1 {
-		return fmt.Errorf("routing can be empty only when the number of groups is 1")
+	if len(c.Routing) == 0 && len(c.Groups) > 1 {
+		errs.add("", fmt.Errorf("routing can be empty only when the number of groups is 1"))
 	}
 	for i, inbound := range c.Inbounds {
-		if err := inbound.Verify(); err != nil {
-			return fmt.Errorf("parse inbounds[%d] error:%v", i, err)
-		}
+		errs.add(fmt.Sprintf("inbounds[%d]", i), inbound.Verify())
 	}
 	for i, group := range c.Groups {
-		if err := group.Verify(); err != nil {
-			return fmt.Errorf("parse groups[%d] error:%v", i, err)
-		}
+		errs.add(fmt.Sprintf("groups[%d]", i), group.Verify())
 	}
 	for i, rule := range c.Routing {
-		if err := rule.Verify(); err != nil {
-			return fmt.Errorf("parse routing[%d] error:%v", i, err)
+		errs.add(fmt.Sprintf("routing[%d]", i), rule.Verify())
+	}
+	for i, client := range c.Clients {
+		errs.add(fmt.Sprintf("clients[%d]", i), client.Verify())
+	}
+	errs.add("cache", c.Cache.Verify())
+	errs.add("api", c.Api.Verify())
+	errs.add("speedCheck", c.SpeedCheck.Verify())
+	errs.add("queryLog", c.QueryLog.Verify())
+	errs.add("dnstap", c.Dnstap.Verify())
+	for i, group := range c.Groups {
+		if group.CacheConfig != nil && group.CacheConfig.UseSharedCache && c.Cache.MemorySize <= 0 {
+			errs.add(fmt.Sprintf("groups[%d].cache.useSharedCache", i), errors.New("shared cache is disabled"))
 		}
 	}
-	return nil
+	c.verifyListens(errs)
+	c.verifyTags(errs)
+	c.verifyShadowedRules(errs)
+	return errs.err()
 }
 
 // Inbound
@@ -54,6 +83,9 @@ func (c *Inbound) FillDefault() {
 	if len(c.Net) == 0 {
 		c.Net = DEFAULT_NET
 	}
+	if c.RateLimit != nil {
+		c.RateLimit.FillDefault()
+	}
 }
 func (c *Inbound) Verify() error {
 	if c.Protocol != DNS_PROTOCOL {
@@ -62,13 +94,33 @@ func (c *Inbound) Verify() error {
 	if len(c.Listen) == 0 {
 		return fmt.Errorf("listen is empty")
 	}
+	if err := verifyHostPort(c.Listen, true); err != nil {
+		return fieldError("listen", err)
+	}
 	switch c.Net {
 	case UDP_NET:
 	case TCP_NET:
 	case TLS_NET:
+		if len(c.TlsCert) == 0 || len(c.TlsKey) == 0 {
+			return fmt.Errorf("tls_cert and tls_key are required by net:%s", c.Net)
+		}
 	default:
 		return fmt.Errorf("unknow net:%s", c.Net)
 	}
+	if err := verifyPrefixes("traceClients", c.TraceClients); err != nil {
+		return err
+	}
+	if err := verifyPrefixes("allow", c.Allow); err != nil {
+		return err
+	}
+	if err := verifyPrefixes("deny", c.Deny); err != nil {
+		return err
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Verify(); err != nil {
+			return fieldError("rateLimit", err)
+		}
+	}
 	return nil
 }
 
@@ -90,47 +142,95 @@ func (c *Group) FillDefault() {
 	if len(c.SpeedChecks) == 0 {
 		c.SpeedChecks = append(c.SpeedChecks,
 			&SpeedCheckConfig{SpeedCheckType: PING_SPEED_CHECK_TYPE},
-			&SpeedCheckConfig{SpeedCheckType: HTTP_SPEED_CHECK_TYPE, Port: 80},
-			&SpeedCheckConfig{SpeedCheckType: HTTP_SPEED_CHECK_TYPE, Port: 443},
+			&SpeedCheckConfig{SpeedCheckType: TCP_SPEED_CHECK_TYPE, Port: 80},
+			&SpeedCheckConfig{SpeedCheckType: TCP_SPEED_CHECK_TYPE, Port: 443},
 			// &SpeedCheckConfig{SpeedCheckType: UDP_SPEED_CHECK_TYPE, Port: 443},
 		)
 	}
+	for _, speedCheck := range c.SpeedChecks {
+		speedCheck.FillDefault()
+	}
 	if c.DualstackIpSelectionThreshold == nil {
 		c.DualstackIpSelectionThreshold = &DEFAULT_DUALSTACK_IP_SELECTION_THRESHOLD
 	}
+	if len(c.DualstackIpPreference) == 0 {
+		c.DualstackIpPreference = IPV4_IP_FAMILY
+	}
 }
 func (c *Group) Verify() error {
+	errs := &errorList{}
 	if len(c.Outbounds) == 0 {
-		return fmt.Errorf("outbounds is empty")
+		errs.add("", fmt.Errorf("outbounds is empty"))
 	}
 	for i, outbound := range c.Outbounds {
-		if err := outbound.Verify(); err != nil {
-			return fmt.Errorf("parse outbounds[%d] error:%v", i, err)
-		}
+		errs.add(fmt.Sprintf("outbounds[%d]", i), outbound.Verify())
 	}
 	switch c.CacheMissResponseMode {
 	case FIRST_PING_RESPONSEMODE:
 	case FASTEST_IP_RESPONSEMODE:
 	case FASTEST_RESPONSE_RESPONSEMODE:
 	default:
-		return fmt.Errorf("unkown cacheMissResponseMode:%s", c.CacheMissResponseMode)
+		errs.add("", fmt.Errorf("unkown cacheMissResponseMode:%s", c.CacheMissResponseMode))
 	}
 
 	for i, speedCheck := range c.SpeedChecks {
-		if err := speedCheck.Verify(); err != nil {
-			return fmt.Errorf("parse speedCheck[%d] error:%v", i, err)
+		errs.add(fmt.Sprintf("speedChecks[%d]", i), speedCheck.Verify())
+		if speedCheck.SpeedCheckType == NONE_SPEED_CHECK_TYPE && len(c.SpeedChecks) > 1 {
+			errs.add(fmt.Sprintf("speedChecks[%d]", i), errors.New("none can not be used with other speed checks"))
 		}
 	}
-	return nil
+	if c.CacheConfig == nil {
+		errs.add("cache", errors.New("cache is empty"))
+	} else {
+		errs.add("cache", c.CacheConfig.Verify())
+	}
+	if c.DualstackIpSelectionThreshold != nil && *c.DualstackIpSelectionThreshold < 0 {
+		errs.add("dualstackIpSelectionThreshold", fmt.Errorf("dualstackIpSelectionThreshold:%d is negative", *c.DualstackIpSelectionThreshold))
+	}
+	switch c.DualstackIpPreference {
+	case IPV4_IP_FAMILY:
+	case IPV6_IP_FAMILY:
+	default:
+		errs.add("dualstackIpPreference", fmt.Errorf("unkown dualstackIpPreference:%s", c.DualstackIpPreference))
+	}
+	return errs.err()
 }
 
 // SpeedCheckConfig
+func (c *SpeedCheckConfig) FillDefault() {
+	if c.TimeoutMs == nil {
+		c.TimeoutMs = &DEFAULT_SPEED_CHECK_TIMEOUT_MS
+	}
+	if c.SpeedCheckType != HTTP_SPEED_CHECK_TYPE {
+		return
+	}
+	if len(c.Path) == 0 {
+		c.Path = DEFAULT_HTTP_SPEED_CHECK_PATH
+	}
+	if len(c.Measure) == 0 {
+		c.Measure = TTFB_HTTP_MEASURE
+	}
+}
 func (c *SpeedCheckConfig) Verify() error {
+	if c.SpeedCheckType == HTTP_SPEED_CHECK_TYPE {
+		switch c.Measure {
+		case TTFB_HTTP_MEASURE:
+		case CONNECT_HTTP_MEASURE:
+		default:
+			return fmt.Errorf("unkown measure:%s", c.Measure)
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			return fmt.Errorf("path:%s not start with /", c.Path)
+		}
+	}
+	if *c.TimeoutMs <= 0 {
+		return fmt.Errorf("timeoutMs:%d is not positive", *c.TimeoutMs)
+	}
 	switch c.SpeedCheckType {
-	case PING_SPEED_CHECK_TYPE:
-	case HTTP_SPEED_CHECK_TYPE:
-		if c.Port == 0 {
-			return fmt.Errorf("port is empty")
+	case PING_SPEED_CHECK_TYPE, ICMP_SPEED_CHECK_TYPE, NONE_SPEED_CHECK_TYPE:
+	case TCP_SPEED_CHECK_TYPE, HTTP_SPEED_CHECK_TYPE, UDP_SPEED_CHECK_TYPE, TLS_SPEED_CHECK_TYPE:
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("port:%d is illegal", c.Port)
 		}
 	default:
 		return fmt.Errorf("unkown speedTestType:%s", c.SpeedCheckType)
@@ -143,36 +243,54 @@ func (c *Outbound) FillDefault() {
 	if len(c.Protocol) == 0 {
 		c.Protocol = DEFAULT_PROTOCOL
 	}
+	// decode the setting of the protocol, the errors are reported by Verify
+	var setting interface{ FillDefault() }
+	switch c.Protocol {
+	case DNS_PROTOCOL:
+		c.DnsSetting = &DnsSetting{}
+		setting = c.DnsSetting
+	case SOCK5_PROTOCOL:
+		c.Sock5Setting = &Sock5Setting{}
+		setting = c.Sock5Setting
+	case HTTPS_PROTOCOL:
+		c.HttpsSetting = &HttpsSetting{}
+		setting = c.HttpsSetting
+	default:
+		return
+	}
+	if json.Unmarshal(c.Setting, setting) != nil {
+		return
+	}
+	setting.FillDefault()
+	// normalize the raw setting with the defaults
+	if b, err := json.Marshal(setting); err == nil {
+		c.Setting = b
+	}
 }
+
+// verify a decoded copy of the setting, the outbound is not changed
 func (c *Outbound) Verify() error {
+	var setting interface {
+		FillDefault()
+		Verify() error
+	}
 	switch c.Protocol {
 	case DNS_PROTOCOL:
-		if err := json.Unmarshal(c.Setting, &c.DnsSetting); err != nil {
-			return err
-		}
-		c.DnsSetting.FillDefault()
-		if err := c.DnsSetting.Verify(); err != nil {
-			return fmt.Errorf("DnsSetting verify error:%v", err)
-		}
+		setting = &DnsSetting{}
 	case SOCK5_PROTOCOL:
-		if err := json.Unmarshal(c.Setting, &c.Sock5Setting); err != nil {
-			return err
-		}
-		c.Sock5Setting.FillDefault()
-		if err := c.Sock5Setting.Verify(); err != nil {
-			return fmt.Errorf("Sock5Setting verify error:%v", err)
-		}
+		setting = &Sock5Setting{}
 	case HTTPS_PROTOCOL:
-		if err := json.Unmarshal(c.Setting, &c.HttpsSetting); err != nil {
-			return err
-		}
-		c.HttpsSetting.FillDefault()
-		if err := c.HttpsSetting.Verify(); err != nil {
-			return fmt.Errorf("HttpsSetting verify error:%v", err)
-		}
+		setting = &HttpsSetting{}
 	default:
 		return fmt.Errorf("unknow protocol:%s", c.Protocol)
 	}
+	if err := json.Unmarshal(c.Setting, setting); err != nil {
+		return fieldError("setting", err)
+	}
+	setting.FillDefault()
+	if err := setting.Verify(); err != nil {
+		return fieldError("setting", err)
+	}
 	return nil
 }
 
@@ -192,6 +310,163 @@ func (c *CacheConfig) FillDefault() {
 	if c.CacheExpiredPrefetchTimeSecond == nil {
 		c.CacheExpiredPrefetchTimeSecond = &DEFAULT_CACHEEXPIRED_PREFETCH_TIMESECOND
 	}
+	if c.CacheExpiredMaxStaleSecond == nil {
+		c.CacheExpiredMaxStaleSecond = &DEFAULT_CACHEEXPIRED_MAX_STALE_SECOND
+	}
+	if c.CacheExpiredClientTimeoutMs == nil {
+		c.CacheExpiredClientTimeoutMs = &DEFAULT_CACHEEXPIRED_CLIENT_TIMEOUT_MS
+	}
+	if c.CacheExpiredFailureRecheckSecond == nil {
+		c.CacheExpiredFailureRecheckSecond = &DEFAULT_CACHEEXPIRED_FAILURE_RECHECK_SECOND
+	}
+	if c.CacheCheckpointTimeSecond == nil {
+		c.CacheCheckpointTimeSecond = &DEFAULT_CACHE_CHECKPOINT_TIMESECOND
+	}
+	if c.PrefetchMinHits == nil {
+		c.PrefetchMinHits = &DEFAULT_PREFETCH_MIN_HITS
+	}
+	if c.PrefetchHitDecaySecond == nil {
+		c.PrefetchHitDecaySecond = &DEFAULT_PREFETCH_HIT_DECAY_SECOND
+	}
+	if c.MaxPrefetchPerSecond == nil {
+		c.MaxPrefetchPerSecond = &DEFAULT_MAX_PREFETCH_PER_SECOND
+	}
+}
+
+func (c *CacheConfig) Verify() error {
+	if c.CacheMemorySize < 0 {
+		return fmt.Errorf("cacheMemorySize:%d is negative", c.CacheMemorySize)
+	}
+	if c.SharedCacheQuota < 0 {
+		return fmt.Errorf("sharedCacheQuota:%d is negative", c.SharedCacheQuota)
+	}
+	if *c.CacheExpiredMaxStaleSecond < 0 {
+		return fmt.Errorf("cacheExpiredMaxStaleSecond:%d is negative", *c.CacheExpiredMaxStaleSecond)
+	}
+	if *c.CacheExpiredClientTimeoutMs < 0 {
+		return fmt.Errorf("cacheExpiredClientTimeoutMs:%d is negative", *c.CacheExpiredClientTimeoutMs)
+	}
+	if *c.CacheExpiredFailureRecheckSecond <= 0 {
+		return fmt.Errorf("cacheExpiredFailureRecheckSecond:%d is not positive", *c.CacheExpiredFailureRecheckSecond)
+	}
+	if *c.PrefetchHitDecaySecond <= 0 {
+		return fmt.Errorf("prefetchHitDecaySecond:%d is not positive", *c.PrefetchHitDecaySecond)
+	}
+	if *c.MaxPrefetchPerSecond < 0 {
+		return fmt.Errorf("maxPrefetchPerSecond:%d is negative", *c.MaxPrefetchPerSecond)
+	}
+	return nil
+}
+
+// SharedCache
+func (c *SharedCache) Verify() error {
+	if c.MemorySize < 0 {
+		return fmt.Errorf("memorySize:%d is negative", c.MemorySize)
+	}
+	return nil
+}
+
+// SpeedCheck
+func (c *SpeedCheck) FillDefault() {
+	if c.LatencyCacheTtlSecond == nil {
+		c.LatencyCacheTtlSecond = &DEFAULT_LATENCY_CACHE_TTL_SECOND
+	}
+	if c.LatencyEwmaAlpha == nil {
+		c.LatencyEwmaAlpha = &DEFAULT_LATENCY_EWMA_ALPHA
+	}
+	if c.MaxInflightProbes == nil {
+		c.MaxInflightProbes = &DEFAULT_MAX_INFLIGHT_PROBES
+	}
+	if c.MaxQueuedProbes == nil {
+		c.MaxQueuedProbes = &DEFAULT_MAX_QUEUED_PROBES
+	}
+	if len(c.QueueDropPolicy) == 0 {
+		c.QueueDropPolicy = DROP_NEWEST_QUEUE_DROP_POLICY
+	}
+	if c.PerDestinationRate == nil {
+		c.PerDestinationRate = &DEFAULT_PER_DESTINATION_RATE
+	}
+	if c.PerDestinationBurst == nil {
+		c.PerDestinationBurst = &DEFAULT_PER_DESTINATION_BURST
+	}
+}
+func (c *SpeedCheck) Verify() error {
+	if *c.LatencyCacheTtlSecond < 0 {
+		return fmt.Errorf("latencyCacheTtlSecond:%d is negative", *c.LatencyCacheTtlSecond)
+	}
+	if *c.LatencyEwmaAlpha <= 0 || *c.LatencyEwmaAlpha > 1 {
+		return fmt.Errorf("latencyEwmaAlpha:%v is not in (0, 1]", *c.LatencyEwmaAlpha)
+	}
+	if *c.MaxInflightProbes <= 0 {
+		return fmt.Errorf("maxInflightProbes:%d is not positive", *c.MaxInflightProbes)
+	}
+	if *c.MaxQueuedProbes < 0 {
+		return fmt.Errorf("maxQueuedProbes:%d is negative", *c.MaxQueuedProbes)
+	}
+	switch c.QueueDropPolicy {
+	case DROP_NEWEST_QUEUE_DROP_POLICY:
+	case DROP_OLDEST_QUEUE_DROP_POLICY:
+	default:
+		return fmt.Errorf("unkown queueDropPolicy:%s", c.QueueDropPolicy)
+	}
+	if *c.PerDestinationRate < 0 {
+		return fmt.Errorf("perDestinationRate:%v is negative", *c.PerDestinationRate)
+	}
+	return nil
+}
+
+// QueryLog
+func (c *QueryLog) FillDefault() {
+	if c.MaxSizeMb == nil {
+		c.MaxSizeMb = &DEFAULT_QUERY_LOG_MAX_SIZE_MB
+	}
+	if c.MaxBackups == nil {
+		c.MaxBackups = &DEFAULT_QUERY_LOG_MAX_BACKUPS
+	}
+	if c.MemoryRecords == nil {
+		c.MemoryRecords = &DEFAULT_QUERY_LOG_MEMORY_RECORDS
+	}
+}
+func (c *QueryLog) Verify() error {
+	errs := &errorList{}
+	if *c.MaxSizeMb <= 0 {
+		errs.add("maxSizeMb", fmt.Errorf("%d is not positive", *c.MaxSizeMb))
+	}
+	if *c.MaxBackups < 0 {
+		errs.add("maxBackups", fmt.Errorf("%d is negative", *c.MaxBackups))
+	}
+	if *c.MemoryRecords < 0 {
+		errs.add("memoryRecords", fmt.Errorf("%d is negative", *c.MemoryRecords))
+	}
+	return errs.err()
+}
+
+// Dnstap
+func (c *Dnstap) FillDefault() {
+	if c.BufferSize == nil {
+		c.BufferSize = &DEFAULT_DNSTAP_BUFFER_SIZE
+	}
+}
+func (c *Dnstap) Verify() error {
+	errs := &errorList{}
+	if path, ok := strings.CutPrefix(c.Output, UNIX_DNSTAP_SCHEME); ok && len(path) == 0 {
+		errs.add("output", fmt.Errorf("unix socket path is empty"))
+	}
+	if addr, ok := strings.CutPrefix(c.Output, TCP_DNSTAP_SCHEME); ok {
+		errs.add("output", verifyHostPort(addr, false))
+	}
+	if *c.BufferSize <= 0 {
+		errs.add("bufferSize", fmt.Errorf("%d is not positive", *c.BufferSize))
+	}
+	return errs.err()
+}
+
+// Api
+func (c *Api) Verify() error {
+	if len(c.Listen) > 0 && len(c.Token) == 0 {
+		return fmt.Errorf("token is empty")
+	}
+	return nil
 }
 
 // DnsSetting
@@ -199,15 +474,17 @@ func (c *DnsSetting) FillDefault() {
 	if len(c.Net) == 0 {
 		c.Net = UDP_NET
 	}
-	// 解析 URL
-	parsedURL, _ := url.Parse(c.Addr)
-	if parsedURL != nil {
-		if len(parsedURL.Port()) == 0 {
-			c.Addr = fmt.Sprintf("%s:53", parsedURL.Hostname())
-		}
+	if len(c.Addr) > 0 {
+		c.Addr = withDefaultPort(c.Addr, "53")
 	}
 }
 func (c *DnsSetting) Verify() error {
+	if len(c.Addr) == 0 {
+		return fmt.Errorf("addr is empty")
+	}
+	if err := verifyHostPort(c.Addr, false); err != nil {
+		return fieldError("addr", err)
+	}
 	switch c.Net {
 	case UDP_NET:
 	case TCP_NET:
@@ -218,16 +495,198 @@ func (c *DnsSetting) Verify() error {
 	return nil
 }
 
+// Sock5Setting
+func (c *Sock5Setting) FillDefault() {
+}
+func (c *Sock5Setting) Verify() error {
+	if len(c.Addr) == 0 {
+		return fmt.Errorf("addr is empty")
+	}
+	if err := verifyHostPort(strings.TrimPrefix(c.Addr, "sock5://"), false); err != nil {
+		return fieldError("addr", err)
+	}
+	return nil
+}
+
+// HttpsSetting
+func (c *HttpsSetting) FillDefault() {
+}
+func (c *HttpsSetting) Verify() error {
+	u, err := url.Parse(c.Addr)
+	if err != nil {
+		return fieldError("addr", err)
+	}
+	if u.Scheme != "https" || len(u.Host) == 0 {
+		return fieldError("addr", fmt.Errorf("url:%s is not https", c.Addr))
+	}
+	return nil
+}
+
+// add port to addr without port
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// ips or CIDRs
+func verifyPrefixes(path string, list []string) error {
+	for i, s := range list {
+		if _, err := util.ParsePrefix(s); err != nil {
+			return fieldError(fmt.Sprintf("%s[%d]", path, i), err)
+		}
+	}
+	return nil
+}
+
+// check host:port, the host can be empty to listen on all addresses
+func verifyHostPort(addr string, emptyHost bool) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if len(host) == 0 && !emptyHost {
+		return fmt.Errorf("addr:%s host is empty", addr)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("addr:%s port is illegal", addr)
+	}
+	return nil
+}
+
+// ClientGroup
+func (c *ClientGroup) FillDefault() {
+	if c.Blocking == nil {
+		blocking := true
+		c.Blocking = &blocking
+	}
+	if c.RateLimit != nil {
+		c.RateLimit.FillDefault()
+	}
+}
+func (c *ClientGroup) Verify() error {
+	errs := &errorList{}
+	if len(c.Tag) == 0 {
+		errs.add("tag", fmt.Errorf("tag is empty"))
+	}
+	if len(c.Cidrs) == 0 && len(c.Macs) == 0 {
+		errs.add("", fmt.Errorf("cidrs and macs are empty"))
+	}
+	errs.add("", verifyPrefixes("cidrs", c.Cidrs))
+	for i, mac := range c.Macs {
+		if _, err := net.ParseMAC(mac); err != nil {
+			errs.add(fmt.Sprintf("macs[%d]", i), err)
+		}
+	}
+	if c.RateLimit != nil {
+		errs.add("rateLimit", c.RateLimit.Verify())
+	}
+	return errs.err()
+}
+
+// RateLimit
+func (c *InboundRateLimit) FillDefault() {
+	if c.Client != nil {
+		c.Client.FillDefault()
+	}
+	if c.Subnet != nil {
+		c.Subnet.FillDefault()
+	}
+	if c.Ipv4PrefixLength == nil {
+		c.Ipv4PrefixLength = &DEFAULT_RATE_LIMIT_IPV4_PREFIX_LENGTH
+	}
+	if c.Ipv6PrefixLength == nil {
+		c.Ipv6PrefixLength = &DEFAULT_RATE_LIMIT_IPV6_PREFIX_LENGTH
+	}
+	if len(c.Action) == 0 {
+		c.Action = REFUSE_RATE_LIMIT_ACTION
+	}
+	if c.Rrl != nil {
+		c.Rrl.FillDefault()
+	}
+}
+func (c *InboundRateLimit) Verify() error {
+	errs := &errorList{}
+	if c.Client != nil {
+		errs.add("client", c.Client.Verify())
+	}
+	if c.Subnet != nil {
+		errs.add("subnet", c.Subnet.Verify())
+	}
+	if *c.Ipv4PrefixLength < 0 || *c.Ipv4PrefixLength > 32 {
+		errs.add("", fmt.Errorf("ipv4PrefixLength:%d is not in [0, 32]", *c.Ipv4PrefixLength))
+	}
+	if *c.Ipv6PrefixLength < 0 || *c.Ipv6PrefixLength > 128 {
+		errs.add("", fmt.Errorf("ipv6PrefixLength:%d is not in [0, 128]", *c.Ipv6PrefixLength))
+	}
+	switch c.Action {
+	case REFUSE_RATE_LIMIT_ACTION:
+	case DROP_RATE_LIMIT_ACTION:
+	default:
+		errs.add("", fmt.Errorf("unkown action:%s", c.Action))
+	}
+	if c.Rrl != nil {
+		errs.add("rrl", c.Rrl.Verify())
+	}
+	return errs.err()
+}
+func (c *Rrl) FillDefault() {
+	c.RateLimit.FillDefault()
+	if c.Slip == nil {
+		c.Slip = &DEFAULT_RRL_SLIP
+	}
+}
+func (c *Rrl) Verify() error {
+	if err := c.RateLimit.Verify(); err != nil {
+		return err
+	}
+	if *c.Slip < 0 {
+		return fmt.Errorf("slip:%d is negative", *c.Slip)
+	}
+	return nil
+}
+func (c *RateLimit) FillDefault() {
+	if c.Burst == 0 {
+		c.Burst = max(int64(math.Ceil(c.Qps)), 1)
+	}
+}
+func (c *RateLimit) Verify() error {
+	if c.Qps < 0 {
+		return fmt.Errorf("qps:%v is negative", c.Qps)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst:%d is negative", c.Burst)
+	}
+	return nil
+}
+
 // Rule
 func (c *Rule) FillDefault() {
 }
 func (c *Rule) Verify() error {
+	errs := &errorList{}
 	if len(c.Domain) == 0 {
-		return fmt.Errorf("domain is empty")
+		errs.add("", fmt.Errorf("domain is empty"))
 	}
-	if len(c.GroupTag) == 0 {
-		return fmt.Errorf("groupTag is empty")
+	for i, pattern := range c.Domain {
+		_, err := domain.Compile(pattern)
+		errs.add(fmt.Sprintf("domain[%d]", i), err)
 	}
-	// TODO: check rule mapping
-	return nil
+	if len(c.GroupTag) == 0 && len(c.Address) == 0 {
+		errs.add("", fmt.Errorf("groupTag and address are both empty"))
+	}
+	if len(c.GroupTag) > 0 && len(c.Address) > 0 {
+		errs.add("", fmt.Errorf("groupTag and address can not be both set"))
+	}
+	for i, address := range c.Address {
+		switch address {
+		case BLOCK_ADDRESS, BLOCK_IPV4_ADDRESS, BLOCK_IPV6_ADDRESS:
+		default:
+			if net.ParseIP(address) == nil {
+				errs.add(fmt.Sprintf("address[%d]", i), fmt.Errorf("ip:%s is illegal", address))
+			}
+		}
+	}
+	return errs.err()
 }
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/xsmartdns/xsmartdns/util/domain"
+)
+
+// inbounds can not listen on the same address and port of the same transport
+func (c *Config) verifyListens(errs *errorList) {
+	type listen struct {
+		index      int
+		transport  string
+		host, port string
+	}
+	listens := make([]*listen, 0, len(c.Inbounds))
+	for i, inbound := range c.Inbounds {
+		host, port, err := net.SplitHostPort(inbound.Listen)
+		if err != nil {
+			// reported by Inbound.Verify
+			continue
+		}
+		l := &listen{index: i, transport: "tcp", host: host, port: port}
+		if inbound.Net == UDP_NET {
+			l.transport = "udp"
+		}
+		for _, other := range listens {
+			if other.transport == l.transport && other.port == l.port && hostsOverlap(other.host, l.host) {
+				errs.add(fmt.Sprintf("inbounds[%d].listen", i),
+					fmt.Errorf("listen:%s %s conflicts with inbounds[%d]", inbound.Listen, l.transport, other.index))
+				break
+			}
+		}
+		listens = append(listens, l)
+	}
+}
+
+// check if two listen hosts share an address
+func hostsOverlap(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if a == b || (ipA != nil && ipB != nil && ipA.Equal(ipB)) {
+		return true
+	}
+	// empty host and [::] listen on all the addresses of both families
+	if len(a) == 0 || len(b) == 0 || net.IPv6unspecified.Equal(ipA) || net.IPv6unspecified.Equal(ipB) {
+		return true
+	}
+	// 0.0.0.0 listens on all the ipv4 addresses
+	if net.IPv4zero.Equal(ipA) {
+		return ipB == nil || ipB.To4() != nil
+	}
+	if net.IPv4zero.Equal(ipB) {
+		return ipA == nil || ipA.To4() != nil
+	}
+	return false
+}
+
+// group tags are unique and the rules refer to existing groups
+func (c *Config) verifyTags(errs *errorList) {
+	tags := make(map[string]int, len(c.Groups))
+	for i, group := range c.Groups {
+		if j, ok := tags[group.Tag]; ok {
+			errs.add(fmt.Sprintf("groups[%d].tag", i), fmt.Errorf("tag:%s is duplicated with groups[%d]", group.Tag, j))
+			continue
+		}
+		tags[group.Tag] = i
+	}
+	for i, rule := range c.Routing {
+		if len(rule.GroupTag) == 0 {
+			continue
+		}
+		if _, ok := tags[rule.GroupTag]; !ok {
+			errs.add(fmt.Sprintf("routing[%d].groupTag", i), fmt.Errorf("group:%s not found", rule.GroupTag))
+		}
+	}
+	clientTags := make(map[string]int, len(c.Clients))
+	for i, client := range c.Clients {
+		if j, ok := clientTags[client.Tag]; ok {
+			errs.add(fmt.Sprintf("clients[%d].tag", i), fmt.Errorf("tag:%s is duplicated with clients[%d]", client.Tag, j))
+		} else {
+			clientTags[client.Tag] = i
+		}
+		if len(client.GroupTag) == 0 {
+			continue
+		}
+		if _, ok := tags[client.GroupTag]; !ok {
+			errs.add(fmt.Sprintf("clients[%d].groupTag", i), fmt.Errorf("group:%s not found", client.GroupTag))
+		}
+	}
+}
+
+// qtypes answered by a rule
+const (
+	ruleAnswersA = 1 << iota
+	ruleAnswersAAAA
+	ruleAnswersOther
+	ruleAnswersAll = ruleAnswersA | ruleAnswersAAAA | ruleAnswersOther
+)
+
+// the same as the address group, other qtypes fall through to the next rules
+func (c *Rule) answers() int {
+	if len(c.Address) == 0 {
+		return ruleAnswersAll
+	}
+	answers := 0
+	for _, address := range c.Address {
+		switch address {
+		case BLOCK_ADDRESS:
+			return ruleAnswersAll
+		case BLOCK_IPV4_ADDRESS:
+			answers |= ruleAnswersA
+		case BLOCK_IPV6_ADDRESS:
+			answers |= ruleAnswersAAAA
+		default:
+			answers |= ruleAnswersA | ruleAnswersAAAA
+		}
+	}
+	return answers
+}
+
+// a rule is unreachable when the earlier rules match all its names for all its qtypes
+func (c *Config) verifyShadowedRules(errs *errorList) {
+	type compiled struct {
+		answers  int
+		matchers []domain.Matcher
+	}
+	rules := make([]*compiled, 0, len(c.Routing))
+	for i, rule := range c.Routing {
+		current := &compiled{answers: rule.answers()}
+		for _, pattern := range rule.Domain {
+			m, err := domain.Compile(pattern)
+			if err != nil {
+				// reported by Rule.Verify
+				current = nil
+				break
+			}
+			current.matchers = append(current.matchers, m)
+		}
+		if current == nil || len(current.matchers) == 0 {
+			// keep the index of the rules
+			rules = append(rules, nil)
+			continue
+		}
+		shadowed := true
+		by := -1
+		for _, m := range current.matchers {
+			covered := 0
+			for j, earlier := range rules {
+				if earlier == nil {
+					continue
+				}
+				for _, em := range earlier.matchers {
+					if domain.Covers(em, m) {
+						covered |= earlier.answers
+						by = max(by, j)
+						break
+					}
+				}
+			}
+			if covered&current.answers != current.answers {
+				shadowed = false
+				break
+			}
+		}
+		if shadowed {
+			errs.add(fmt.Sprintf("routing[%d]", i), fmt.Errorf("rule is unreachable, shadowed by routing[%d]", by))
+		}
+		rules = append(rules, current)
+	}
+}
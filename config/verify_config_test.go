@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	Convey("TestVerifyConfig", t, func() {
+		data := `{
+			"inbounds": [
+				{"listen": "127.0.0.1:8053"},
+				{"listen": ":8053"},
+				{"listen": ":8053", "net": "tcp"},
+				{"listen": "[::1]:8053", "net": "tcp"},
+				{"listen": "127.0.0.1"}
+			],
+			"groups": [
+				{"outbounds": [{"setting": {"addr": "223.5.5.5"}}]},
+				{"outbounds": [{"protocol": "https", "setting": {"addr": "http://doh.pub/dns-query"}}]},
+				{"tag": "cn", "outbounds": [{"setting": {"addr": "223.5.5.5"}}]},
+				{"tag": "v6", "outbounds": [{"setting": {"addr": "223.5.5.5"}}], "dualstackIpPreference": "ipv5"},
+				{"tag": "stale", "outbounds": [{"setting": {"addr": "223.5.5.5"}}], "cache": {"cacheExpiredFailureRecheckSecond": 0}}
+			],
+			"routing": [
+				{"domain": ["a.com"], "groupTag": "cn"},
+				{"domain": ["full:b.a.com", "*.a.com"], "groupTag": "default"},
+				{"domain": ["ads.b.com"], "address": ["#4"]},
+				{"domain": ["ads.b.com"], "address": ["1.1.1.1"]},
+				{"domain": ["c.com"], "groupTag": "oversea"},
+				{"domain": ["d..com"], "address": ["1.1.1"]}
+			]
+		}`
+		_, err := Parse([]byte(data))
+		var errs Errors
+		So(errors.As(err, &errs), ShouldBeTrue)
+		paths := make([]string, 0, len(errs))
+		for _, e := range errs {
+			var parseErr *ParseError
+			So(errors.As(e, &parseErr), ShouldBeTrue)
+			paths = append(paths, parseErr.Path)
+		}
+		So(paths, ShouldResemble, []string{
+			"inbounds[4].listen",
+			"groups[1].outbounds[0].setting.addr",
+			"groups[3].dualstackIpPreference",
+			"groups[4].cache",
+			"routing[5].domain[0]",
+			"routing[5].address[0]",
+			"inbounds[1].listen",
+			"inbounds[3].listen",
+			"groups[1].tag",
+			"routing[4].groupTag",
+			"routing[1]",
+		})
+	})
+
+	Convey("TestOutboundVerifyNotChange", t, func() {
+		outbound := &Outbound{Protocol: DNS_PROTOCOL, Setting: []byte(`{"addr": "223.5.5.5"}`)}
+		So(outbound.Verify(), ShouldBeNil)
+		So(outbound.DnsSetting, ShouldBeNil)
+		outbound.FillDefault()
+		So(outbound.DnsSetting.Addr, ShouldEqual, "223.5.5.5:53")
+	})
+}
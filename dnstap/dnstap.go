@@ -0,0 +1,229 @@
+package dnstap
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+const VERSION = "xsmartdns"
+
+var writer atomic.Pointer[tapWriter]
+
+// init or replace the output, the old output is flushed and closed
+func Init(cfg *config.Dnstap) {
+	var w *tapWriter
+	if len(cfg.Output) > 0 {
+		output, err := newOutput(cfg.Output)
+		if err != nil {
+			log.Errorf("dnstap output:%s init error:%v", cfg.Output, err)
+		} else {
+			identity := cfg.Identity
+			if len(identity) == 0 {
+				identity, _ = os.Hostname()
+			}
+			w = newTapWriter(output, identity, int(*cfg.BufferSize))
+		}
+	}
+	if old := writer.Swap(w); old != nil {
+		old.close()
+	}
+}
+
+// flush and close the output
+func Close() {
+	if old := writer.Swap(nil); old != nil {
+		old.close()
+	}
+}
+
+// whether the output is enabled, the messages are needless if not
+func Enabled() bool {
+	return writer.Load() != nil
+}
+
+// the query from the client to the inbound
+func ClientQuery(inbound config.Net, client, local net.Addr, r *dns.Msg, queryTime time.Time) {
+	w := writer.Load()
+	if w == nil {
+		return
+	}
+	m := clientMessage(tap.Message_CLIENT_QUERY, inbound, client, local)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, queryTime)
+	m.QueryMessage = pack(r)
+	w.write(m)
+}
+
+// the response from the inbound to the client
+func ClientResponse(inbound config.Net, client, local net.Addr, resp *dns.Msg, queryTime, responseTime time.Time) {
+	w := writer.Load()
+	if w == nil {
+		return
+	}
+	m := clientMessage(tap.Message_CLIENT_RESPONSE, inbound, client, local)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, queryTime)
+	setTime(&m.ResponseTimeSec, &m.ResponseTimeNsec, responseTime)
+	m.ResponseMessage = pack(resp)
+	w.write(m)
+}
+
+func clientMessage(typ tap.Message_Type, inbound config.Net, client, local net.Addr) *tap.Message {
+	protocol := tap.SocketProtocol_UDP
+	switch inbound {
+	case config.TCP_NET:
+		protocol = tap.SocketProtocol_TCP
+	case config.TLS_NET:
+		protocol = tap.SocketProtocol_DOT
+	}
+	m := &tap.Message{Type: &typ, SocketProtocol: &protocol}
+	m.SocketFamily, m.QueryAddress, m.QueryPort = splitAddr(client)
+	_, m.ResponseAddress, m.ResponsePort = splitAddr(local)
+	return m
+}
+
+// the upstream of an outbound
+type Forwarder struct {
+	// nil if not a dns upstream
+	protocol *tap.SocketProtocol
+	family   *tap.SocketFamily
+	// nil if the upstream is a host name
+	addr []byte
+	port *uint32
+}
+
+func NewForwarder(c *config.Outbound) *Forwarder {
+	f := &Forwarder{}
+	var protocol tap.SocketProtocol
+	var hostPort string
+	switch {
+	case c.DnsSetting != nil:
+		protocol, hostPort = tap.SocketProtocol_UDP, c.DnsSetting.Addr
+		switch c.DnsSetting.Net {
+		case config.TCP_NET:
+			protocol = tap.SocketProtocol_TCP
+		case config.TLS_NET:
+			protocol = tap.SocketProtocol_DOT
+		}
+	case c.HttpsSetting != nil:
+		protocol = tap.SocketProtocol_DOH
+		if u, err := url.Parse(c.HttpsSetting.Addr); err == nil {
+			hostPort = u.Host
+			if len(u.Port()) == 0 {
+				hostPort = net.JoinHostPort(u.Hostname(), "443")
+			}
+		}
+	default:
+		return f
+	}
+	f.protocol = &protocol
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return f
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+		p := uint32(n)
+		f.port = &p
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		f.family, f.addr = ipFamily(ip)
+	}
+	return f
+}
+
+// the query forwarded to the upstream
+func (f *Forwarder) Query(r *dns.Msg, queryTime time.Time) {
+	w := writer.Load()
+	if w == nil {
+		return
+	}
+	m := f.message(tap.Message_FORWARDER_QUERY)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, queryTime)
+	m.QueryMessage = pack(r)
+	w.write(m)
+}
+
+// the response of the upstream, not written if failed
+func (f *Forwarder) Response(resp *dns.Msg, queryTime, responseTime time.Time) {
+	w := writer.Load()
+	if w == nil || resp == nil {
+		return
+	}
+	m := f.message(tap.Message_FORWARDER_RESPONSE)
+	setTime(&m.QueryTimeSec, &m.QueryTimeNsec, queryTime)
+	setTime(&m.ResponseTimeSec, &m.ResponseTimeNsec, responseTime)
+	m.ResponseMessage = pack(resp)
+	w.write(m)
+}
+
+func (f *Forwarder) message(typ tap.Message_Type) *tap.Message {
+	return &tap.Message{Type: &typ, SocketProtocol: f.protocol, SocketFamily: f.family, ResponseAddress: f.addr, ResponsePort: f.port}
+}
+
+func splitAddr(addr net.Addr) (*tap.SocketFamily, []byte, *uint32) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return nil, nil, nil
+	}
+	p := uint32(port)
+	family, b := ipFamily(ip)
+	return family, b, &p
+}
+
+func ipFamily(ip net.IP) (*tap.SocketFamily, []byte) {
+	family := tap.SocketFamily_INET6
+	if ip4 := ip.To4(); ip4 != nil {
+		family = tap.SocketFamily_INET
+		return &family, ip4
+	}
+	return &family, ip.To16()
+}
+
+func setTime(sec **uint64, nsec **uint32, t time.Time) {
+	s, ns := uint64(t.Unix()), uint32(t.Nanosecond())
+	*sec, *nsec = &s, &ns
+}
+
+// nil if failed to pack
+func pack(m *dns.Msg) []byte {
+	b, err := m.Pack()
+	if err != nil {
+		log.Debuf("dnstap pack msg error:%v", err)
+		return nil
+	}
+	return b
+}
+
+func marshal(identity []byte, m *tap.Message) ([]byte, error) {
+	typ := tap.Dnstap_MESSAGE
+	return proto.Marshal(&tap.Dnstap{Identity: identity, Version: []byte(VERSION), Type: &typ, Message: m})
+}
+
+// drop the message if the buffer is full
+func (w *tapWriter) write(m *tap.Message) {
+	b, err := marshal(w.identity, m)
+	if err != nil {
+		log.Warnf("dnstap marshal error:%v", err)
+		return
+	}
+	select {
+	case w.ch <- b:
+	default:
+		metrics.ObserveDnstapDrop()
+	}
+}
@@ -0,0 +1,149 @@
+package dnstap
+
+import (
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/metrics"
+	"google.golang.org/protobuf/proto"
+)
+
+// output never consumed, such as a socket reconnecting
+type blockedOutput struct {
+	ch     chan []byte
+	closed chan struct{}
+}
+
+func (o *blockedOutput) GetOutputChannel() chan []byte {
+	return o.ch
+}
+func (o *blockedOutput) RunOutputLoop() {
+	<-o.closed
+}
+func (o *blockedOutput) Close() {
+	close(o.closed)
+}
+
+var droppedRegexp = regexp.MustCompile(`xsmartdns_dnstap_dropped_total (\d+)`)
+
+// scrape the dropped counter
+func dropped() int {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	match := droppedRegexp.FindStringSubmatch(rec.Body.String())
+	So(match, ShouldHaveLength, 2)
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+func TestDnstap(t *testing.T) {
+	Convey("TestDnstap", t, func() {
+		filename := filepath.Join(t.TempDir(), "dnstap.fstrm")
+		bufferSize := int64(16)
+		Init(&config.Dnstap{Output: filename, Identity: "test", BufferSize: &bufferSize})
+		So(Enabled(), ShouldBeTrue)
+
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		client := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5353}
+		local := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 53}
+		now := time.Now()
+		ClientQuery(config.UDP_NET, client, local, r, now)
+		forwarder := NewForwarder(&config.Outbound{DnsSetting: &config.DnsSetting{Addr: "1.1.1.1:853", Net: config.TLS_NET}})
+		forwarder.Query(r, now)
+		forwarder.Response(resp, now, now)
+		ClientResponse(config.TCP_NET, client, local, resp, now, now)
+		Close()
+		So(Enabled(), ShouldBeFalse)
+
+		input, err := tap.NewFrameStreamInputFromFilename(filename)
+		So(err, ShouldBeNil)
+		ch := make(chan []byte, 8)
+		input.ReadInto(ch)
+		close(ch)
+		messages := make([]*tap.Dnstap, 0)
+		for b := range ch {
+			m := &tap.Dnstap{}
+			So(proto.Unmarshal(b, m), ShouldBeNil)
+			messages = append(messages, m)
+		}
+		So(messages, ShouldHaveLength, 4)
+		So(string(messages[0].Identity), ShouldEqual, "test")
+
+		query := messages[0].Message
+		So(query.GetType(), ShouldEqual, tap.Message_CLIENT_QUERY)
+		So(query.GetSocketFamily(), ShouldEqual, tap.SocketFamily_INET)
+		So(net.IP(query.QueryAddress).String(), ShouldEqual, "192.168.1.2")
+		So(query.GetQueryPort(), ShouldEqual, 5353)
+		So(query.GetQueryTimeSec(), ShouldEqual, now.Unix())
+		m := new(dns.Msg)
+		So(m.Unpack(query.QueryMessage), ShouldBeNil)
+		So(m.Question[0].Name, ShouldEqual, "example.com.")
+
+		forwarded := messages[1].Message
+		So(forwarded.GetType(), ShouldEqual, tap.Message_FORWARDER_QUERY)
+		So(forwarded.GetSocketProtocol(), ShouldEqual, tap.SocketProtocol_DOT)
+		So(net.IP(forwarded.ResponseAddress).String(), ShouldEqual, "1.1.1.1")
+		So(forwarded.GetResponsePort(), ShouldEqual, 853)
+		So(messages[2].Message.GetType(), ShouldEqual, tap.Message_FORWARDER_RESPONSE)
+		So(messages[2].Message.ResponseMessage, ShouldNotBeEmpty)
+
+		response := messages[3].Message
+		So(response.GetType(), ShouldEqual, tap.Message_CLIENT_RESPONSE)
+		So(response.GetSocketProtocol(), ShouldEqual, tap.SocketProtocol_TCP)
+		So(net.IP(response.ResponseAddress).String(), ShouldEqual, "::1")
+	})
+	Convey("forwarder of doh", t, func() {
+		f := NewForwarder(&config.Outbound{HttpsSetting: &config.HttpsSetting{Addr: "https://dns.google/dns-query"}})
+		So(*f.protocol, ShouldEqual, tap.SocketProtocol_DOH)
+		So(*f.port, ShouldEqual, 443)
+		So(f.addr, ShouldBeNil)
+	})
+	Convey("blocked output", t, func() {
+		output := &blockedOutput{ch: make(chan []byte), closed: make(chan struct{})}
+		w := newTapWriter(output, "test", 2)
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		before := dropped()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 10; i++ {
+				typ := tap.Message_CLIENT_QUERY
+				w.write(&tap.Message{Type: &typ, QueryMessage: pack(r)})
+			}
+		}()
+		// the write never blocks
+		written := false
+		select {
+		case <-done:
+			written = true
+		case <-time.After(time.Second):
+		}
+		So(written, ShouldBeTrue)
+		// one is taken by the run loop, the buffer holds two
+		So(dropped()-before, ShouldBeGreaterThanOrEqualTo, 7)
+		// consume to flush when closed
+		go func() {
+			for {
+				select {
+				case <-output.ch:
+				case <-output.closed:
+					return
+				}
+			}
+		}()
+		w.close()
+	})
+}
@@ -0,0 +1,130 @@
+package dnstap
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+const (
+	// max time to flush the buffered messages when closed
+	CLOSE_TIMEOUT = 5 * time.Second
+)
+
+// unix socket, tcp socket or file by the scheme
+func newOutput(output string) (tap.Output, error) {
+	if path, ok := strings.CutPrefix(output, config.UNIX_DNSTAP_SCHEME); ok {
+		o, err := tap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(tapLogger{})
+		return o, nil
+	}
+	if addr, ok := strings.CutPrefix(output, config.TCP_DNSTAP_SCHEME); ok {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		o, err := tap.NewFrameStreamSockOutput(tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(tapLogger{})
+		return o, nil
+	}
+	o, err := tap.NewFrameStreamOutputFromFilename(output)
+	if err != nil {
+		return nil, err
+	}
+	o.SetLogger(tapLogger{})
+	return o, nil
+}
+
+type tapLogger struct{}
+
+func (tapLogger) Printf(format string, args ...interface{}) {
+	log.Warnf("dnstap "+format, args...)
+}
+
+// buffer the messages, the output may block while reconnecting
+type tapWriter struct {
+	identity []byte
+	ch       chan []byte
+	output   tap.Output
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newTapWriter(output tap.Output, identity string, bufferSize int) *tapWriter {
+	w := &tapWriter{
+		identity: []byte(identity),
+		ch:       make(chan []byte, bufferSize),
+		output:   output,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go output.RunOutputLoop()
+	go w.run()
+	return w
+}
+
+func (w *tapWriter) run() {
+	defer close(w.done)
+	out := w.output.GetOutputChannel()
+	for {
+		select {
+		case b := <-w.ch:
+			select {
+			case out <- b:
+			case <-w.stop:
+				w.flush(out, b)
+				return
+			}
+		case <-w.stop:
+			w.flush(out, nil)
+			return
+		}
+	}
+}
+
+// flush the pending and the buffered until timeout
+func (w *tapWriter) flush(out chan []byte, pending []byte) {
+	timeout := time.After(CLOSE_TIMEOUT)
+	for {
+		if pending == nil {
+			select {
+			case pending = <-w.ch:
+			default:
+				return
+			}
+		}
+		select {
+		case out <- pending:
+			pending = nil
+		case <-timeout:
+			log.Warnf("dnstap flush timeout, %d messages dropped", len(w.ch)+1)
+			return
+		}
+	}
+}
+
+// the ch is not closed as writing may be still in progress
+func (w *tapWriter) close() {
+	close(w.stop)
+	<-w.done
+	closed := make(chan struct{})
+	go func() {
+		w.output.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(CLOSE_TIMEOUT):
+		log.Warnf("dnstap close output timeout")
+	}
+}
@@ -0,0 +1,84 @@
+package group
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/cache"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/util"
+)
+
+// answer the configured addresses directly, like smartdns address
+type addressGroupInvoker struct {
+	ipv4, ipv6           []net.IP
+	blockIpv4, blockIpv6 bool
+	blockAll             bool
+}
+
+func NewAddressGroupInvoker(addresses []string) GroupInvoker {
+	g := &addressGroupInvoker{}
+	for _, address := range addresses {
+		switch address {
+		case config.BLOCK_ADDRESS:
+			g.blockAll = true
+		case config.BLOCK_IPV4_ADDRESS:
+			g.blockIpv4 = true
+		case config.BLOCK_IPV6_ADDRESS:
+			g.blockIpv6 = true
+		default:
+			ip := net.ParseIP(address)
+			if ip4 := ip.To4(); ip4 != nil {
+				g.ipv4 = append(g.ipv4, ip4)
+			} else if ip != nil {
+				g.ipv6 = append(g.ipv6, ip)
+			}
+		}
+	}
+	return g
+}
+
+// check if the qtype is answered by the addresses, other types are forwarded as usual
+func (g *addressGroupInvoker) Answerable(qtype uint16) bool {
+	hasIp := len(g.ipv4) > 0 || len(g.ipv6) > 0
+	switch qtype {
+	case dns.TypeA:
+		return g.blockAll || hasIp || g.blockIpv4
+	case dns.TypeAAAA:
+		return g.blockAll || hasIp || g.blockIpv6
+	}
+	return g.blockAll
+}
+
+func (g *addressGroupInvoker) Invoke(r *dns.Msg) (*dns.Msg, error) {
+	question, err := util.GetQuestion(r)
+	if err != nil {
+		return nil, err
+	}
+	resp := util.EmptyReply(r, config.DEFAULT_ADDRESS_TTL)
+	if g.blockAll {
+		return resp, nil
+	}
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: config.DEFAULT_ADDRESS_TTL}
+	switch {
+	case question.Qtype == dns.TypeA && !g.blockIpv4:
+		for _, ip := range g.ipv4 {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+		}
+	case question.Qtype == dns.TypeAAAA && !g.blockIpv6:
+		for _, ip := range g.ipv6 {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(resp.Answer) > 0 {
+		resp.Ns = nil
+	}
+	return resp, nil
+}
+
+func (g *addressGroupInvoker) Cache() *cache.DnsQueryCache {
+	return nil
+}
+
+func (g *addressGroupInvoker) Shutdown() {
+}
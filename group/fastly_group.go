@@ -1,7 +1,10 @@
 package group
 
 import (
+	"sync"
+
 	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/cache"
 	"github.com/xsmartdns/xsmartdns/chain"
 	"github.com/xsmartdns/xsmartdns/chain/chains"
 	"github.com/xsmartdns/xsmartdns/chain/chains/cachechain"
@@ -9,15 +12,23 @@ import (
 	"github.com/xsmartdns/xsmartdns/model"
 )
 
+type cacheHolder interface {
+	Cache() *cache.DnsQueryCache
+}
+
 // dns upstream group
 // one dns request will invoke all outbound in the group
 type fastlyGroupInvoker struct {
 	handleInvoke chain.HandleInvoke
 	chains       []chain.Chain
+	// held by the in-flight queries, shutdown waits for them
+	inflight sync.RWMutex
 }
 
 func NewFastlyGroupInvoker(cfg *config.Group) GroupInvoker {
 	handleInvoke, chains := chain.BuildChain(
+		// the preferred type queried in parallel is served by the cache too
+		chains.NewDualstackChain(cfg),
 		cachechain.NewCacheChain(cfg),
 		chains.NewSpeedSortChain(cfg),
 		chains.NewRemoveruplicateChain(cfg),
@@ -29,10 +40,27 @@ func NewFastlyGroupInvoker(cfg *config.Group) GroupInvoker {
 }
 
 func (p *fastlyGroupInvoker) Invoke(r *dns.Msg) (*dns.Msg, error) {
-	return p.handleInvoke(model.WrapDnsMsg(r))
+	return p.InvokeMessage(model.WrapDnsMsg(r))
+}
+
+func (p *fastlyGroupInvoker) InvokeMessage(r *model.Message) (*dns.Msg, error) {
+	p.inflight.RLock()
+	defer p.inflight.RUnlock()
+	return p.handleInvoke(r)
+}
+
+func (p *fastlyGroupInvoker) Cache() *cache.DnsQueryCache {
+	for _, c := range p.chains {
+		if holder, ok := c.(cacheHolder); ok {
+			return holder.Cache()
+		}
+	}
+	return nil
 }
 
 func (p *fastlyGroupInvoker) Shutdown() {
+	p.inflight.Lock()
+	defer p.inflight.Unlock()
 	for _, c := range p.chains {
 		c.Shutdown()
 	}
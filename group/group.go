@@ -1,8 +1,27 @@
 package group
 
-import "github.com/miekg/dns"
+import (
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/cache"
+	"github.com/xsmartdns/xsmartdns/model"
+)
 
 type GroupInvoker interface {
 	Invoke(*dns.Msg) (*dns.Msg, error)
+	// cache of the group, nil if the group has no cache
+	Cache() *cache.DnsQueryCache
 	Shutdown()
 }
+
+// group invokes with the message context, eg: trace
+type messageInvoker interface {
+	InvokeMessage(*model.Message) (*dns.Msg, error)
+}
+
+// invoke the group with the message context if supported
+func InvokeMessage(g GroupInvoker, r *model.Message) (*dns.Msg, error) {
+	if invoker, ok := g.(messageInvoker); ok {
+		return invoker.InvokeMessage(r)
+	}
+	return g.Invoke(r.Msg)
+}
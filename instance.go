@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xsmartdns/xsmartdns/api"
+	"github.com/xsmartdns/xsmartdns/client"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/dnstap"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/querylog"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/server"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+// running inbounds and router, reloadable by SIGHUP or admin api
+type instance struct {
+	sync.Mutex
+	cfg    *config.Config
+	router *router.ReloadableRouter
+	// client groups shared by inbounds
+	clients *client.Matcher
+	// key: inbound config
+	inbounds map[string]server.Server
+	api      server.Server
+	wg       sync.WaitGroup
+	closing  atomic.Bool
+}
+
+func newInstance(cfg *config.Config) *instance {
+	inst := &instance{cfg: cfg, router: router.NewReloadableRouter(cfg), clients: client.NewMatcher(cfg.Clients), inbounds: make(map[string]server.Server)}
+	for _, inbound := range cfg.Inbounds {
+		srv := server.NewDnsServer(*inbound, inst.router, inst.clients)
+		if err := srv.Init(); err != nil {
+			log.Fatalf("inbound:%v init err:%v", inbound, err)
+		}
+		if err := srv.Listen(); err != nil {
+			log.Fatalf("inbound:%v listen err:%v", inbound, err)
+		}
+		inst.inbounds[inboundKey(inbound)] = srv
+	}
+	// admin api
+	if len(cfg.Api.Listen) > 0 {
+		inst.api = api.NewApiServer(cfg.Api, inst.router, inst.reload)
+		if err := inst.api.Init(); err != nil {
+			log.Fatalf("api init err:%v", err)
+		}
+		if err := inst.api.Listen(); err != nil {
+			log.Fatalf("api listen err:%v", err)
+		}
+	}
+	return inst
+}
+
+// start all servers, exit if all servers stopped
+func (inst *instance) start() {
+	inst.Lock()
+	defer inst.Unlock()
+	for _, srv := range inst.servers() {
+		inst.wg.Add(1)
+		go inst.serve(srv)
+	}
+	go func() {
+		inst.wg.Wait()
+		if !inst.closing.Load() {
+			log.Fatalf("all inbound is stopped")
+		}
+	}()
+}
+
+// must hold lock
+func (inst *instance) servers() []server.Server {
+	srvs := make([]server.Server, 0, len(inst.inbounds)+1)
+	for _, srv := range inst.inbounds {
+		srvs = append(srvs, srv)
+	}
+	if inst.api != nil {
+		srvs = append(srvs, inst.api)
+	}
+	return srvs
+}
+
+// wg.Add must be called before
+func (inst *instance) serve(srv server.Server) {
+	defer inst.wg.Done()
+	if err := srv.Start(); err != nil {
+		log.Errorf("inbound start err:%v", err)
+	}
+}
+
+// reload config file, swap router and rebind the changed inbounds,
+// the new listeners are bound before return, the old config keeps running if any bind failed
+func (inst *instance) reload() error {
+	inst.Lock()
+	defer inst.Unlock()
+	if inst.closing.Load() {
+		return fmt.Errorf("reload config error:shutting down")
+	}
+	cfg, err := parseConfig()
+	if err != nil {
+		return fmt.Errorf("reload config error:%v", err)
+	}
+	if !reflect.DeepEqual(cfg.Log, inst.cfg.Log) || !reflect.DeepEqual(cfg.Cache, inst.cfg.Cache) {
+		log.Warnf("reload config: log and shared cache changes take effect after restart")
+	}
+
+	// init the new servers first, keep running the old config if failed
+	inbounds := make(map[string]server.Server, len(cfg.Inbounds))
+	added := make([]server.Server, 0)
+	for _, inbound := range cfg.Inbounds {
+		key := inboundKey(inbound)
+		if srv, ok := inst.inbounds[key]; ok {
+			inbounds[key] = srv
+			continue
+		}
+		srv := server.NewDnsServer(*inbound, inst.router, inst.clients)
+		if err := srv.Init(); err != nil {
+			return fmt.Errorf("reload inbound:%v init error:%v", inbound, err)
+		}
+		inbounds[key] = srv
+		added = append(added, srv)
+	}
+	// the token is replaced without rebinding if the address is not changed
+	apiRebound := cfg.Api.Listen != inst.cfg.Api.Listen
+	var newApi server.Server
+	if apiRebound && len(cfg.Api.Listen) > 0 {
+		newApi = api.NewApiServer(cfg.Api, inst.router, inst.reload)
+		if err := newApi.Init(); err != nil {
+			return fmt.Errorf("reload api init error:%v", err)
+		}
+	}
+
+	// keep the wait group above zero while rebinding
+	inst.wg.Add(1)
+	defer inst.wg.Done()
+	// release the listeners of removed inbounds before binding
+	removed := make([]*config.Inbound, 0)
+	for _, inbound := range inst.cfg.Inbounds {
+		key := inboundKey(inbound)
+		if _, ok := inbounds[key]; !ok {
+			removed = append(removed, inbound)
+			if err := inst.inbounds[key].Shutdown(); err != nil {
+				log.Warnf("reload shutdown inbound error:%v", err)
+			}
+		}
+	}
+	if err := listenAll(added, newApi); err != nil {
+		inst.restore(removed)
+		return fmt.Errorf("reload config error:%v", err)
+	}
+
+	speedcheck.Init(&cfg.SpeedCheck)
+	// keep the memory records if not changed
+	if !reflect.DeepEqual(cfg.QueryLog, inst.cfg.QueryLog) {
+		querylog.Init(&cfg.QueryLog)
+	}
+	if !reflect.DeepEqual(cfg.Dnstap, inst.cfg.Dnstap) {
+		dnstap.Init(&cfg.Dnstap)
+	}
+	// keep the rate limit counters if not changed, the groups of the clients not in the old router are ignored until it is reloaded
+	if !reflect.DeepEqual(cfg.Clients, inst.cfg.Clients) {
+		inst.clients.Reload(cfg.Clients)
+	}
+	inst.router.Reload(cfg)
+
+	inst.wg.Add(len(added))
+	for _, srv := range added {
+		go inst.serve(srv)
+	}
+	if apiRebound {
+		// reload may be requested by the old api, shutdown it after the request finished
+		if oldApi := inst.api; oldApi != nil {
+			go func() {
+				if err := oldApi.Shutdown(); err != nil {
+					log.Warnf("reload shutdown api error:%v", err)
+				}
+			}()
+		}
+		if newApi != nil {
+			inst.wg.Add(1)
+			go inst.serve(newApi)
+		}
+		inst.api = newApi
+	} else if inst.api != nil && cfg.Api.Token != inst.cfg.Api.Token {
+		api.SetToken(inst.api, cfg.Api.Token)
+	}
+	inst.inbounds = inbounds
+	inst.cfg = cfg
+	log.Infof("reload config succeed, %d inbounds rebound", len(added))
+	return nil
+}
+
+// bind all servers, close the bound ones if any failed, newApi is nil if not changed
+func listenAll(inbounds []server.Server, newApi server.Server) error {
+	srvs := append([]server.Server(nil), inbounds...)
+	if newApi != nil {
+		srvs = append(srvs, newApi)
+	}
+	for i, srv := range srvs {
+		if err := srv.Listen(); err != nil {
+			for _, bound := range srvs[:i] {
+				bound.Shutdown()
+			}
+			return fmt.Errorf("listen error:%v", err)
+		}
+	}
+	return nil
+}
+
+// rebind the removed inbounds after a failed reload, must hold lock
+func (inst *instance) restore(removed []*config.Inbound) {
+	for _, inbound := range removed {
+		srv := server.NewDnsServer(*inbound, inst.router, inst.clients)
+		if err := srv.Init(); err != nil {
+			log.Errorf("reload restore inbound:%v init error:%v", inbound, err)
+			continue
+		}
+		if err := srv.Listen(); err != nil {
+			log.Errorf("reload restore inbound:%v listen error:%v", inbound, err)
+			continue
+		}
+		inst.inbounds[inboundKey(inbound)] = srv
+		inst.wg.Add(1)
+		go inst.serve(srv)
+	}
+}
+
+// shutdown all servers and groups
+func (inst *instance) shutdown() {
+	inst.Lock()
+	defer inst.Unlock()
+	inst.closing.Store(true)
+	for _, srv := range inst.servers() {
+		srv.Shutdown()
+	}
+	inst.router.Shutdown()
+}
+
+func inboundKey(inbound *config.Inbound) string {
+	b, _ := json.Marshal(inbound)
+	return string(b)
+}
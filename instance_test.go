@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+// write the config of an udp inbound answering lan. with 192.168.1.1
+func writeTestConfig(listen string) {
+	So(os.WriteFile(configFile, []byte(fmt.Sprintf(`{
+		"inbounds": [{"listen": "%s"}],
+		"groups": [{"outbounds": [{"setting": {"addr": "127.0.0.1:1"}}], "speedChecks": "none"}],
+		"routing": [{"domain": ["lan"], "address": ["192.168.1.1"]}]
+	}`, listen)), 0644), ShouldBeNil)
+}
+
+func freeAddr() string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+func queryLan(addr string) error {
+	r := new(dns.Msg)
+	r.SetQuestion("lan.", dns.TypeA)
+	c := &dns.Client{Timeout: time.Second}
+	resp, _, err := c.Exchange(r, addr)
+	if err != nil {
+		return err
+	}
+	if len(resp.Answer) != 1 {
+		return fmt.Errorf("unexpected answer:%v", resp.Answer)
+	}
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	Convey("TestReload", t, func() {
+		configFile = filepath.Join(t.TempDir(), "config.json")
+		addr := freeAddr()
+		writeTestConfig(addr)
+		cfg, err := parseConfig()
+		So(err, ShouldBeNil)
+		inst := newInstance(cfg)
+		inst.start()
+		defer inst.shutdown()
+		So(queryLan(addr), ShouldBeNil)
+
+		Convey("bind failed", func() {
+			occupied, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer occupied.Close()
+			writeTestConfig(occupied.LocalAddr().String())
+			So(inst.reload(), ShouldNotBeNil)
+			// the removed inbound is restored
+			So(queryLan(addr), ShouldBeNil)
+			So(inst.cfg, ShouldEqual, cfg)
+		})
+
+		Convey("bound before return", func() {
+			newAddr := freeAddr()
+			writeTestConfig(newAddr)
+			So(inst.reload(), ShouldBeNil)
+			So(queryLan(newAddr), ShouldBeNil)
+		})
+	})
+}
@@ -2,16 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/xsmartdns/xsmartdns/cache"
 	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/dnstap"
 	"github.com/xsmartdns/xsmartdns/log"
-	"github.com/xsmartdns/xsmartdns/router"
-	"github.com/xsmartdns/xsmartdns/server"
+	"github.com/xsmartdns/xsmartdns/querylog"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
 )
 
 var (
@@ -19,82 +21,82 @@ var (
 )
 
 func init() {
-	flag.StringVar(&configFile, "c", "", "config file")
+	flag.StringVar(&configFile, "c", "", "config file, json, yaml, toml or smartdns.conf by extension")
+	flag.Usage = usage
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
 	// init config
 	flag.Parse()
 	if len(configFile) == 0 {
 		flag.Usage()
 		return
 	}
+	os.Exit(run())
+}
+
+// run the server until shutdown
+func run() int {
 	cfg, err := parseConfig()
 	if err != nil {
-		panic("parse config err:" + err.Error())
+		// one error per line
+		fmt.Fprintf(os.Stderr, "parse config err:\n%v\n", err)
+		return 1
 	}
 
 	// init log
 	log.Init(&cfg.Log)
-	// init router
-	router := router.NewGroupRouter(cfg)
-	// init inbounds
-	srvs := initInbounds(cfg, router)
+	// init shared cache
+	cache.Init(&cfg.Cache)
+	// init speed check
+	speedcheck.Init(&cfg.SpeedCheck)
+	// init query log
+	querylog.Init(&cfg.QueryLog)
+	// init dnstap
+	dnstap.Init(&cfg.Dnstap)
+	defer dnstap.Close()
+	// init router and inbounds
+	inst := newInstance(cfg)
 	// start and block to wait shutdown
-	startInbounds(srvs)
+	inst.start()
+	waitSignal(inst)
+	return 0
 }
 
 func parseConfig() (*config.Config, error) {
-	b, err := os.ReadFile(configFile)
-	if err != nil {
-		return nil, err
-	}
-	return config.Parse(b)
-}
-
-func initInbounds(cfg *config.Config, router router.Router) []server.Server {
-	srvs := make([]server.Server, 0, len(cfg.Inbounds))
-	for _, inbound := range cfg.Inbounds {
-		srv := server.NewDnsServer(*inbound, router)
-		if err := srv.Init(); err != nil {
-			log.Fatalf("inbound:%v init err:%v", inbound, err)
+	if config.IsSmartdnsFile(configFile) {
+		cfg, warnings, err := config.ParseSmartdnsFile(configFile)
+		for _, w := range warnings {
+			log.Warnf("%s", w)
 		}
-		srvs = append(srvs, srv)
+		return cfg, err
 	}
-	return srvs
+	return config.ParseFile(configFile)
 }
 
-func startInbounds(srvs []server.Server) {
-	wg := sync.WaitGroup{}
-	for _, srv := range srvs {
-		wg.Add(1)
-		go func(srv server.Server) {
-			defer wg.Done()
-			if err := srv.Start(); err != nil {
-				log.Errorf("inbound start err:%v", err)
-			}
-		}(srv)
-	}
-	go func() {
-		wg.Wait()
-		log.Fatalf("all inbound is stopped")
-	}()
-	// wait signal to shutdown
-	waitShtdown(&wg, srvs)
-}
-
-func waitShtdown(wg *sync.WaitGroup, srvs []server.Server) {
+// reload on SIGHUP, shutdown on SIGINT and SIGTERM
+func waitSignal(inst *instance) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
-	log.Infof("Received signal: %s", sig)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		log.Infof("Received signal: %s", sig)
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := inst.reload(); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
 	chStoped := make(chan struct{}, 1)
 	// shutdown and wait
 	go func() {
-		for _, srv := range srvs {
-			srv.Shutdown()
-		}
-		wg.Wait()
+		inst.shutdown()
+		inst.wg.Wait()
 		chStoped <- struct{}{}
 	}()
 	// shutdown or wait timeout
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	NAMESPACE = "xsmartdns"
+	// rcode label of the queries failed without response
+	ERROR_RCODE = "ERROR"
+	// qtype label of the unknown qtypes
+	OTHER_QTYPE = "OTHER"
+)
+
+// result of a cache lookup
+type CacheResult string
+
+const (
+	HIT_CACHE_RESULT   CacheResult = "hit"
+	MISS_CACHE_RESULT  CacheResult = "miss"
+	STALE_CACHE_RESULT CacheResult = "stale"
+)
+
+// 1ms to ~8s
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 2, 14)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "queries_total", Help: "Queries by inbound, qtype and rcode.",
+	}, []string{"inbound", "qtype", "rcode"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "cache_requests_total", Help: "Cache lookups by group and result: hit, miss or stale.",
+	}, []string{"group", "result"})
+	outboundDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE, Name: "outbound_duration_seconds", Help: "Latency of the outbound requests.", Buckets: latencyBuckets,
+	}, []string{"group", "outbound"})
+	outboundErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "outbound_errors_total", Help: "Failed outbound requests.",
+	}, []string{"group", "outbound"})
+	outboundWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "outbound_wins_total", Help: "Times the outbound answered first in the group.",
+	}, []string{"group", "outbound"})
+	speedCheckProbes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "speed_check_probes_total", Help: "Speed check probes by type and result: success or failure.",
+	}, []string{"type", "result"})
+	speedCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE, Name: "speed_check_duration_seconds", Help: "Measured latency of the succeeded speed check probes.", Buckets: latencyBuckets,
+	}, []string{"type"})
+	chainDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE, Name: "chain_duration_seconds", Help: "Time spent in the chain itself, excluding the chains after it.", Buckets: latencyBuckets,
+	}, []string{"chain"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "rate_limited_total", Help: "Queries and responses over the rate limits by inbound, limit: client, subnet, clientGroup or rrl, and action: refuse, drop or slip.",
+	}, []string{"inbound", "limit", "action"})
+	dnstapDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "dnstap_dropped_total", Help: "Dnstap messages dropped as the buffer is full.",
+	})
+
+	queryLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE, Name: "query_log_dropped_total", Help: "Query log records dropped as the file buffer is full.",
+	})
+	cacheSizes = &cacheSizeCollector{
+		sizes:   make(map[*cacheSize]struct{}),
+		entries: prometheus.NewDesc(prometheus.BuildFQName(NAMESPACE, "", "cache_entries"), "Entries in the cache of the group.", []string{"group"}, nil),
+		memory:  prometheus.NewDesc(prometheus.BuildFQName(NAMESPACE, "", "cache_memory_bytes"), "Estimated memory used by the cache of the group.", []string{"group"}, nil),
+	}
+)
+
+func init() {
+	registry.MustRegister(
+		queries, cacheRequests, cacheSizes,
+		outboundDuration, outboundErrors, outboundWins,
+		speedCheckProbes, speedCheckDuration, chainDuration, rateLimited, dnstapDropped, queryLogDropped,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// http handler of prometheus metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// resp is nil if the query failed
+func ObserveQuery(inbound string, r, resp *dns.Msg) {
+	qtype := "NONE"
+	if len(r.Question) > 0 {
+		qtype = qtypeLabel(r.Question[0].Qtype)
+	}
+	rcode := ERROR_RCODE
+	if resp != nil {
+		rcode = dns.RcodeToString[resp.Rcode]
+	}
+	queries.WithLabelValues(inbound, qtype, rcode).Inc()
+}
+
+// known qtypes or OTHER, the label values are bounded
+func qtypeLabel(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return OTHER_QTYPE
+}
+
+func ObserveCache(group string, result CacheResult) {
+	cacheRequests.WithLabelValues(group, string(result)).Inc()
+}
+
+func ObserveOutbound(group, outbound string, d time.Duration, err error) {
+	if err != nil {
+		outboundErrors.WithLabelValues(group, outbound).Inc()
+		return
+	}
+	outboundDuration.WithLabelValues(group, outbound).Observe(d.Seconds())
+}
+
+func ObserveOutboundWin(group, outbound string) {
+	outboundWins.WithLabelValues(group, outbound).Inc()
+}
+
+func ObserveSpeedCheck(checkType string, rtMs int64, err error) {
+	if err != nil {
+		speedCheckProbes.WithLabelValues(checkType, "failure").Inc()
+		return
+	}
+	speedCheckProbes.WithLabelValues(checkType, "success").Inc()
+	speedCheckDuration.WithLabelValues(checkType).Observe(float64(rtMs) / 1000)
+}
+
+func ObserveChain(chain string, d time.Duration) {
+	chainDuration.WithLabelValues(chain).Observe(d.Seconds())
+}
+
+func ObserveRateLimit(inbound, limit, action string) {
+	rateLimited.WithLabelValues(inbound, limit, action).Inc()
+}
+
+func ObserveDnstapDrop() {
+	dnstapDropped.Inc()
+}
+
+func ObserveQueryLogDrop() {
+	queryLogDropped.Inc()
+}
+
+// register the size of a group cache, call the returned func to unregister
+func RegisterCacheSize(group string, size func() (entries int, memory int64)) (unregister func()) {
+	cacheSizes.Lock()
+	cacheSizes.seq++
+	s := &cacheSize{group: group, size: size, seq: cacheSizes.seq}
+	cacheSizes.sizes[s] = struct{}{}
+	cacheSizes.Unlock()
+	return func() {
+		cacheSizes.Lock()
+		delete(cacheSizes.sizes, s)
+		cacheSizes.Unlock()
+	}
+}
+
+type cacheSize struct {
+	group string
+	size  func() (entries int, memory int64)
+	// order of registered
+	seq uint64
+}
+
+// read the cache sizes when scraped
+type cacheSizeCollector struct {
+	sync.Mutex
+	sizes   map[*cacheSize]struct{}
+	seq     uint64
+	entries *prometheus.Desc
+	memory  *prometheus.Desc
+}
+
+func (c *cacheSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+	ch <- c.memory
+}
+
+func (c *cacheSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	// the old and new caches of a group are both registered while reloading, only the newest one is reported
+	c.Lock()
+	newest := make(map[string]*cacheSize)
+	for s := range c.sizes {
+		if old, ok := newest[s.group]; !ok || s.seq > old.seq {
+			newest[s.group] = s
+		}
+	}
+	c.Unlock()
+	for group, s := range newest {
+		n, m := s.size()
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(n), group)
+		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(m), group)
+	}
+}
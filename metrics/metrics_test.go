@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("observe query", t, func() {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeAAAA)
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeNameError)
+		ObserveQuery("udp://:53", r, resp)
+		ObserveQuery("udp://:53", r, nil)
+		So(testutil.ToFloat64(queries.WithLabelValues("udp://:53", "AAAA", "NXDOMAIN")), ShouldEqual, 1)
+		So(testutil.ToFloat64(queries.WithLabelValues("udp://:53", "AAAA", ERROR_RCODE)), ShouldEqual, 1)
+
+		r.SetQuestion("example.com.", 65000)
+		ObserveQuery("udp://:53", r, resp)
+		So(testutil.ToFloat64(queries.WithLabelValues("udp://:53", OTHER_QTYPE, "NXDOMAIN")), ShouldEqual, 1)
+	})
+	Convey("observe outbound", t, func() {
+		ObserveOutbound("g", "udp://1.1.1.1:53", 10*time.Millisecond, nil)
+		ObserveOutbound("g", "udp://1.1.1.1:53", time.Second, errors.New("timeout"))
+		So(testutil.ToFloat64(outboundErrors.WithLabelValues("g", "udp://1.1.1.1:53")), ShouldEqual, 1)
+		So(testutil.CollectAndCount(outboundDuration), ShouldEqual, 1)
+	})
+	Convey("cache size of the newest cache of the group", t, func() {
+		unregister1 := RegisterCacheSize("g", func() (int, int64) { return 2, 100 })
+		unregister2 := RegisterCacheSize("g", func() (int, int64) { return 3, 50 })
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(rec.Body.String(), ShouldContainSubstring, `xsmartdns_cache_entries{group="g"} 3`)
+		So(rec.Body.String(), ShouldContainSubstring, `xsmartdns_cache_memory_bytes{group="g"} 50`)
+
+		unregister2()
+		rec = httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(rec.Body.String(), ShouldContainSubstring, `xsmartdns_cache_entries{group="g"} 2`)
+		unregister1()
+		rec = httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(strings.Contains(rec.Body.String(), "xsmartdns_cache_entries"), ShouldBeFalse)
+	})
+}
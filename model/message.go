@@ -6,6 +6,10 @@ type Message struct {
 	*dns.Msg
 
 	InvokeConfig *InvokeConfig
+	// speed check results of the answer ips, set by speed sort chain
+	SpeedCheckResults []*SpeedCheckResult
+	// trace of the query, nil if not traced
+	Trace *Trace
 }
 
 type InvokeConfig struct {
@@ -13,6 +17,12 @@ type InvokeConfig struct {
 	SpeedCheckTimes int32
 }
 
+type SpeedCheckResult struct {
+	Ip string `json:"ip"`
+	// -1(speedcheck.UNKNOWN_RT_MS) if not checked or the probes are saturated, math.MaxInt64 if all checks failed
+	RtMs int64 `json:"rtMs"`
+}
+
 func WrapDnsMsg(m *dns.Msg) *Message {
 	invokeConfig := &InvokeConfig{}
 	invokeConfig.SpeedCheckTimes = 1
@@ -0,0 +1,270 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// trace of a query through the group, a nil trace records nothing
+type Trace struct {
+	mu       sync.Mutex
+	pending  sync.WaitGroup
+	start    time.Time
+	cacheHit bool
+	stale    bool
+	// the outbound answered the query
+	winner      string
+	upstreams   []*UpstreamTrace
+	speedChecks []*SpeedCheckTrace
+	events      []*TraceEvent
+}
+
+// one decision of a chain
+type TraceEvent struct {
+	// since the trace started
+	ElapsedMs float64 `json:"elapsedMs"`
+	Chain     string  `json:"chain"`
+	Message   string  `json:"message"`
+}
+
+// one speed check method of an ip
+type SpeedCheckTrace struct {
+	Ip     string `json:"ip"`
+	Method string `json:"method"`
+	RtMs   int64  `json:"rtMs"`
+	Error  string `json:"error,omitempty"`
+}
+
+// answer of one outbound
+type UpstreamTrace struct {
+	Index    int      `json:"index"`
+	Outbound string   `json:"outbound"`
+	RtMs     int64    `json:"rtMs"`
+	Rcode    string   `json:"rcode,omitempty"`
+	Answer   []string `json:"answer,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func NewTrace() *Trace {
+	return &Trace{start: time.Now()}
+}
+
+func (t *Trace) Addf(chain string, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	e := &TraceEvent{ElapsedMs: float64(time.Since(t.start).Microseconds()) / 1000, Chain: chain, Message: fmt.Sprintf(format, args...)}
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+// err is nil if succeed
+func (t *Trace) AddSpeedCheck(ip, method string, rtMs int64, err error) {
+	if t == nil {
+		return
+	}
+	s := &SpeedCheckTrace{Ip: ip, Method: method, RtMs: rtMs}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	t.mu.Lock()
+	t.speedChecks = append(t.speedChecks, s)
+	t.mu.Unlock()
+}
+
+// number of the events, the mark to copy the later ones
+func (t *Trace) Mark() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.events)
+}
+
+// copy the records of the query resolved by src, such as the leader of coalesced queries, the events before mark are skipped
+func (t *Trace) CopyFrom(src *Trace, mark int) {
+	if t == nil || src == nil || t == src {
+		return
+	}
+	src.mu.Lock()
+	// elapsed since t started
+	offset := float64(src.start.Sub(t.start).Microseconds()) / 1000
+	events := make([]*TraceEvent, 0, len(src.events))
+	for _, e := range src.events[min(mark, len(src.events)):] {
+		copied := *e
+		copied.ElapsedMs += offset
+		events = append(events, &copied)
+	}
+	winner := src.winner
+	upstreams := append([]*UpstreamTrace(nil), src.upstreams...)
+	speedChecks := append([]*SpeedCheckTrace(nil), src.speedChecks...)
+	src.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, events...)
+	sort.SliceStable(t.events, func(i, j int) bool {
+		return t.events[i].ElapsedMs < t.events[j].ElapsedMs
+	})
+	t.upstreams = append(t.upstreams, upstreams...)
+	t.speedChecks = append(t.speedChecks, speedChecks...)
+	if len(t.winner) == 0 {
+		t.winner = winner
+	}
+}
+
+// in order of added
+func (t *Trace) Events() []*TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*TraceEvent(nil), t.events...)
+}
+
+func (t *Trace) SpeedChecks() []*SpeedCheckTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*SpeedCheckTrace(nil), t.speedChecks...)
+}
+
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	hit, stale := t.CacheHit()
+	return json.Marshal(map[string]any{
+		"cacheHit":    hit,
+		"stale":       stale,
+		"winner":      t.Winner(),
+		"upstreams":   t.Upstreams(),
+		"speedChecks": t.SpeedChecks(),
+		"events":      t.Events(),
+	})
+}
+
+// human readable lines, for the cli and txt records
+func (t *Trace) Lines() []string {
+	lines := make([]string, 0)
+	if hit, stale := t.CacheHit(); stale {
+		lines = append(lines, "cache: stale")
+	} else if hit {
+		lines = append(lines, "cache: hit")
+	}
+	for _, u := range t.Upstreams() {
+		if len(u.Error) > 0 {
+			lines = append(lines, fmt.Sprintf("upstream[%d] %s %dms error: %s", u.Index, u.Outbound, u.RtMs, u.Error))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("upstream[%d] %s %dms %s %d answers", u.Index, u.Outbound, u.RtMs, u.Rcode, len(u.Answer)))
+	}
+	if winner := t.Winner(); len(winner) > 0 {
+		lines = append(lines, "answered by: "+winner)
+	}
+	for _, s := range t.SpeedChecks() {
+		if len(s.Error) > 0 {
+			lines = append(lines, fmt.Sprintf("speed check %s %s error: %s", s.Ip, s.Method, s.Error))
+			continue
+		}
+		if s.RtMs < 0 || s.RtMs >= math.MaxInt32 {
+			lines = append(lines, fmt.Sprintf("speed check %s %s failed", s.Ip, s.Method))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("speed check %s %s %dms", s.Ip, s.Method, s.RtMs))
+	}
+	for _, e := range t.Events() {
+		lines = append(lines, fmt.Sprintf("+%.1fms %s: %s", e.ElapsedMs, e.Chain, e.Message))
+	}
+	return lines
+}
+
+// record an outbound invoke, the returned func must be called with the result
+func (t *Trace) StartUpstream(index int, outbound string) func(resp *dns.Msg, err error) {
+	if t == nil {
+		return func(*dns.Msg, error) {}
+	}
+	t.pending.Add(1)
+	start := time.Now()
+	return func(resp *dns.Msg, err error) {
+		defer t.pending.Done()
+		u := &UpstreamTrace{Index: index, Outbound: outbound, RtMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			u.Error = err.Error()
+		} else if resp != nil {
+			u.Rcode = dns.RcodeToString[resp.Rcode]
+			for _, rr := range resp.Answer {
+				u.Answer = append(u.Answer, rr.String())
+			}
+		}
+		t.mu.Lock()
+		t.upstreams = append(t.upstreams, u)
+		t.mu.Unlock()
+	}
+}
+
+// stale is true if the expired cache is served
+func (t *Trace) SetCacheHit(stale bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.cacheHit, t.stale = true, stale
+	t.mu.Unlock()
+}
+
+func (t *Trace) CacheHit() (hit, stale bool) {
+	if t == nil {
+		return false, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cacheHit, t.stale
+}
+
+func (t *Trace) SetWinner(outbound string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.winner = outbound
+	t.mu.Unlock()
+}
+
+// the outbound answered the query, empty if answered by cache or address
+func (t *Trace) Winner() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.winner
+}
+
+// upstreams finished, in order of outbounds
+func (t *Trace) Upstreams() []*UpstreamTrace {
+	t.mu.Lock()
+	upstreams := append([]*UpstreamTrace(nil), t.upstreams...)
+	t.mu.Unlock()
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].Index < upstreams[j].Index
+	})
+	return upstreams
+}
+
+// wait the outbounds still running after the answer, false if timeout
+func (t *Trace) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,136 @@
+package querylog
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// one record per query
+type Record struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Inbound string    `json:"inbound"`
+	Name    string    `json:"name"`
+	Qtype   string    `json:"qtype"`
+	// matched routing rule, empty if the default group is used
+	Rule  string `json:"rule,omitempty"`
+	Group string `json:"group,omitempty"`
+	// "hit" or "stale", empty if missed
+	Cache string `json:"cache,omitempty"`
+	// the outbound answered the query
+	Outbound    string                    `json:"outbound,omitempty"`
+	SpeedChecks []*model.SpeedCheckResult `json:"speedChecks,omitempty"`
+	// rcode of the response, empty if failed
+	Rcode      string   `json:"rcode,omitempty"`
+	Answers    []string `json:"answers,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	DurationMs float64  `json:"durationMs"`
+}
+
+type Sink interface {
+	Write(r *Record)
+	Close() error
+}
+
+const (
+	// max records buffered to write the file
+	FILE_BUFFER_SIZE = 4096
+)
+
+type queryLogger struct {
+	// hold read lock to write the sinks, the sinks are closed with write lock
+	sync.RWMutex
+	closed bool
+	sinks  []Sink
+	// nil if the memory records is disabled
+	ring *ringSink
+}
+
+var logger atomic.Pointer[queryLogger]
+
+// init or replace the sinks, the old sinks are closed after the writing records drained
+func Init(cfg *config.QueryLog) {
+	l := &queryLogger{}
+	if len(cfg.Filename) > 0 {
+		l.sinks = append(l.sinks, newFileSink(cfg.Filename, int(*cfg.MaxSizeMb), int(*cfg.MaxBackups)))
+	}
+	if *cfg.MemoryRecords > 0 {
+		l.ring = newRingSink(int(*cfg.MemoryRecords))
+		l.sinks = append(l.sinks, l.ring)
+	}
+	if len(l.sinks) == 0 {
+		l = nil
+	}
+	if old := logger.Swap(l); old != nil {
+		old.close()
+	}
+}
+
+func (l *queryLogger) close() {
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warnf("close query log error:%v", err)
+		}
+	}
+}
+
+// whether any sink is enabled, the record is needless if not
+func Enabled() bool {
+	return logger.Load() != nil
+}
+
+func Write(r *Record) {
+	l := logger.Load()
+	if l == nil {
+		return
+	}
+	l.RLock()
+	defer l.RUnlock()
+	// replaced while loading
+	if l.closed {
+		return
+	}
+	for _, sink := range l.sinks {
+		sink.Write(r)
+	}
+}
+
+// filter of the memory records, empty field matches all
+type Filter struct {
+	Client string
+	// suffix of the query name, eg: example.com matches www.example.com.
+	Domain string
+	Limit  int
+}
+
+func (f *Filter) match(r *Record) bool {
+	if len(f.Client) > 0 && r.Client != f.Client {
+		return false
+	}
+	if len(f.Domain) > 0 {
+		name := strings.TrimSuffix(strings.ToLower(r.Name), ".")
+		domain := strings.TrimSuffix(strings.ToLower(f.Domain), ".")
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// the latest records in memory, newest first
+func Recent(filter *Filter) []*Record {
+	l := logger.Load()
+	if l == nil || l.ring == nil {
+		return []*Record{}
+	}
+	return l.ring.records(filter)
+}
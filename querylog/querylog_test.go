@@ -0,0 +1,62 @@
+package querylog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func TestQueryLog(t *testing.T) {
+	Convey("TestQueryLog", t, func() {
+		size, backups, records := int64(1), int64(1), int64(3)
+		filename := filepath.Join(t.TempDir(), "query.log")
+		Init(&config.QueryLog{Filename: filename, MaxSizeMb: &size, MaxBackups: &backups, MemoryRecords: &records})
+		defer Init(&config.QueryLog{MaxSizeMb: &size, MaxBackups: &backups, MemoryRecords: new(int64)})
+		So(Enabled(), ShouldBeTrue)
+
+		for _, name := range []string{"a.example.com.", "b.example.org.", "c.example.com.", "example.com."} {
+			Write(&Record{Client: "127.0.0.1", Name: name, Qtype: "A", Rcode: "NOERROR"})
+		}
+		Write(&Record{Client: "10.0.0.1", Name: "d.example.com.", Qtype: "AAAA", Error: "timeout"})
+
+		Convey("the ring keeps the latest records, newest first", func() {
+			names := func(records []*Record) []string {
+				ret := make([]string, 0, len(records))
+				for _, r := range records {
+					ret = append(ret, r.Name)
+				}
+				return ret
+			}
+			So(names(Recent(&Filter{})), ShouldResemble, []string{"d.example.com.", "example.com.", "c.example.com."})
+			So(names(Recent(&Filter{Limit: 1})), ShouldResemble, []string{"d.example.com."})
+			So(names(Recent(&Filter{Client: "127.0.0.1"})), ShouldResemble, []string{"example.com.", "c.example.com."})
+			So(names(Recent(&Filter{Domain: "Example.com", Client: "127.0.0.1", Limit: 1})), ShouldResemble, []string{"example.com."})
+			So(Recent(&Filter{Domain: "example.org"}), ShouldBeEmpty)
+		})
+		Convey("the file has one json per line", func() {
+			// the old sinks are drained when replaced
+			old := logger.Load()
+			Init(&config.QueryLog{MaxSizeMb: &size, MaxBackups: &backups, MemoryRecords: new(int64)})
+			So(old.closed, ShouldBeTrue)
+			b, err := os.ReadFile(filename)
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			So(lines, ShouldHaveLength, 5)
+			record := &Record{}
+			So(json.Unmarshal([]byte(lines[4]), record), ShouldBeNil)
+			So(record.Error, ShouldEqual, "timeout")
+		})
+	})
+	Convey("TestFileSinkDrop", t, func() {
+		// not running, the buffer is never consumed
+		s := &fileSink{ch: make(chan []byte, 1)}
+		s.Write(&Record{Name: "a.example.com."})
+		s.Write(&Record{Name: "b.example.com."})
+		So(s.ch, ShouldHaveLength, 1)
+	})
+}
@@ -0,0 +1,124 @@
+package querylog
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// json lines to a rotating file, written in background as the disk may be slow
+type fileSink struct {
+	out  *lumberjack.Logger
+	ch   chan []byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFileSink(filename string, maxSizeMb, maxBackups int) *fileSink {
+	s := &fileSink{
+		out:  &lumberjack.Logger{Filename: filename, MaxSize: maxSizeMb, MaxBackups: maxBackups},
+		ch:   make(chan []byte, FILE_BUFFER_SIZE),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *fileSink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case b := <-s.ch:
+			s.write(b)
+		case <-s.stop:
+			// flush the buffered
+			for {
+				select {
+				case b := <-s.ch:
+					s.write(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *fileSink) write(b []byte) {
+	if _, err := s.out.Write(b); err != nil {
+		log.Warnf("write query log error:%v", err)
+	}
+}
+
+// drop the record if the buffer is full
+func (s *fileSink) Write(r *Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Warnf("marshal query log error:%v", err)
+		return
+	}
+	select {
+	case s.ch <- append(b, '\n'):
+	default:
+		metrics.ObserveQueryLogDrop()
+	}
+}
+
+// must not be written after closed
+func (s *fileSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.out.Close()
+}
+
+// bounded in-memory ring, the oldest record is overwritten
+type ringSink struct {
+	sync.Mutex
+	buf []*Record
+	// index of the next write
+	next int
+	full bool
+}
+
+func newRingSink(size int) *ringSink {
+	return &ringSink{buf: make([]*Record, size)}
+}
+
+func (s *ringSink) Write(r *Record) {
+	s.Lock()
+	s.buf[s.next] = r
+	s.next = (s.next + 1) % len(s.buf)
+	if s.next == 0 {
+		s.full = true
+	}
+	s.Unlock()
+}
+
+func (s *ringSink) Close() error {
+	return nil
+}
+
+// newest first
+func (s *ringSink) records(filter *Filter) []*Record {
+	s.Lock()
+	defer s.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.buf)
+	}
+	records := make([]*Record, 0)
+	for i := 1; i <= n; i++ {
+		if filter.Limit > 0 && len(records) >= filter.Limit {
+			break
+		}
+		r := s.buf[(s.next-i+len(s.buf))%len(s.buf)]
+		if filter.match(r) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
@@ -0,0 +1,61 @@
+package router
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/group"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// traced query to explain the answer
+type Explanation struct {
+	*Route
+	Rcode  string   `json:"rcode,omitempty"`
+	Answer []string `json:"answer,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	// the final order of the answer ips
+	SpeedCheckResults []*model.SpeedCheckResult `json:"speedCheckResults,omitempty"`
+	DurationMs        float64                   `json:"durationMs"`
+	Trace             *model.Trace              `json:"trace"`
+	// nil if failed
+	Resp *dns.Msg `json:"-"`
+	// the outbounds still running after timeout
+	Timeout bool `json:"timeout,omitempty"`
+}
+
+// resolve the request by the group or routing with opts if empty, wait the outbounds still running after answered
+func Explain(router Router, req *dns.Msg, groupTag string, opts *RouteOptions, timeout time.Duration) (*Explanation, error) {
+	msg := model.WrapDnsMsg(req)
+	msg.Trace = model.NewTrace()
+	var route *Route
+	if len(groupTag) > 0 {
+		invoker, err := router.GetGroupInvoker(groupTag)
+		if err != nil {
+			return nil, err
+		}
+		route = &Route{Group: groupTag, Invoker: invoker}
+		msg.Trace.Addf("router", "group %s by request", groupTag)
+	} else {
+		var err error
+		if route, err = router.FindRoute(req, opts); err != nil {
+			return nil, err
+		}
+		msg.Trace.Addf("router", "%s", route)
+	}
+
+	start := time.Now()
+	resp, err := group.InvokeMessage(route.Invoker, msg)
+	e := &Explanation{Route: route, DurationMs: float64(time.Since(start).Microseconds()) / 1000, Trace: msg.Trace, Resp: resp}
+	e.Timeout = !msg.Trace.Wait(timeout)
+	e.SpeedCheckResults = msg.SpeedCheckResults
+	if err != nil {
+		e.Error = err.Error()
+		return e, nil
+	}
+	e.Rcode = dns.RcodeToString[resp.Rcode]
+	for _, rr := range resp.Answer {
+		e.Answer = append(e.Answer, rr.String())
+	}
+	return e, nil
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/miekg/dns"
 	"github.com/xsmartdns/xsmartdns/config"
 	"github.com/xsmartdns/xsmartdns/group"
+	"github.com/xsmartdns/xsmartdns/util"
+	"github.com/xsmartdns/xsmartdns/util/domain"
 )
 
 // match and find group
@@ -14,6 +16,24 @@ type groupRouter struct {
 	defaultGroup *config.Group
 	// key:group tag
 	groupMap map[string]group.GroupInvoker
+	// in order of routing
+	rules []*rule
+}
+
+type rule struct {
+	// index in routing
+	index    int
+	cfg      *config.Rule
+	matchers []domain.Matcher
+	// answer addresses directly, nil if forward to group
+	address group.GroupInvoker
+	// all addresses are "#", "#4" or "#6"
+	block bool
+}
+
+// the address group answers part of the qtypes
+type answerable interface {
+	Answerable(qtype uint16) bool
 }
 
 func NewGroupRouter(cfg *config.Config) Router {
@@ -21,7 +41,27 @@ func NewGroupRouter(cfg *config.Config) Router {
 	for _, g := range cfg.Groups {
 		groupMap[g.Tag] = group.NewFastlyGroupInvoker(g)
 	}
-	return &groupRouter{cfg: cfg, groupMap: groupMap, defaultGroup: cfg.Groups[0]}
+	return newGroupRouter(cfg, groupMap)
+}
+
+func newGroupRouter(cfg *config.Config, groupMap map[string]group.GroupInvoker) *groupRouter {
+	rules := make([]*rule, 0, len(cfg.Routing))
+	for i, r := range cfg.Routing {
+		matchers := make([]domain.Matcher, 0, len(r.Domain))
+		for _, pattern := range r.Domain {
+			// verified by config
+			if m, err := domain.Compile(pattern); err == nil {
+				matchers = append(matchers, m)
+			}
+		}
+		compiled := &rule{index: i, cfg: r, matchers: matchers}
+		if len(r.Address) > 0 {
+			compiled.address = group.NewAddressGroupInvoker(r.Address)
+			compiled.block = isBlockAddress(r.Address)
+		}
+		rules = append(rules, compiled)
+	}
+	return &groupRouter{cfg: cfg, groupMap: groupMap, defaultGroup: cfg.Groups[0], rules: rules}
 }
 
 func (router *groupRouter) Shutdown() {
@@ -31,18 +71,95 @@ func (router *groupRouter) Shutdown() {
 }
 
 func (router *groupRouter) FindGroupInvoker(r *dns.Msg) (group.GroupInvoker, error) {
-	groupCfg := router.findGroupCfg(r)
-	g := router.groupMap[groupCfg.Tag]
+	route, err := router.FindRoute(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return route.Invoker, nil
+}
+
+func (router *groupRouter) FindRoute(r *dns.Msg, opts *RouteOptions) (*Route, error) {
+	if opts == nil {
+		opts = &RouteOptions{}
+	}
+	matched, matcher := router.findRule(r, opts.DisableBlocking)
+	route := &Route{Group: router.defaultGroup.Tag}
+	if matched != nil {
+		route.Rule = fmt.Sprintf("routing[%d] %s", matched.index, matcher)
+		if matched.address != nil {
+			route.Group = ""
+			route.Invoker = matched.address
+			return route, nil
+		}
+		route.Group = matched.cfg.GroupTag
+	}
+	// the group may be not found while reloading
+	if _, ok := router.groupMap[opts.Group]; ok {
+		route.Group = opts.Group
+	}
+	g := router.groupMap[route.Group]
 	if g == nil {
-		return nil, fmt.Errorf("group:%s not found", groupCfg.Tag)
+		return nil, fmt.Errorf("group:%s not found", route.Group)
+	}
+	route.Invoker = g
+	return route, nil
+}
+
+func (router *groupRouter) GetGroupInvoker(tag string) (group.GroupInvoker, error) {
+	g := router.groupMap[tag]
+	if g == nil {
+		return nil, fmt.Errorf("group:%s not found", tag)
 	}
 	return g, nil
 }
 
-func (router *groupRouter) findGroupCfg(r *dns.Msg) *config.Group {
-	if len(router.cfg.Routing) == 0 {
-		return router.defaultGroup
+func (router *groupRouter) GroupTags() []string {
+	tags := make([]string, 0, len(router.cfg.Groups))
+	for _, g := range router.cfg.Groups {
+		tags = append(tags, g.Tag)
+	}
+	return tags
+}
+
+func (router *groupRouter) groupCfg(tag string) *config.Group {
+	for _, g := range router.cfg.Groups {
+		if g.Tag == tag {
+			return g
+		}
+	}
+	return nil
+}
+
+// find the first matched rule and its matcher, nil if not any matched
+func (router *groupRouter) findRule(r *dns.Msg, disableBlocking bool) (*rule, domain.Matcher) {
+	question, err := util.GetQuestion(r)
+	if err != nil {
+		return nil, nil
+	}
+	for _, rule := range router.rules {
+		if disableBlocking && rule.block {
+			continue
+		}
+		if rule.address != nil {
+			if a, ok := rule.address.(answerable); ok && !a.Answerable(question.Qtype) {
+				continue
+			}
+		}
+		for _, m := range rule.matchers {
+			if m.Match(question.Name) {
+				return rule, m
+			}
+		}
+	}
+	return nil, nil
+}
+
+// check if the addresses only block
+func isBlockAddress(addresses []string) bool {
+	for _, addr := range addresses {
+		if addr != config.BLOCK_ADDRESS && addr != config.BLOCK_IPV4_ADDRESS && addr != config.BLOCK_IPV6_ADDRESS {
+			return false
+		}
 	}
-	// TODO: geosite and domain match
-	return router.defaultGroup
+	return true
 }
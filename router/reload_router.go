@@ -0,0 +1,87 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/group"
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+// router which can be swapped atomically to a router of new config in the running inbounds
+type ReloadableRouter struct {
+	reloadLock sync.Mutex
+	router     atomic.Pointer[groupRouter]
+}
+
+func NewReloadableRouter(cfg *config.Config) *ReloadableRouter {
+	r := &ReloadableRouter{}
+	r.router.Store(NewGroupRouter(cfg).(*groupRouter))
+	return r
+}
+
+// swap to the router of cfg, the groups with unchanged config are carried over with their caches,
+// the caches of the changed groups are persisted and restored by the new groups
+func (r *ReloadableRouter) Reload(cfg *config.Config) {
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+	old := r.router.Load()
+	groupMap := make(map[string]group.GroupInvoker, len(cfg.Groups))
+	for _, g := range cfg.Groups {
+		if oldCfg := old.groupCfg(g.Tag); oldCfg != nil && sameGroupConfig(oldCfg, g) {
+			log.Infof("reload group:%s unchanged, keep it", g.Tag)
+			groupMap[g.Tag] = old.groupMap[g.Tag]
+			continue
+		}
+		log.Infof("reload group:%s", g.Tag)
+		// the replacement cache restores the entries cached by the old group
+		if oldGroup, ok := old.groupMap[g.Tag]; ok && oldGroup.Cache() != nil {
+			oldGroup.Cache().Handover()
+		}
+		groupMap[g.Tag] = group.NewFastlyGroupInvoker(g)
+	}
+	r.router.Store(newGroupRouter(cfg, groupMap))
+
+	// shutdown the groups not carried over, after their in-flight queries are finished
+	for tag, g := range old.groupMap {
+		if groupMap[tag] != g {
+			g.Shutdown()
+		}
+	}
+}
+
+func (r *ReloadableRouter) FindGroupInvoker(msg *dns.Msg) (group.GroupInvoker, error) {
+	return r.router.Load().FindGroupInvoker(msg)
+}
+
+func (r *ReloadableRouter) FindRoute(msg *dns.Msg, opts *RouteOptions) (*Route, error) {
+	return r.router.Load().FindRoute(msg, opts)
+}
+
+func (r *ReloadableRouter) GetGroupInvoker(tag string) (group.GroupInvoker, error) {
+	return r.router.Load().GetGroupInvoker(tag)
+}
+
+func (r *ReloadableRouter) GroupTags() []string {
+	return r.router.Load().GroupTags()
+}
+
+func (r *ReloadableRouter) Shutdown() {
+	r.router.Load().Shutdown()
+}
+
+func sameGroupConfig(a, b *config.Group) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
@@ -8,5 +8,39 @@ import (
 // Router used to match and find group
 type Router interface {
 	FindGroupInvoker(*dns.Msg) (group.GroupInvoker, error)
+	// find group with the matched rule, opts is nil if not any client policy
+	FindRoute(*dns.Msg, *RouteOptions) (*Route, error)
+	// get group by tag
+	GetGroupInvoker(tag string) (group.GroupInvoker, error)
+	// tags of all groups
+	GroupTags() []string
 	Shutdown()
 }
+
+// policy of the client group on routing
+type RouteOptions struct {
+	// forward to the group instead of the matched one, empty or not found not override
+	Group string
+	// skip the block address rules
+	DisableBlocking bool
+}
+
+// result of routing a request
+type Route struct {
+	// matched rule, eg: routing[1] domain:a.com., empty if not any matched
+	Rule string `json:"rule,omitempty"`
+	// group tag, empty if answered by an address rule
+	Group   string             `json:"group,omitempty"`
+	Invoker group.GroupInvoker `json:"-"`
+}
+
+func (r *Route) String() string {
+	rule := r.Rule
+	if len(rule) == 0 {
+		rule = "not any matched"
+	}
+	if len(r.Group) == 0 {
+		return rule + " answered by address"
+	}
+	return rule + " -> group " + r.Group
+}
@@ -1,85 +1,264 @@
 package server
 
 import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"time"
+
 	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/client"
 	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/dnstap"
+	"github.com/xsmartdns/xsmartdns/group"
 	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/querylog"
 	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/util"
 )
 
 type dnsServer struct {
 	cfg       config.Inbound
 	dnsServer *dns.Server
 
-	router router.Router
+	router  router.Router
+	clients *client.Matcher
+	// clients allowed to get the trace
+	traceClients []netip.Prefix
+	// acl of the inbound
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	limiter *rateLimiter
 }
 
-func NewDnsServer(cfg config.Inbound, router router.Router) Server {
-	return &dnsServer{cfg: cfg, router: router}
+func NewDnsServer(cfg config.Inbound, router router.Router, clients *client.Matcher) Server {
+	return &dnsServer{cfg: cfg, router: router, clients: clients}
 }
 
 func (srv *dnsServer) Init() error {
-	// dns handler
-	dns.HandleFunc(".", srv.handleDNSRequest)
+	var err error
+	if srv.traceClients, err = util.ParsePrefixes(srv.cfg.TraceClients); err != nil {
+		return err
+	}
+	if srv.allow, err = util.ParsePrefixes(srv.cfg.Allow); err != nil {
+		return err
+	}
+	if srv.deny, err = util.ParsePrefixes(srv.cfg.Deny); err != nil {
+		return err
+	}
+	srv.limiter = newRateLimiter(srv.cfg.RateLimit)
+	// create dns server, each inbound has its own handler
+	srv.dnsServer = &dns.Server{Addr: srv.cfg.Listen, Net: string(srv.cfg.Net), Handler: dns.HandlerFunc(srv.handleDNSRequest)}
+	return nil
+}
 
-	// create dns server
-	srv.dnsServer = &dns.Server{Addr: srv.cfg.Listen, Net: string(srv.cfg.Net)}
+func (srv *dnsServer) Listen() error {
+	addr := srv.cfg.Listen
+	if len(addr) == 0 {
+		addr = ":domain"
+	}
+	switch srv.cfg.Net {
+	case config.TCP_NET:
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		srv.dnsServer.Listener = l
+	case config.TLS_NET:
+		cert, err := tls.LoadX509KeyPair(srv.cfg.TlsCert, srv.cfg.TlsKey)
+		if err != nil {
+			return err
+		}
+		l, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return err
+		}
+		srv.dnsServer.Listener = l
+	default:
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		srv.dnsServer.PacketConn = pc
+	}
 	return nil
 }
 
 func (srv *dnsServer) Start() error {
 	log.Infof("Starting %s server on %s", srv.cfg.Net, srv.cfg.Listen)
-	return srv.dnsServer.ListenAndServe()
+	return srv.dnsServer.ActivateAndServe()
 }
 
 func (srv *dnsServer) Shutdown() error {
 	log.Infof("Shutdown %s server on %s", srv.cfg.Net, srv.cfg.Listen)
-	srv.router.Shutdown()
-	return srv.dnsServer.Shutdown()
+	if err := srv.dnsServer.Shutdown(); err != nil {
+		// bound but not served
+		return srv.closeListener()
+	}
+	return nil
+}
+
+func (srv *dnsServer) closeListener() error {
+	if srv.dnsServer.PacketConn != nil {
+		return srv.dnsServer.PacketConn.Close()
+	}
+	if srv.dnsServer.Listener != nil {
+		return srv.dnsServer.Listener.Close()
+	}
+	return nil
 }
 
 // process dns request
 func (srv *dnsServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	logAccessRequest(r)
+	start := time.Now()
+	dnstap.ClientQuery(srv.cfg.Net, w.RemoteAddr(), w.LocalAddr(), r, start)
+	clientIp := util.AddrIp(w.RemoteAddr())
+	if !srv.aclAllowed(clientIp) {
+		log.Debuf("client:%s is refused by acl", clientIp)
+		srv.refuse(w, r, start)
+		return
+	}
+	if limit, ok := srv.limiter.allowQuery(clientIp); !ok {
+		srv.limited(w, r, start, limit)
+		return
+	}
+	// policy of the client group
+	var opts *router.RouteOptions
+	clientGroup := srv.clients.Match(clientIp)
+	if clientGroup != nil {
+		if !clientGroup.Allow(clientIp) {
+			srv.limited(w, r, start, CLIENT_GROUP_LIMIT)
+			return
+		}
+		opts = clientGroup.RouteOptions()
+	}
+	traceAllowed := srv.traceAllowed(w)
+	if traceAllowed && isTraceQuery(r) {
+		resp := srv.explain(r, clientGroup)
+		metrics.ObserveQuery(srv.name(), r, resp)
+		srv.truncate(r, resp)
+		srv.writeMsg(w, clientIp, resp, start)
+		return
+	}
+	traced := traceAllowed && removeTraceOption(r)
+	msg := model.WrapDnsMsg(r)
+	if traced || querylog.Enabled() {
+		msg.Trace = model.NewTrace()
+	}
+	if clientGroup != nil {
+		msg.Trace.Addf("client", "client group %s", clientGroup.Cfg.Tag)
+	}
 
 	// process request
-	resp, err := srv.processServe(r)
+	route, resp, err := srv.processServe(msg, opts)
+	metrics.ObserveQuery(srv.name(), r, resp)
+	if querylog.Enabled() {
+		querylog.Write(srv.queryRecord(w, route, msg, resp, err, start))
+	}
 	if err != nil {
 		log.Errorf("request:%s processServe error:%s", r, err)
 		// TODO: write empty msg to client?
 		return
 	}
 
-	// response
-	logResponse(resp)
-	// write to client
+	if traced {
+		appendTrace(resp, msg.Trace)
+		srv.truncate(r, resp)
+	}
+	srv.writeMsg(w, clientIp, resp, start)
+}
+
+// write to client, limited by rrl if udp
+func (srv *dnsServer) writeMsg(w dns.ResponseWriter, clientIp netip.Addr, resp *dns.Msg, start time.Time) {
+	if srv.cfg.Net == config.UDP_NET {
+		switch action := srv.limiter.limitResponse(clientIp, resp); action {
+		case DROP_RRL_ACTION:
+			metrics.ObserveRateLimit(srv.name(), RRL_LIMIT, string(action))
+			return
+		case SLIP_RRL_ACTION:
+			metrics.ObserveRateLimit(srv.name(), RRL_LIMIT, string(action))
+			resp = slipMsg(resp)
+		}
+	}
 	w.WriteMsg(resp)
+	dnstap.ClientResponse(srv.cfg.Net, w.RemoteAddr(), w.LocalAddr(), resp, start, time.Now())
+}
+
+// answer REFUSED without routing
+func (srv *dnsServer) refuse(w dns.ResponseWriter, r *dns.Msg, start time.Time) {
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeRefused)
+	metrics.ObserveQuery(srv.name(), r, resp)
+	srv.writeMsg(w, util.AddrIp(w.RemoteAddr()), resp, start)
+}
+
+// refuse or drop the query over the limit
+func (srv *dnsServer) limited(w dns.ResponseWriter, r *dns.Msg, start time.Time, limit string) {
+	action := srv.limiter.action()
+	log.Debuf("client:%s is over the %s rate limit, %s", w.RemoteAddr(), limit, action)
+	metrics.ObserveRateLimit(srv.name(), limit, string(action))
+	if action == config.DROP_RATE_LIMIT_ACTION {
+		return
+	}
+	srv.refuse(w, r, start)
 }
 
-func (srv *dnsServer) processServe(r *dns.Msg) (*dns.Msg, error) {
+// deny is checked before allow, empty allow for all
+func (srv *dnsServer) aclAllowed(ip netip.Addr) bool {
+	if util.PrefixesContain(srv.deny, ip) {
+		return false
+	}
+	return len(srv.allow) == 0 || util.PrefixesContain(srv.allow, ip)
+}
+
+// inbound name for metrics, such as udp://:53
+func (srv *dnsServer) name() string {
+	return string(srv.cfg.Net) + "://" + srv.cfg.Listen
+}
+
+func (srv *dnsServer) processServe(r *model.Message, opts *router.RouteOptions) (*router.Route, *dns.Msg, error) {
 	// find group by router
-	invoker, err := srv.router.FindGroupInvoker(r)
+	route, err := srv.router.FindRoute(r.Msg, opts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	r.Trace.Addf("router", "%s", route)
 	// group invoke
-	return invoker.Invoke(r)
+	resp, err := group.InvokeMessage(route.Invoker, r)
+	return route, resp, err
 }
 
-// access request
-func logAccessRequest(r *dns.Msg) {
-	if len(r.Question) == 0 {
-		return
+// route is nil if not found
+func (srv *dnsServer) queryRecord(w dns.ResponseWriter, route *router.Route, msg *model.Message, resp *dns.Msg, err error, start time.Time) *querylog.Record {
+	record := &querylog.Record{
+		Time:        start,
+		Client:      util.AddrIp(w.RemoteAddr()).String(),
+		Inbound:     srv.name(),
+		Outbound:    msg.Trace.Winner(),
+		SpeedChecks: msg.SpeedCheckResults,
+		DurationMs:  float64(time.Since(start).Microseconds()) / 1000,
 	}
-	log.Infof("Received DNS request from %s", r.Question[0].Name)
-	for _, question := range r.Question {
-		log.Infof("Question:%s %s %s", question.Name, dns.Class(question.Qclass).String(), dns.Type(question.Qtype).String())
+	if len(msg.Question) > 0 {
+		record.Name = msg.Question[0].Name
+		record.Qtype = dns.Type(msg.Question[0].Qtype).String()
 	}
-}
-
-// access response
-func logResponse(r *dns.Msg) {
-	for _, answer := range r.Answer {
-		log.Infof("%T Answer: %s", answer, answer.String())
+	if route != nil {
+		record.Rule, record.Group = route.Rule, route.Group
+	}
+	if hit, stale := msg.Trace.CacheHit(); stale {
+		record.Cache = "stale"
+	} else if hit {
+		record.Cache = "hit"
+	}
+	if err != nil {
+		record.Error = err.Error()
+		return record
+	}
+	record.Rcode = dns.RcodeToString[resp.Rcode]
+	for _, rr := range resp.Answer {
+		record.Answers = append(record.Answers, rr.String())
 	}
+	return record
 }
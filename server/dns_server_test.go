@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/cache"
+	"github.com/xsmartdns/xsmartdns/client"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/querylog"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/util/speedcheck"
+)
+
+// udp response writer of a client
+type mockResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *mockResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *mockResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+func (w *mockResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *mockResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+func (w *mockResponseWriter) Close() error {
+	return nil
+}
+func (w *mockResponseWriter) TsigStatus() error {
+	return nil
+}
+func (w *mockResponseWriter) TsigTimersOnly(bool) {
+}
+func (w *mockResponseWriter) Hijack() {
+}
+
+func TestHandleDNSRequest(t *testing.T) {
+	Convey("TestHandleDNSRequest", t, func() {
+		log.Init(&config.Log{Level: "error"})
+		// the outbounds are never answered
+		cfg, err := config.Parse([]byte(`{
+			"inbounds": [{"listen": "127.0.0.1:0", "allow": ["10.0.0.0/8"], "deny": ["10.0.0.1"]}],
+			"groups": [
+				{"outbounds": [{"setting": {"addr": "127.0.0.1:1"}}], "speedChecks": "none"},
+				{"tag": "kids", "outbounds": [{"setting": {"addr": "127.0.0.1:1"}}], "speedChecks": "none"}
+			],
+			"routing": [{"domain": ["ads.com"], "address": ["#"]}, {"domain": ["lan"], "address": ["192.168.1.1"]}],
+			"clients": [
+				{"tag": "kids", "cidrs": ["10.0.1.0/24"], "groupTag": "kids"},
+				{"tag": "admin", "cidrs": ["10.0.2.0/24"], "blocking": false}
+			],
+			"queryLog": {"memoryRecords": 10}
+		}`))
+		So(err, ShouldBeNil)
+		cache.Init(&cfg.Cache)
+		speedcheck.Init(&cfg.SpeedCheck)
+		querylog.Init(&cfg.QueryLog)
+		disabled := int64(0)
+		defer querylog.Init(&config.QueryLog{MemoryRecords: &disabled})
+		groupRouter := router.NewGroupRouter(cfg)
+		defer groupRouter.Shutdown()
+		srv := NewDnsServer(*cfg.Inbounds[0], groupRouter, client.NewMatcher(cfg.Clients)).(*dnsServer)
+		So(srv.Init(), ShouldBeNil)
+
+		query := func(clientIp, name string) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetQuestion(name, dns.TypeA)
+			w := &mockResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(clientIp), Port: 5353}}
+			srv.handleDNSRequest(w, r)
+			return w.msg
+		}
+		lastRecord := func() *querylog.Record {
+			records := querylog.Recent(&querylog.Filter{Limit: 1})
+			So(records, ShouldHaveLength, 1)
+			return records[0]
+		}
+
+		Convey("deny before allow", func() {
+			So(query("10.0.0.1", "lan.").Rcode, ShouldEqual, dns.RcodeRefused)
+			So(query("192.168.1.2", "lan.").Rcode, ShouldEqual, dns.RcodeRefused)
+			resp := query("10.0.0.2", "lan.")
+			So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(resp.Answer, ShouldHaveLength, 1)
+		})
+		Convey("override the group of the client", func() {
+			query("10.0.1.1", "example.com.")
+			So(lastRecord().Group, ShouldEqual, "kids")
+			query("10.0.0.2", "example.com.")
+			So(lastRecord().Group, ShouldEqual, "default")
+			// the address rules still apply
+			So(query("10.0.1.1", "lan.").Answer, ShouldHaveLength, 1)
+		})
+		Convey("disable blocking of the client", func() {
+			resp := query("10.0.0.2", "ads.com.")
+			So(resp.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(resp.Answer, ShouldBeEmpty)
+			So(lastRecord().Group, ShouldBeEmpty)
+			query("10.0.2.1", "ads.com.")
+			So(lastRecord().Group, ShouldEqual, "default")
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"math"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
+)
+
+// limit of the rate limit metrics
+const (
+	CLIENT_LIMIT       = "client"
+	SUBNET_LIMIT       = "subnet"
+	CLIENT_GROUP_LIMIT = "clientGroup"
+	RRL_LIMIT          = "rrl"
+)
+
+// action of the rrl, the same as the rate limit metrics
+type rrlAction string
+
+const (
+	PASS_RRL_ACTION rrlAction = ""
+	DROP_RRL_ACTION rrlAction = "drop"
+	SLIP_RRL_ACTION rrlAction = "slip"
+)
+
+// rate limits of an inbound, nil no limit
+type rateLimiter struct {
+	cfg    *config.InboundRateLimit
+	client *ratelimit.KeyedLimiter[netip.Addr]
+	subnet *ratelimit.KeyedLimiter[netip.Prefix]
+	rrl    *ratelimit.KeyedLimiter[rrlKey]
+}
+
+// identical responses to a client subnet
+type rrlKey struct {
+	subnet netip.Prefix
+	name   string
+	qtype  uint16
+	rcode  int
+}
+
+func newRateLimiter(cfg *config.InboundRateLimit) *rateLimiter {
+	if cfg == nil {
+		return nil
+	}
+	l := &rateLimiter{cfg: cfg}
+	if cfg.Client != nil && cfg.Client.Qps > 0 {
+		l.client = ratelimit.NewKeyedLimiter[netip.Addr](cfg.Client.Qps, burstOf(cfg.Client))
+	}
+	if cfg.Subnet != nil && cfg.Subnet.Qps > 0 {
+		l.subnet = ratelimit.NewKeyedLimiter[netip.Prefix](cfg.Subnet.Qps, burstOf(cfg.Subnet))
+	}
+	if cfg.Rrl != nil && cfg.Rrl.Qps > 0 {
+		l.rrl = ratelimit.NewKeyedLimiter[rrlKey](cfg.Rrl.Qps, burstOf(&cfg.Rrl.RateLimit))
+	}
+	return l
+}
+
+func burstOf(cfg *config.RateLimit) int {
+	return int(min(cfg.Burst, math.MaxInt32))
+}
+
+// take a token of the client ip and subnet, the exceeded limit if not allowed
+func (l *rateLimiter) allowQuery(ip netip.Addr) (string, bool) {
+	if l == nil {
+		return "", true
+	}
+	if l.client != nil && !l.client.Allow(ip.Unmap()) {
+		return CLIENT_LIMIT, false
+	}
+	if l.subnet != nil && !l.subnet.Allow(l.subnetOf(ip)) {
+		return SUBNET_LIMIT, false
+	}
+	return "", true
+}
+
+// action of the queries over the limits
+func (l *rateLimiter) action() config.RateLimitAction {
+	if l == nil {
+		return config.REFUSE_RATE_LIMIT_ACTION
+	}
+	return l.cfg.Action
+}
+
+// check the response to the client by rrl
+func (l *rateLimiter) limitResponse(ip netip.Addr, resp *dns.Msg) rrlAction {
+	if l == nil || l.rrl == nil {
+		return PASS_RRL_ACTION
+	}
+	key := rrlKey{subnet: l.subnetOf(ip), rcode: resp.Rcode}
+	if len(resp.Question) > 0 {
+		key.name = strings.ToLower(resp.Question[0].Name)
+		key.qtype = resp.Question[0].Qtype
+	}
+	allowed, over := l.rrl.Take(key)
+	if allowed {
+		return PASS_RRL_ACTION
+	}
+	// slip by the responses over the limit of the key
+	if slip := *l.cfg.Rrl.Slip; slip > 0 && over%slip == 0 {
+		return SLIP_RRL_ACTION
+	}
+	return DROP_RRL_ACTION
+}
+
+func (l *rateLimiter) subnetOf(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	bits := *l.cfg.Ipv6PrefixLength
+	if ip.Is4() {
+		bits = *l.cfg.Ipv4PrefixLength
+	}
+	prefix, _ := ip.Prefix(int(bits))
+	return prefix
+}
+
+// empty response with TC=1 to retry by tcp
+func slipMsg(resp *dns.Msg) *dns.Msg {
+	m := &dns.Msg{MsgHdr: resp.MsgHdr, Question: resp.Question}
+	m.Truncated = true
+	return m
+}
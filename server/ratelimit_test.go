@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	Convey("TestRateLimit", t, func() {
+		So(newRateLimiter(nil).action(), ShouldEqual, config.REFUSE_RATE_LIMIT_ACTION)
+		cfg := &config.InboundRateLimit{
+			Client: &config.RateLimit{Qps: 0.001, Burst: 2},
+			Subnet: &config.RateLimit{Qps: 0.001, Burst: 3},
+			Rrl:    &config.Rrl{RateLimit: config.RateLimit{Qps: 0.001}},
+			Action: config.DROP_RATE_LIMIT_ACTION,
+		}
+		cfg.FillDefault()
+		So(cfg.Verify(), ShouldBeNil)
+		l := newRateLimiter(cfg)
+		So(l.action(), ShouldEqual, config.DROP_RATE_LIMIT_ACTION)
+
+		Convey("limit the client and subnet", func() {
+			a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("::ffff:10.0.0.2")
+			for i := 0; i < 2; i++ {
+				_, ok := l.allowQuery(a)
+				So(ok, ShouldBeTrue)
+			}
+			limit, ok := l.allowQuery(a)
+			So(ok, ShouldBeFalse)
+			So(limit, ShouldEqual, CLIENT_LIMIT)
+			// the third query of 10.0.0.0/24
+			_, ok = l.allowQuery(b)
+			So(ok, ShouldBeTrue)
+			limit, ok = l.allowQuery(b)
+			So(ok, ShouldBeFalse)
+			So(limit, ShouldEqual, SUBNET_LIMIT)
+			_, ok = l.allowQuery(netip.MustParseAddr("10.0.1.1"))
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("slip every slip-th response over the rrl of the key", func() {
+			slip := int64(3)
+			cfg.Rrl.Slip = &slip
+			ip := netip.MustParseAddr("2001:db8::1")
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			So(l.limitResponse(ip, resp), ShouldEqual, PASS_RRL_ACTION)
+			// other keys over the limit not change the slips of the key
+			other := resp.Copy()
+			other.Question[0].Name = "other.com."
+			So(l.limitResponse(ip, other), ShouldEqual, PASS_RRL_ACTION)
+			So(l.limitResponse(netip.MustParseAddr("2001:db9::1"), resp), ShouldEqual, PASS_RRL_ACTION)
+			for i := 1; i <= 9; i++ {
+				So(l.limitResponse(netip.MustParseAddr("2001:db9::1"), resp), ShouldNotEqual, PASS_RRL_ACTION)
+				So(l.limitResponse(ip, other), ShouldNotEqual, PASS_RRL_ACTION)
+				expected := DROP_RRL_ACTION
+				if i%3 == 0 {
+					expected = SLIP_RRL_ACTION
+				}
+				So(l.limitResponse(ip, resp), ShouldEqual, expected)
+			}
+			// other responses have their own bucket
+			resp.Rcode = dns.RcodeNameError
+			So(l.limitResponse(ip, resp), ShouldEqual, PASS_RRL_ACTION)
+
+			slipped := slipMsg(resp)
+			So(slipped.Truncated, ShouldBeTrue)
+			So(slipped.Id, ShouldEqual, r.Id)
+			So(slipped.Rcode, ShouldEqual, dns.RcodeNameError)
+			So(slipped.Answer, ShouldBeEmpty)
+		})
+
+	})
+}
@@ -2,6 +2,9 @@ package server
 
 type Server interface {
 	Init() error
+	// bind the listener, the errors such as address in use are returned before serving
+	Listen() error
+	// serve on the bound listener until shutdown
 	Start() error
 	Shutdown() error
 }
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xsmartdns/xsmartdns/client"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/model"
+	"github.com/xsmartdns/xsmartdns/router"
+	"github.com/xsmartdns/xsmartdns/util"
+)
+
+const (
+	// EDNS0 local option to get the trace in the additional section, eg: dig +ednsopt=65300 example.com
+	TRACE_EDNS0_OPTION_CODE = 65300
+	// max time to wait the other outbounds of a CH TXT trace query
+	TRACE_QUERY_TIMEOUT = time.Second
+	// max length of a txt string
+	MAX_TXT_STRING_LEN = 255
+	// suffix of the CH TXT query name with the qtype label, eg: aaaa.example.com.trace.
+	TRACE_QTYPE_SUFFIX = ".trace."
+)
+
+func (srv *dnsServer) traceAllowed(w dns.ResponseWriter) bool {
+	return len(srv.traceClients) > 0 && util.PrefixesContain(srv.traceClients, util.AddrIp(w.RemoteAddr()))
+}
+
+// CH TXT query of a domain, eg: dig CH TXT example.com
+func isTraceQuery(r *dns.Msg) bool {
+	return len(r.Question) == 1 && r.Question[0].Qclass == dns.ClassCHAOS && r.Question[0].Qtype == dns.TypeTXT
+}
+
+// remove the trace option not to forward it, false if not found
+func removeTraceOption(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for i, o := range opt.Option {
+		if o.Option() == TRACE_EDNS0_OPTION_CODE {
+			opt.Option = append(opt.Option[:i:i], opt.Option[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// name and qtype to explain of the CH TXT query name, eg: A of example.com. or AAAA of aaaa.example.com.trace.
+func traceQuestion(name string) (string, uint16) {
+	if !strings.HasSuffix(strings.ToLower(name), TRACE_QTYPE_SUFFIX) {
+		return name, dns.TypeA
+	}
+	name = name[:len(name)-len(TRACE_QTYPE_SUFFIX)] + "."
+	label, rest, found := strings.Cut(name, ".")
+	if qtype, ok := dns.StringToType[strings.ToUpper(label)]; ok && found && len(rest) > 0 {
+		return rest, qtype
+	}
+	return name, dns.TypeA
+}
+
+// resolve the CH TXT query name, answer the trace in txt
+func (srv *dnsServer) explain(r *dns.Msg, clientGroup *client.Group) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(traceQuestion(r.Question[0].Name))
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	var opts *router.RouteOptions
+	if clientGroup != nil {
+		opts = clientGroup.RouteOptions()
+	}
+	e, err := router.Explain(srv.router, req, "", opts, TRACE_QUERY_TIMEOUT)
+	if err != nil {
+		resp.Answer = traceTxt(r.Question[0].Name, []string{"error: " + err.Error()})
+		return resp
+	}
+	lines := e.Trace.Lines()
+	if clientGroup != nil {
+		lines = append([]string{"client group " + clientGroup.Cfg.Tag}, lines...)
+	}
+	if len(e.Error) > 0 {
+		lines = append(lines, "error: "+e.Error)
+	} else {
+		lines = append(lines, "answer: "+e.Rcode)
+		for _, rr := range e.Answer {
+			lines = append(lines, "answer: "+strings.ReplaceAll(rr, "\t", " "))
+		}
+	}
+	resp.Answer = traceTxt(r.Question[0].Name, lines)
+	return resp
+}
+
+// the trace records may exceed the udp size
+func (srv *dnsServer) truncate(r, resp *dns.Msg) {
+	if srv.cfg.Net != config.UDP_NET {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+}
+
+// append the trace to the additional section
+func appendTrace(resp *dns.Msg, trace *model.Trace) {
+	name := "."
+	if len(resp.Question) > 0 {
+		name = resp.Question[0].Name
+	}
+	resp.Extra = append(resp.Extra, traceTxt(name, trace.Lines())...)
+}
+
+// one CH TXT record per line
+func traceTxt(name string, lines []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(lines))
+	for i, line := range lines {
+		txt := &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}}
+		// keep the order by the index, the records may be reordered by the client
+		line = fmt.Sprintf("%02d %s", i, line)
+		for len(line) > MAX_TXT_STRING_LEN {
+			txt.Txt = append(txt.Txt, line[:MAX_TXT_STRING_LEN])
+			line = line[MAX_TXT_STRING_LEN:]
+		}
+		txt.Txt = append(txt.Txt, line)
+		rrs = append(rrs, txt)
+	}
+	return rrs
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+func TestTrace(t *testing.T) {
+	Convey("TestTrace", t, func() {
+		Convey("remove the trace option", func() {
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			So(removeTraceOption(r), ShouldBeFalse)
+			r.SetEdns0(4096, false)
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: TRACE_EDNS0_OPTION_CODE}, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+			So(removeTraceOption(r), ShouldBeTrue)
+			So(opt.Option, ShouldHaveLength, 1)
+			So(opt.Option[0].Option(), ShouldEqual, dns.EDNS0COOKIE)
+		})
+		Convey("trace in txt", func() {
+			trace := model.NewTrace()
+			trace.SetCacheHit(true)
+			trace.Addf("speedSort", "drop %s", "1.1.1.1")
+			resp := new(dns.Msg)
+			resp.SetQuestion("example.com.", dns.TypeA)
+			appendTrace(resp, trace)
+			So(resp.Extra, ShouldHaveLength, 2)
+			So(resp.Extra[0].(*dns.TXT).Txt, ShouldResemble, []string{"00 cache: stale"})
+			So(resp.Extra[1].(*dns.TXT).Txt[0], ShouldEndWith, "speedSort: drop 1.1.1.1")
+			So(resp.Extra[1].Header().Class, ShouldEqual, dns.ClassCHAOS)
+
+			rrs := traceTxt("example.com.", []string{strings.Repeat("a", 300)})
+			So(rrs[0].(*dns.TXT).Txt, ShouldHaveLength, 2)
+			So(rrs[0].(*dns.TXT).Txt[0], ShouldHaveLength, MAX_TXT_STRING_LEN)
+		})
+		Convey("the qtype of the CH TXT name", func() {
+			name, qtype := traceQuestion("example.com.")
+			So(name, ShouldEqual, "example.com.")
+			So(qtype, ShouldEqual, dns.TypeA)
+			name, qtype = traceQuestion("AAAA.example.com.Trace.")
+			So(name, ShouldEqual, "example.com.")
+			So(qtype, ShouldEqual, dns.TypeAAAA)
+			name, qtype = traceQuestion("www.example.com.trace.")
+			So(name, ShouldEqual, "www.example.com.")
+			So(qtype, ShouldEqual, dns.TypeA)
+			name, qtype = traceQuestion("aaaa.trace.")
+			So(name, ShouldEqual, "aaaa.")
+			So(qtype, ShouldEqual, dns.TypeA)
+		})
+		Convey("truncate the udp response", func() {
+			srv := &dnsServer{}
+			srv.cfg.Net = config.UDP_NET
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			lines := make([]string, 0)
+			for i := 0; i < 50; i++ {
+				lines = append(lines, strings.Repeat("a", 50))
+			}
+			resp.Extra = traceTxt("example.com.", lines)
+			srv.truncate(r, resp)
+			So(resp.Len(), ShouldBeLessThanOrEqualTo, dns.MinMsgSize)
+		})
+	})
+}
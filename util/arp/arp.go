@@ -0,0 +1,100 @@
+package arp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+const (
+	// linux arp table, only IPv4
+	ARP_TABLE_FILE = "/proc/net/arp"
+	// reload the table in background every the interval
+	ARP_REFRESH_INTERVAL = 30 * time.Second
+)
+
+var (
+	table     = &arpTable{file: ARP_TABLE_FILE}
+	startOnce sync.Once
+)
+
+// load the table and refresh it in background, call before Lookup
+func Start() {
+	startOnce.Do(func() {
+		table.refresh()
+		go func() {
+			for range time.Tick(ARP_REFRESH_INTERVAL) {
+				table.refresh()
+			}
+		}()
+	})
+}
+
+// mac of the ip in the lan, eg: 00:11:22:33:44:55, not found if not started
+func Lookup(ip netip.Addr) (string, bool) {
+	return table.lookup(ip)
+}
+
+type arpTable struct {
+	file string
+	macs atomic.Pointer[map[netip.Addr]string]
+	// only accessed by the refreshing goroutine
+	warned bool
+}
+
+func (t *arpTable) lookup(ip netip.Addr) (string, bool) {
+	macs := t.macs.Load()
+	if macs == nil {
+		return "", false
+	}
+	mac, ok := (*macs)[ip.Unmap()]
+	return mac, ok
+}
+
+// keep the old table if failed
+func (t *arpTable) refresh() {
+	f, err := os.Open(t.file)
+	if err != nil {
+		if !t.warned {
+			t.warned = true
+			log.Warnf("read arp table error:%v", err)
+		}
+		return
+	}
+	defer f.Close()
+	macs := parse(f)
+	t.macs.Store(&macs)
+}
+
+// IP address  HW type  Flags  HW address  Mask  Device
+func parse(r io.Reader) map[netip.Addr]string {
+	macs := make(map[netip.Addr]string)
+	scanner := bufio.NewScanner(r)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// incomplete entries have the flags 0x0
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			continue
+		}
+		macs[ip] = mac.String()
+	}
+	return macs
+}
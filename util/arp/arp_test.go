@@ -0,0 +1,55 @@
+package arp
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+func TestLookup(t *testing.T) {
+	Convey("TestLookup", t, func() {
+		file := filepath.Join(t.TempDir(), "arp")
+		So(os.WriteFile(file, []byte(`IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.2      0x1         0x2         00:11:22:AA:BB:CC     *        eth0
+192.168.1.3      0x1         0x0         00:00:00:00:00:00     *        eth0
+`), 0o644), ShouldBeNil)
+		tb := &arpTable{file: file}
+		// not loaded
+		_, ok := tb.lookup(netip.MustParseAddr("192.168.1.2"))
+		So(ok, ShouldBeFalse)
+
+		tb.refresh()
+		mac, ok := tb.lookup(netip.MustParseAddr("192.168.1.2"))
+		So(ok, ShouldBeTrue)
+		So(mac, ShouldEqual, "00:11:22:aa:bb:cc")
+		_, ok = tb.lookup(netip.MustParseAddr("192.168.1.3"))
+		So(ok, ShouldBeFalse)
+		// ipv4-mapped ipv6 of the dual stack listener
+		_, ok = tb.lookup(netip.MustParseAddr("::ffff:192.168.1.2"))
+		So(ok, ShouldBeTrue)
+
+		So(os.WriteFile(file, []byte("IP address HW type Flags HW address Mask Device\n"), 0o644), ShouldBeNil)
+		tb.refresh()
+		_, ok = tb.lookup(netip.MustParseAddr("192.168.1.2"))
+		So(ok, ShouldBeFalse)
+
+		// keep the table if failed
+		So(os.WriteFile(file, []byte("IP address HW type Flags HW address Mask Device\n192.168.1.2 0x1 0x2 00:11:22:aa:bb:cc * eth0\n"), 0o644), ShouldBeNil)
+		tb.refresh()
+		So(os.Remove(file), ShouldBeNil)
+		tb.refresh()
+		So(tb.warned, ShouldBeTrue)
+		_, ok = tb.lookup(netip.MustParseAddr("192.168.1.2"))
+		So(ok, ShouldBeTrue)
+	})
+}
@@ -33,6 +33,40 @@ func GetQuestionKey(q *dns.Question) string {
 	return q.String()
 }
 
+// get the EDNS Client Subnet option of msg, nil if not present
+func GetEdns0Subnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// add an Extended DNS Error(RFC 8914) to resp if the request supports EDNS
+func SetExtendedError(r, resp *dns.Msg, code uint16) {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code})
+}
+
+// check DNSSEC OK bit of msg
+func IsDnssecOk(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
 // Get the unique key of a dns question
 func GetQuestionRR(rr dns.RR) string {
 	header := rr.Header()
@@ -57,17 +91,81 @@ func RemoveDuplicateRR(data []dns.RR) []dns.RR {
 	return ret
 }
 
-// merge from other msg answer
+// merge answers of other msgs into m, return the merged msg
+// the first msg which has answers is the base, its cname chain is kept and
+// the final records of other chains are renamed to the final name of the base chain.
+// records are deduplicated by name and data with the min ttl
 func MergeAllAnswer(m *dns.Msg, other ...*dns.Msg) *dns.Msg {
-	answer := make([]dns.RR, 0, len(m.Answer))
-	ns := make([]dns.RR, 0, len(m.Ns))
-	extra := make([]dns.RR, 0, len(m.Ns))
-	for _, msg := range other {
-		answer = append(answer, msg.Answer...)
-		ns = append(ns, msg.Ns...)
-		extra = append(extra, msg.Extra...)
+	base, rest := m, other
+	if len(m.Answer) == 0 || m.Rcode != dns.RcodeSuccess {
+		for i, msg := range other {
+			if len(msg.Answer) > 0 && msg.Rcode == dns.RcodeSuccess {
+				base, rest = msg, append([]*dns.Msg{m}, append(other[:i:i], other[i+1:]...)...)
+				break
+			}
+		}
+	}
+	question, err := GetQuestion(base)
+	if err != nil {
+		return base
+	}
+	baseName := GetCnameTarget(base.Answer, question.Name)
+
+	answer := make([]dns.RR, 0, len(base.Answer))
+	index := make(map[string]dns.RR, len(base.Answer))
+	// add rr or take the min ttl if exist, only take the ttl if onlyTtl
+	add := func(rr dns.RR, onlyTtl bool) {
+		key := strings.ToLower(rr.Header().Name) + "\t" + GetQuestionRR(rr)
+		if exist, ok := index[key]; ok {
+			exist.Header().Ttl = min(exist.Header().Ttl, rr.Header().Ttl)
+			return
+		}
+		if onlyTtl {
+			return
+		}
+		index[key] = rr
+		answer = append(answer, rr)
 	}
-	return m
+	for _, rr := range base.Answer {
+		add(rr, false)
+	}
+	for _, msg := range rest {
+		if msg.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		name := GetCnameTarget(msg.Answer, question.Name)
+		for _, rr := range msg.Answer {
+			switch {
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				// keep the cname chain of base
+				add(rr, true)
+			case strings.EqualFold(rr.Header().Name, name):
+				rr = dns.Copy(rr)
+				rr.Header().Name = baseName
+				add(rr, false)
+			}
+		}
+	}
+	base.Answer = answer
+	return base
+}
+
+// follow the cname chain from name in answer, return the final name
+func GetCnameTarget(answer []dns.RR, name string) string {
+	// at most len(answer) hops, avoid cname loop
+	for range answer {
+		found := false
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				name, found = cname.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
 }
 
 // check ip type for dns.RR
@@ -79,6 +177,17 @@ func IsIpsRR(rr dns.RR) bool {
 	return false
 }
 
+// get ip of A or AAAA rr, empty if not ip rr
+func GetIp(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return ""
+}
+
 // filter all ip rr
 func FilterIpRR(data []dns.RR) (ipRRs, other []dns.RR) {
 	ipRRs = make([]dns.RR, 0, len(data))
@@ -115,7 +224,7 @@ func RewriteMsgTTL(msg *dns.Msg, ttl uint32) *dns.Msg {
 	return msg
 }
 
-// get the max ttl in answer
+// get the min ttl in answer, the soa ttl in authority of an empty answer(RFC 2308)
 func GetAnswerTTL(msg *dns.Msg) uint32 {
 	ttl := uint32(math.MaxUint32)
 	for _, rr := range msg.Answer {
@@ -123,5 +232,31 @@ func GetAnswerTTL(msg *dns.Msg) uint32 {
 			ttl = rr.Header().Ttl
 		}
 	}
+	if len(msg.Answer) > 0 {
+		return ttl
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(ttl, soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
 	return ttl
 }
+
+// empty answer reply of the request with an soa in authority
+func EmptyReply(r *dns.Msg, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.RecursionAvailable = true
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "a.gtld-servers.net.",
+		Mbox:    "nstld.verisign-grs.com.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}}
+	return resp
+}
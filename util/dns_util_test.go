@@ -0,0 +1,122 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestMsg(rcode int, rrs ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Response = true
+	m.Rcode = rcode
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestMergeAllAnswer(t *testing.T) {
+	Convey("TestMergeAllAnswer", t, func() {
+		cases := []struct {
+			name  string
+			msgs  []*dns.Msg
+			want  []string
+			rcode int
+		}{
+			{
+				name: "single",
+				msgs: []*dns.Msg{newTestMsg(dns.RcodeSuccess, "www.example.com. 60 IN A 1.1.1.1")},
+				want: []string{"www.example.com.\t60\tIN\tA\t1.1.1.1"},
+			},
+			{
+				name: "dedupe with min ttl",
+				msgs: []*dns.Msg{
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 60 IN A 1.1.1.1", "www.example.com. 60 IN A 2.2.2.2"),
+					newTestMsg(dns.RcodeSuccess, "WWW.example.com. 30 IN A 1.1.1.1", "www.example.com. 60 IN A 3.3.3.3"),
+				},
+				want: []string{
+					"www.example.com.\t30\tIN\tA\t1.1.1.1",
+					"www.example.com.\t60\tIN\tA\t2.2.2.2",
+					"www.example.com.\t60\tIN\tA\t3.3.3.3",
+				},
+			},
+			{
+				name: "same cname chain",
+				msgs: []*dns.Msg{
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 300 IN CNAME a.cdn.net.", "a.cdn.net. 60 IN A 1.1.1.1"),
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 100 IN CNAME a.cdn.net.", "a.cdn.net. 60 IN A 2.2.2.2"),
+				},
+				want: []string{
+					"www.example.com.\t100\tIN\tCNAME\ta.cdn.net.",
+					"a.cdn.net.\t60\tIN\tA\t1.1.1.1",
+					"a.cdn.net.\t60\tIN\tA\t2.2.2.2",
+				},
+			},
+			{
+				name: "different cname chains",
+				msgs: []*dns.Msg{
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 300 IN CNAME a.cdn.net.", "a.cdn.net. 60 IN A 1.1.1.1"),
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 300 IN CNAME b.cdn.net.", "b.cdn.net. 300 IN CNAME c.cdn.net.",
+						"c.cdn.net. 30 IN A 2.2.2.2", "c.cdn.net. 30 IN A 1.1.1.1"),
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 60 IN A 3.3.3.3"),
+				},
+				want: []string{
+					"www.example.com.\t300\tIN\tCNAME\ta.cdn.net.",
+					"a.cdn.net.\t30\tIN\tA\t1.1.1.1",
+					"a.cdn.net.\t30\tIN\tA\t2.2.2.2",
+					"a.cdn.net.\t60\tIN\tA\t3.3.3.3",
+				},
+			},
+			{
+				name: "first failed",
+				msgs: []*dns.Msg{
+					newTestMsg(dns.RcodeServerFailure),
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 60 IN A 1.1.1.1"),
+					newTestMsg(dns.RcodeSuccess, "www.example.com. 60 IN A 2.2.2.2"),
+				},
+				want: []string{
+					"www.example.com.\t60\tIN\tA\t1.1.1.1",
+					"www.example.com.\t60\tIN\tA\t2.2.2.2",
+				},
+			},
+			{
+				name: "all empty",
+				msgs: []*dns.Msg{
+					newTestMsg(dns.RcodeNameError),
+					newTestMsg(dns.RcodeSuccess),
+				},
+				want:  []string{},
+				rcode: dns.RcodeNameError,
+			},
+		}
+		for _, c := range cases {
+			Convey(c.name, func() {
+				merged := MergeAllAnswer(c.msgs[0], c.msgs[1:]...)
+				answers := make([]string, 0, len(merged.Answer))
+				for _, rr := range merged.Answer {
+					answers = append(answers, rr.String())
+				}
+				So(answers, ShouldResemble, c.want)
+				So(merged.Rcode, ShouldEqual, c.rcode)
+			})
+		}
+	})
+}
+
+func TestGetCnameTarget(t *testing.T) {
+	Convey("TestGetCnameTarget", t, func() {
+		m := newTestMsg(dns.RcodeSuccess, "a.cdn.net. 60 IN CNAME b.cdn.net.", "www.example.com. 60 IN CNAME a.cdn.net.")
+		So(GetCnameTarget(m.Answer, "www.example.com."), ShouldEqual, "b.cdn.net.")
+		So(GetCnameTarget(m.Answer, "other.com."), ShouldEqual, "other.com.")
+		// loop
+		m = newTestMsg(dns.RcodeSuccess, "a.com. 60 IN CNAME b.com.", "b.com. 60 IN CNAME a.com.")
+		So(GetCnameTarget(m.Answer, "a.com."), ShouldEqual, "a.com.")
+	})
+}
@@ -0,0 +1,179 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	FULL_PREFIX    = "full:"
+	DOMAIN_PREFIX  = "domain:"
+	KEYWORD_PREFIX = "keyword:"
+	REGEXP_PREFIX  = "regexp:"
+	GEOSITE_PREFIX = "geosite:"
+	WILDCARD       = "*."
+)
+
+// match a query name
+type Matcher interface {
+	Match(name string) bool
+	String() string
+}
+
+// compile a domain pattern:
+//
+//	a.com or domain:a.com   a.com and its subdomains
+//	full:a.com              only a.com
+//	*.a.com                 only the subdomains of a.com
+//	keyword:abc             names contain abc
+//	regexp:^a[0-9]\.com$    names match the regexp
+func Compile(pattern string) (Matcher, error) {
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case strings.HasPrefix(pattern, GEOSITE_PREFIX):
+		return nil, fmt.Errorf("pattern:%s geosite is not supported", pattern)
+	case strings.HasPrefix(pattern, FULL_PREFIX):
+		name, err := normalizeName(pattern, strings.TrimPrefix(pattern, FULL_PREFIX))
+		return &fullMatcher{name: name}, err
+	case strings.HasPrefix(pattern, KEYWORD_PREFIX):
+		keyword := strings.ToLower(strings.TrimPrefix(pattern, KEYWORD_PREFIX))
+		if len(keyword) == 0 {
+			return nil, fmt.Errorf("pattern:%s keyword is empty", pattern)
+		}
+		return &keywordMatcher{keyword: keyword}, nil
+	case strings.HasPrefix(pattern, REGEXP_PREFIX):
+		expr := strings.TrimPrefix(pattern, REGEXP_PREFIX)
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("pattern:%s error:%v", pattern, err)
+		}
+		return &regexpMatcher{expr: expr, re: re}, nil
+	case strings.HasPrefix(pattern, WILDCARD):
+		name, err := normalizeName(pattern, strings.TrimPrefix(pattern, WILDCARD))
+		return &suffixMatcher{name: name, subdomainOnly: true}, err
+	default:
+		name, err := normalizeName(pattern, strings.TrimPrefix(pattern, DOMAIN_PREFIX))
+		return &suffixMatcher{name: name}, err
+	}
+}
+
+// lower fqdn of the name
+func normalizeName(pattern, name string) (string, error) {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if len(name) == 0 {
+		// root matches all names
+		if strings.HasPrefix(pattern, DOMAIN_PREFIX) || pattern == "." {
+			return ".", nil
+		}
+		return "", fmt.Errorf("pattern:%s domain is empty", pattern)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.ContainsAny(label, " */\\:") {
+			return "", fmt.Errorf("pattern:%s domain is illegal", pattern)
+		}
+	}
+	return name + ".", nil
+}
+
+func lowerFqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+type fullMatcher struct {
+	name string
+}
+
+func (m *fullMatcher) Match(name string) bool {
+	return lowerFqdn(name) == m.name
+}
+
+func (m *fullMatcher) String() string {
+	return FULL_PREFIX + m.name
+}
+
+type suffixMatcher struct {
+	name          string
+	subdomainOnly bool
+}
+
+func (m *suffixMatcher) Match(name string) bool {
+	name = lowerFqdn(name)
+	if m.name == "." {
+		return !m.subdomainOnly || name != "."
+	}
+	if name == m.name {
+		return !m.subdomainOnly
+	}
+	return strings.HasSuffix(name, "."+m.name)
+}
+
+func (m *suffixMatcher) String() string {
+	if m.subdomainOnly {
+		return WILDCARD + m.name
+	}
+	return DOMAIN_PREFIX + m.name
+}
+
+type keywordMatcher struct {
+	keyword string
+}
+
+func (m *keywordMatcher) Match(name string) bool {
+	return strings.Contains(strings.ToLower(name), m.keyword)
+}
+
+func (m *keywordMatcher) String() string {
+	return KEYWORD_PREFIX + m.keyword
+}
+
+type regexpMatcher struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+// match the name without the trailing dot
+func (m *regexpMatcher) Match(name string) bool {
+	return m.re.MatchString(strings.TrimSuffix(name, "."))
+}
+
+func (m *regexpMatcher) String() string {
+	return REGEXP_PREFIX + m.expr
+}
+
+// check if a matches all the names matched by b, false if unknown
+func Covers(a, b Matcher) bool {
+	switch ma := a.(type) {
+	case *fullMatcher:
+		mb, ok := b.(*fullMatcher)
+		return ok && ma.name == mb.name
+	case *suffixMatcher:
+		if ma.name == "." && !ma.subdomainOnly {
+			return true
+		}
+		switch mb := b.(type) {
+		case *fullMatcher:
+			return ma.Match(mb.name)
+		case *suffixMatcher:
+			// the subdomains of a matched name are matched too
+			return ma.Match(mb.name) || (mb.subdomainOnly && ma.name == mb.name)
+		}
+	case *keywordMatcher:
+		switch mb := b.(type) {
+		case *fullMatcher:
+			return ma.Match(mb.name)
+		case *suffixMatcher:
+			return strings.Contains(mb.name, ma.keyword)
+		case *keywordMatcher:
+			return strings.Contains(mb.keyword, ma.keyword)
+		}
+	case *regexpMatcher:
+		mb, ok := b.(*fullMatcher)
+		return ok && ma.Match(mb.name)
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompile(t *testing.T) {
+	Convey("TestCompile", t, func() {
+		cases := []struct {
+			pattern string
+			match   []string
+			miss    []string
+		}{
+			{pattern: "a.com", match: []string{"a.com.", "A.com", "b.a.com."}, miss: []string{"ba.com.", "com."}},
+			{pattern: "domain:a.com", match: []string{"a.com.", "b.a.com."}, miss: []string{"a.com.cn."}},
+			{pattern: "full:a.com", match: []string{"a.com."}, miss: []string{"b.a.com."}},
+			{pattern: "*.a.com", match: []string{"b.a.com.", "c.b.a.com."}, miss: []string{"a.com."}},
+			{pattern: "keyword:ads", match: []string{"ads.a.com.", "myADS.com."}, miss: []string{"a.com."}},
+			{pattern: `regexp:^a[0-9]\.com$`, match: []string{"a1.com.", "A2.com"}, miss: []string{"a.com.", "b.a1.com."}},
+			{pattern: ".", match: []string{"a.com.", "."}},
+		}
+		for _, c := range cases {
+			m, err := Compile(c.pattern)
+			So(err, ShouldBeNil)
+			for _, name := range c.match {
+				So(m.Match(name), ShouldBeTrue)
+			}
+			for _, name := range c.miss {
+				So(m.Match(name), ShouldBeFalse)
+			}
+		}
+
+		for _, pattern := range []string{"", "full:", "a..com", "keyword:", "regexp:(", "geosite:cn", "a/b.com"} {
+			_, err := Compile(pattern)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestCovers(t *testing.T) {
+	Convey("TestCovers", t, func() {
+		cases := []struct {
+			a, b   string
+			covers bool
+		}{
+			{a: "a.com", b: "full:b.a.com", covers: true},
+			{a: "a.com", b: "*.a.com", covers: true},
+			{a: "a.com", b: "b.a.com", covers: true},
+			{a: "*.a.com", b: "a.com", covers: false},
+			{a: "*.a.com", b: "*.a.com", covers: true},
+			{a: "b.a.com", b: "a.com", covers: false},
+			{a: "keyword:ads", b: "ads.com", covers: true},
+			{a: "keyword:ads", b: "keyword:myads", covers: true},
+			{a: "domain:.", b: "keyword:ads", covers: true},
+			{a: `regexp:^a\.com$`, b: "full:a.com", covers: true},
+			{a: `regexp:a\.com$`, b: "a.com", covers: false},
+			{a: "full:a.com", b: "a.com", covers: false},
+		}
+		for _, c := range cases {
+			a, err := Compile(c.a)
+			So(err, ShouldBeNil)
+			b, err := Compile(c.b)
+			So(err, ShouldBeNil)
+			So(Covers(a, b), ShouldEqual, c.covers)
+		}
+	})
+}
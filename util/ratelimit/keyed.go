@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	// max keys tracked, the least recently used one is evicted, eg: spoofed udp sources
+	KEYED_LIMITER_MAX_KEYS = 65536
+)
+
+// token bucket rate limiter of each key, such as client ip
+type KeyedLimiter[K comparable] struct {
+	rate     float64
+	burst    int
+	limiters *lru.Cache[K, *keyedEntry]
+}
+
+type keyedEntry struct {
+	limiter *Limiter
+	// times over the limit
+	over atomic.Int64
+}
+
+func NewKeyedLimiter[K comparable](rate float64, burst int) *KeyedLimiter[K] {
+	return newKeyedLimiter[K](rate, burst, KEYED_LIMITER_MAX_KEYS)
+}
+
+func newKeyedLimiter[K comparable](rate float64, burst int, maxKeys int) *KeyedLimiter[K] {
+	// only error if size is not positive
+	limiters, _ := lru.New[K, *keyedEntry](maxKeys)
+	return &KeyedLimiter[K]{rate: rate, burst: burst, limiters: limiters}
+}
+
+// take a token of the key if available
+func (l *KeyedLimiter[K]) Allow(key K) bool {
+	allowed, _ := l.TakeAt(key, time.Now())
+	return allowed
+}
+
+func (l *KeyedLimiter[K]) AllowAt(key K, now time.Time) bool {
+	allowed, _ := l.TakeAt(key, now)
+	return allowed
+}
+
+// take a token of the key, over is the times the key is over the limit including this one if not allowed
+func (l *KeyedLimiter[K]) Take(key K) (allowed bool, over int64) {
+	return l.TakeAt(key, time.Now())
+}
+
+func (l *KeyedLimiter[K]) TakeAt(key K, now time.Time) (bool, int64) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	entry, ok := l.limiters.Get(key)
+	if !ok {
+		entry = &keyedEntry{limiter: NewLimiter(l.rate, l.burst)}
+		entry.limiter.last = now
+		// keep the one added by others
+		if prev, ok, _ := l.limiters.PeekOrAdd(key, entry); ok {
+			entry = prev
+		}
+	}
+	if entry.limiter.AllowAt(now) {
+		return true, 0
+	}
+	return false, entry.over.Add(1)
+}
+
+// number of the keys tracked
+func (l *KeyedLimiter[K]) Len() int {
+	return l.limiters.Len()
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	Convey("TestKeyedLimiter", t, func() {
+		l := NewKeyedLimiter[string](1, 2)
+		now := time.Now()
+		So(l.AllowAt("a", now), ShouldBeTrue)
+		So(l.AllowAt("a", now), ShouldBeTrue)
+		So(l.AllowAt("a", now), ShouldBeFalse)
+		// other keys have their own bucket
+		So(l.AllowAt("b", now), ShouldBeTrue)
+		So(l.AllowAt("a", now.Add(time.Second)), ShouldBeTrue)
+
+		So(NewKeyedLimiter[string](0, 1).AllowAt("a", now), ShouldBeTrue)
+
+		// count the times over the limit of the key
+		allowed, over := l.TakeAt("b", now)
+		So(allowed, ShouldBeTrue)
+		So(over, ShouldEqual, 0)
+		_, over = l.TakeAt("b", now)
+		So(over, ShouldEqual, 1)
+		_, over = l.TakeAt("b", now)
+		So(over, ShouldEqual, 2)
+	})
+
+	Convey("the keys are bounded", t, func() {
+		l := newKeyedLimiter[int](1, 1, 100)
+		now := time.Now()
+		So(l.AllowAt(0, now), ShouldBeTrue)
+		for i := 1; i <= 1000; i++ {
+			l.AllowAt(i, now)
+		}
+		So(l.Len(), ShouldEqual, 100)
+		// the least recently used key is evicted with its bucket
+		So(l.AllowAt(0, now), ShouldBeTrue)
+		So(l.AllowAt(1000, now), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket rate limiter
+type Limiter struct {
+	sync.Mutex
+	// tokens per second, no limit if rate <= 0
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take a token if available
+func (l *Limiter) Allow() bool {
+	return l.AllowAt(time.Now())
+}
+
+func (l *Limiter) AllowAt(now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// refill tokens by elapsed time, must hold lock
+func (l *Limiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+}
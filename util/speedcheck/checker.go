@@ -0,0 +1,57 @@
+package speedcheck
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+// probe the latency of an ip
+type SpeedChecker interface {
+	// check once and return the round trip time
+	Check(ctx context.Context, target *Target) (rtMs int64, err error)
+}
+
+type Target struct {
+	Ip string
+	// queried host, used as SNI or http Host
+	Host string
+	Cfg  *config.SpeedCheckConfig
+}
+
+// timeout of one check
+func (t *Target) Timeout() time.Duration {
+	timeoutMs := config.DEFAULT_SPEED_CHECK_TIMEOUT_MS
+	if t.Cfg.TimeoutMs != nil && *t.Cfg.TimeoutMs > 0 {
+		timeoutMs = *t.Cfg.TimeoutMs
+	}
+	return time.Duration(timeoutMs) * time.Millisecond
+}
+
+// ip:port of target
+func (t *Target) Address() string {
+	return net.JoinHostPort(t.Ip, strconv.FormatInt(t.Cfg.Port, 10))
+}
+
+var (
+	checkersLock sync.RWMutex
+	checkers     = make(map[config.SpeedCheckType]SpeedChecker)
+)
+
+// register checker of the speed check type, the exists one will be replaced
+func Register(speedCheckType config.SpeedCheckType, checker SpeedChecker) {
+	checkersLock.Lock()
+	defer checkersLock.Unlock()
+	checkers[speedCheckType] = checker
+}
+
+func GetChecker(speedCheckType config.SpeedCheckType) (SpeedChecker, bool) {
+	checkersLock.RLock()
+	defer checkersLock.RUnlock()
+	checker, ok := checkers[speedCheckType]
+	return checker, ok
+}
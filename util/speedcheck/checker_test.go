@@ -0,0 +1,148 @@
+package speedcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func newTestTarget(speedCheckType config.SpeedCheckType, address string) *Target {
+	host, port, _ := net.SplitHostPort(address)
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return &Target{Ip: host, Host: "www.example.com", Cfg: &config.SpeedCheckConfig{SpeedCheckType: speedCheckType, Port: p}}
+}
+
+func check(target *Target) (int64, error) {
+	checker, ok := GetChecker(target.Cfg.SpeedCheckType)
+	So(ok, ShouldBeTrue)
+	return checker.Check(context.Background(), target)
+}
+
+func TestCheckers(t *testing.T) {
+	Convey("TestTcpChecker", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		_, err = check(newTestTarget(config.TCP_SPEED_CHECK_TYPE, l.Addr().String()))
+		So(err, ShouldBeNil)
+
+		l.Close()
+		_, err = check(newTestTarget(config.TCP_SPEED_CHECK_TYPE, l.Addr().String()))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("TestHttpChecker", t, func() {
+		hosts := make(chan string, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hosts <- r.Host
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer srv.Close()
+		target := newTestTarget(config.HTTP_SPEED_CHECK_TYPE, srv.Listener.Addr().String())
+		target.Cfg.Path = "/health"
+		target.Cfg.ExpectedStatus = []int{http.StatusOK}
+		_, err := check(target)
+		So(err, ShouldBeNil)
+		So(<-hosts, ShouldEqual, "www.example.com:"+strconv.FormatInt(target.Cfg.Port, 10))
+
+		target.Cfg.Path = "/"
+		_, err = check(target)
+		So(err, ShouldNotBeNil)
+		<-hosts
+
+		target.Cfg.Measure = config.CONNECT_HTTP_MEASURE
+		target.Cfg.ExpectedStatus = nil
+		_, err = check(target)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("TestHttpsChecker", t, func() {
+		sni := make(chan string, 1)
+		requests := make(chan *http.Request, 1)
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}))
+		srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		}}
+		srv.StartTLS()
+		defer srv.Close()
+		dialed := make(chan string, 1)
+		// the checked ip:443 is served by the test server
+		checker := &httpChecker{dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed <- address
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		}}
+		target := &Target{Ip: "192.0.2.1", Host: "www.example.com", Cfg: &config.SpeedCheckConfig{SpeedCheckType: config.HTTP_SPEED_CHECK_TYPE, Port: 443}}
+		_, err := checker.Check(context.Background(), target)
+		So(err, ShouldBeNil)
+		So(<-dialed, ShouldEqual, "192.0.2.1:443")
+		So(<-sni, ShouldEqual, "www.example.com")
+		r := <-requests
+		So(r.TLS, ShouldNotBeNil)
+		So(r.Host, ShouldEqual, "www.example.com")
+
+		// no sni for the ip
+		target.Host = ""
+		_, err = checker.Check(context.Background(), target)
+		So(err, ShouldBeNil)
+		<-dialed
+		So(<-sni, ShouldBeEmpty)
+		So((<-requests).Host, ShouldEqual, "192.0.2.1")
+	})
+
+	Convey("TestTlsChecker", t, func() {
+		sni := make(chan string, 1)
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		}}
+		srv.StartTLS()
+		defer srv.Close()
+		_, err := check(newTestTarget(config.TLS_SPEED_CHECK_TYPE, srv.Listener.Addr().String()))
+		So(err, ShouldBeNil)
+		So(<-sni, ShouldEqual, "www.example.com")
+	})
+
+	Convey("TestQuicChecker", t, func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 1500)
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil || n < QUIC_MIN_INITIAL_SIZE {
+				return
+			}
+			// version negotiation: swap connection ids and list supported version 1
+			vn := []byte{0x80, 0, 0, 0, 0, QUIC_CID_LEN}
+			vn = append(vn, buf[7+QUIC_CID_LEN:7+2*QUIC_CID_LEN]...)
+			vn = append(vn, QUIC_CID_LEN)
+			vn = append(vn, buf[6:6+QUIC_CID_LEN]...)
+			vn = append(vn, 0, 0, 0, 1)
+			conn.WriteTo(vn, addr)
+		}()
+		_, err = check(newTestTarget(config.UDP_SPEED_CHECK_TYPE, conn.LocalAddr().String()))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("TestIcmpChecker", t, func() {
+		_, err := check(&Target{Ip: "127.0.0.1", Cfg: &config.SpeedCheckConfig{SpeedCheckType: config.ICMP_SPEED_CHECK_TYPE}})
+		if err != nil {
+			// ping socket is not allowed by net.ipv4.ping_group_range
+			t.Skipf("icmp datagram socket unavailable: %v", err)
+		}
+		So(err, ShouldBeNil)
+	})
+}
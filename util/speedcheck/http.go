@@ -0,0 +1,118 @@
+package speedcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func init() {
+	Register(config.HTTP_SPEED_CHECK_TYPE, &httpChecker{})
+}
+
+// request the queried host(as Host and SNI) on the ip, use https when port is 443
+type httpChecker struct {
+	// dial the checked address, nil for the net dialer
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (c *httpChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := target.Address()
+	dial := c.dial
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: -1 * time.Second,
+		}).DialContext
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			// always connect to the checked ip
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dial(ctx, network, address)
+			},
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          1,
+			IdleConnTimeout:       timeout,
+			TLSHandshakeTimeout:   timeout,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives:     true,
+		},
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// start time
+	start := time.Now()
+	var connected, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			connected = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, httpCheckUrl(target), nil)
+	if err != nil {
+		return 0, fmt.Errorf("httping create request:%s error:%v", address, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("httping connection:%s host:%s error:%v", address, target.Host, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+		if len(target.Cfg.ExpectedStatus) > 0 && !slices.Contains(target.Cfg.ExpectedStatus, resp.StatusCode) {
+			return 0, fmt.Errorf("httping:%s host:%s unexpected status:%d", address, target.Host, resp.StatusCode)
+		}
+	}
+
+	switch {
+	case target.Cfg.Measure == config.CONNECT_HTTP_MEASURE && !connected.IsZero():
+		return connected.Sub(start).Milliseconds(), nil
+	case target.Cfg.Measure != config.CONNECT_HTTP_MEASURE && !firstByte.IsZero():
+		return firstByte.Sub(start).Milliseconds(), nil
+	}
+	return time.Since(start).Milliseconds(), nil
+}
+
+// the url with the queried host, host is the ip if unknown
+func httpCheckUrl(target *Target) string {
+	scheme := "http"
+	if target.Cfg.Port == config.HTTPS_SPEED_CHECK_PORT {
+		scheme = "https"
+	}
+	host := target.Host
+	if len(host) == 0 {
+		host = target.Ip
+	}
+	u := &url.URL{Scheme: scheme, Host: net.JoinHostPort(host, strconv.FormatInt(target.Cfg.Port, 10)), Path: target.Cfg.Path}
+	// omit default port in Host header
+	if (scheme == "http" && target.Cfg.Port == 80) || scheme == "https" {
+		u.Host = strings.TrimSuffix(u.Host, ":"+strconv.FormatInt(target.Cfg.Port, 10))
+	}
+	if len(target.Cfg.Path) == 0 {
+		u.Path = config.DEFAULT_HTTP_SPEED_CHECK_PATH
+	}
+	return u.String()
+}
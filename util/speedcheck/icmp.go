@@ -0,0 +1,86 @@
+package speedcheck
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ICMP_PROTOCOL_IPV4 = 1
+	ICMP_PROTOCOL_IPV6 = 58
+)
+
+func init() {
+	Register(config.ICMP_SPEED_CHECK_TYPE, &icmpChecker{})
+}
+
+// ICMP echo by unprivileged datagram socket, allowed by net.ipv4.ping_group_range on linux
+type icmpChecker struct {
+}
+
+func (c *icmpChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ip := net.ParseIP(target.Ip)
+	if ip == nil {
+		return 0, fmt.Errorf("icmp illegal ip:%s", target.Ip)
+	}
+	network, address, protocol := "udp4", "0.0.0.0", ICMP_PROTOCOL_IPV4
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, address, protocol = "udp6", "::", ICMP_PROTOCOL_IPV6
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return 0, fmt.Errorf("icmp listen %s error:%v", network, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	// the kernel rewrites echo id to the local port of datagram socket, match reply by seq
+	seq := rand.Intn(1 << 16)
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("xsmartdns")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(b, &net.UDPAddr{IP: ip}); err != nil {
+		return 0, fmt.Errorf("icmp write:%s error:%v", target.Ip, err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("icmp read:%s error:%v", target.Ip, err)
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return time.Since(start).Milliseconds(), nil
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package speedcheck
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/util/timeutil"
+)
+
+const (
+	CLEAR_EXPIRED_LATENCY_INTERVAL = time.Minute
+)
+
+// ip latency cache shared by groups, many hostnames share the same cdn ips
+var latencies = newLatencyTable(config.DEFAULT_LATENCY_CACHE_TTL_SECOND, config.DEFAULT_LATENCY_EWMA_ALPHA)
+
+type latencyTable struct {
+	sync.RWMutex
+	// 0 disable the cache
+	ttlSecond int64
+	alpha     float64
+	items     map[latencyKey]*latencyItem
+	clearOnce sync.Once
+}
+
+// the latency of different check types and ports are not comparable
+type latencyKey struct {
+	ip        string
+	checkType config.SpeedCheckType
+	port      int64
+}
+
+func newLatencyKey(ip string, check *config.SpeedCheckConfig) latencyKey {
+	return latencyKey{ip: ip, checkType: check.SpeedCheckType, port: check.Port}
+}
+
+type latencyItem struct {
+	// EWMA smoothed latency
+	rtMs             float64
+	updateTimeSecond int64
+}
+
+func newLatencyTable(ttlSecond int64, alpha float64) *latencyTable {
+	return &latencyTable{ttlSecond: ttlSecond, alpha: alpha, items: make(map[latencyKey]*latencyItem)}
+}
+
+// init speed check setting shared by groups
+func Init(cfg *config.SpeedCheck) {
+	latencies.Lock()
+	latencies.ttlSecond = *cfg.LatencyCacheTtlSecond
+	latencies.alpha = *cfg.LatencyEwmaAlpha
+	latencies.Unlock()
+	initScheduler(cfg)
+}
+
+// get cached latency of ip by the first cached check in order
+func GetLatency(ip string, checks config.SpeedChecks) (rtMs int64, ok bool) {
+	now := timeutil.NowSecond()
+	for _, check := range checks {
+		if rtMs, ok := latencies.get(newLatencyKey(ip, check), now); ok {
+			return rtMs, true
+		}
+	}
+	return 0, false
+}
+
+// feed a succeed speed check result to the latency cache
+func FeedLatency(ip string, check *config.SpeedCheckConfig, rtMs int64) {
+	latencies.feed(newLatencyKey(ip, check), rtMs, timeutil.NowSecond())
+	latencies.clearOnce.Do(func() {
+		go latencies.clearExpiredLoop()
+	})
+}
+
+func (t *latencyTable) get(key latencyKey, now int64) (int64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	item, ok := t.items[key]
+	if !ok || t.expired(item, now) {
+		return 0, false
+	}
+	return int64(item.rtMs + 0.5), true
+}
+
+func (t *latencyTable) feed(key latencyKey, rtMs int64, now int64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.ttlSecond <= 0 {
+		return
+	}
+	item, ok := t.items[key]
+	if !ok || t.expired(item, now) {
+		t.items[key] = &latencyItem{rtMs: float64(rtMs), updateTimeSecond: now}
+		return
+	}
+	item.rtMs = t.alpha*float64(rtMs) + (1-t.alpha)*item.rtMs
+	item.updateTimeSecond = now
+}
+
+// must hold lock
+func (t *latencyTable) expired(item *latencyItem, now int64) bool {
+	return now-item.updateTimeSecond > t.ttlSecond
+}
+
+func (t *latencyTable) clearExpiredLoop() {
+	for range time.Tick(CLEAR_EXPIRED_LATENCY_INTERVAL) {
+		t.clearExpired(timeutil.NowSecond())
+	}
+}
+
+func (t *latencyTable) clearExpired(now int64) {
+	t.Lock()
+	defer t.Unlock()
+	for key, item := range t.items {
+		if t.expired(item, now) {
+			delete(t.items, key)
+		}
+	}
+}
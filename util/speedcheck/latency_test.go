@@ -0,0 +1,89 @@
+package speedcheck
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// block the checks until released
+type blockChecker struct {
+	checked int32
+	release chan struct{}
+}
+
+func (c *blockChecker) Check(ctx context.Context, target *Target) (int64, error) {
+	atomic.AddInt32(&c.checked, 1)
+	<-c.release
+	return 5, nil
+}
+
+func TestLatencyTable(t *testing.T) {
+	Convey("TestLatencyTable", t, func() {
+		table := newLatencyTable(10, 0.5)
+		key := newLatencyKey("1.1.1.1", &config.SpeedCheckConfig{SpeedCheckType: config.TCP_SPEED_CHECK_TYPE, Port: 443})
+		_, ok := table.get(key, 100)
+		So(ok, ShouldBeFalse)
+
+		table.feed(key, 100, 100)
+		rtMs, ok := table.get(key, 105)
+		So(ok, ShouldBeTrue)
+		So(rtMs, ShouldEqual, 100)
+
+		// smoothed
+		table.feed(key, 20, 105)
+		rtMs, _ = table.get(key, 105)
+		So(rtMs, ShouldEqual, 60)
+
+		// expired
+		_, ok = table.get(key, 116)
+		So(ok, ShouldBeFalse)
+		table.feed(key, 20, 116)
+		rtMs, _ = table.get(key, 116)
+		So(rtMs, ShouldEqual, 20)
+
+		// not the same check
+		_, ok = table.get(newLatencyKey("1.1.1.1", &config.SpeedCheckConfig{SpeedCheckType: config.TCP_SPEED_CHECK_TYPE, Port: 80}), 116)
+		So(ok, ShouldBeFalse)
+
+		table.clearExpired(200)
+		So(len(table.items), ShouldEqual, 0)
+
+		// disabled
+		table = newLatencyTable(0, 0.5)
+		table.feed(key, 100, 100)
+		_, ok = table.get(key, 100)
+		So(ok, ShouldBeFalse)
+	})
+	Convey("TestSpeedCheckAsync", t, func() {
+		checker := &blockChecker{release: make(chan struct{})}
+		Register("block", checker)
+		cfg := &config.Group{SpeedChecks: config.SpeedChecks{{SpeedCheckType: "block", Port: 1}}}
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		rr, _ := dns.NewRR("example.com. 60 IN A 10.1.1.1")
+
+		SpeedCheckAsync(model.WrapDnsMsg(r), rr, cfg)
+		for atomic.LoadInt32(&checker.checked) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// deduplicated while probing
+		SpeedCheckAsync(model.WrapDnsMsg(r), rr, cfg)
+		close(checker.release)
+		for {
+			if _, ok := GetLatency("10.1.1.1", cfg.SpeedChecks); ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		So(atomic.LoadInt32(&checker.checked), ShouldEqual, 1)
+		rtMs, _ := GetLatency("10.1.1.1", cfg.SpeedChecks)
+		So(rtMs, ShouldEqual, 5)
+	})
+}
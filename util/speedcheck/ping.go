@@ -0,0 +1,39 @@
+package speedcheck
+
+import (
+	"context"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func init() {
+	Register(config.PING_SPEED_CHECK_TYPE, &pingChecker{})
+}
+
+type pingChecker struct {
+}
+
+func (c *pingChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pinger, err := probing.NewPinger(target.Ip)
+	if err != nil {
+		return 0, err
+	}
+	defer pinger.Stop()
+	go func() {
+		<-ctx.Done()
+		pinger.Stop()
+	}()
+	pinger.Count = 1
+	err = pinger.RunWithContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	stats := pinger.Statistics()
+
+	return stats.MaxRtt.Milliseconds(), nil
+}
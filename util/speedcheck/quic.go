@@ -0,0 +1,99 @@
+package speedcheck
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+const (
+	// client initial datagram must be padded to at least 1200 bytes(RFC 9000 section 14.1)
+	QUIC_MIN_INITIAL_SIZE = 1200
+	// reserved version to force version negotiation(RFC 9000 section 15)
+	QUIC_PROBE_VERSION = uint32(0x1a2a3a4a)
+	QUIC_CID_LEN       = 8
+)
+
+func init() {
+	Register(config.UDP_SPEED_CHECK_TYPE, &quicVersionNegotiationChecker{})
+}
+
+// rt of QUIC(HTTP3) version negotiation, not a handshake: an initial packet with a reserved version
+// is answered by a version negotiation packet in one round trip without any crypto work of the server
+type quicVersionNegotiationChecker struct {
+}
+
+func (c *quicVersionNegotiationChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := target.Address()
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return 0, fmt.Errorf("quic version negotiation dial:%s error:%v", address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+
+	packet, err := newQuicProbePacket()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, fmt.Errorf("quic version negotiation write:%s error:%v", address, err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, fmt.Errorf("quic version negotiation read:%s error:%v", address, err)
+		}
+		if isQuicVersionNegotiation(buf[:n], packet) {
+			return time.Since(start).Milliseconds(), nil
+		}
+	}
+}
+
+// long header initial packet with the reserved version: flags | version | dcid len | dcid | scid len | scid | padding
+func newQuicProbePacket() ([]byte, error) {
+	packet := make([]byte, QUIC_MIN_INITIAL_SIZE)
+	packet[0] = 0xc0
+	binary.BigEndian.PutUint32(packet[1:5], QUIC_PROBE_VERSION)
+	packet[5] = QUIC_CID_LEN
+	packet[6+QUIC_CID_LEN] = QUIC_CID_LEN
+	if _, err := rand.Read(packet[6 : 6+QUIC_CID_LEN]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(packet[7+QUIC_CID_LEN : 7+2*QUIC_CID_LEN]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// version negotiation packet echos the connection ids of the probe(RFC 9000 section 17.2.1)
+func isQuicVersionNegotiation(b, probe []byte) bool {
+	// flags | version 0 | dcid len | dcid | scid len | scid
+	if len(b) < 7+2*QUIC_CID_LEN || b[0]&0x80 == 0 || binary.BigEndian.Uint32(b[1:5]) != 0 {
+		return false
+	}
+	if b[5] != QUIC_CID_LEN || b[6+QUIC_CID_LEN] != QUIC_CID_LEN {
+		return false
+	}
+	probeDcid := probe[6 : 6+QUIC_CID_LEN]
+	probeScid := probe[7+QUIC_CID_LEN : 7+2*QUIC_CID_LEN]
+	return string(b[6:6+QUIC_CID_LEN]) == string(probeScid) && string(b[7+QUIC_CID_LEN:7+2*QUIC_CID_LEN]) == string(probeDcid)
+}
@@ -0,0 +1,213 @@
+package speedcheck
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/util/ratelimit"
+	"github.com/xsmartdns/xsmartdns/util/timeutil"
+)
+
+const (
+	// remove destination limiters idle longer than this
+	DESTINATION_LIMITER_IDLE_SECOND = int64(60)
+	// sweep idle destination limiters every this number of new destinations
+	DESTINATION_LIMITER_SWEEP_INTERVAL = 1024
+)
+
+var (
+	ErrProbeRateLimited = errors.New("speed check probe is rate limited")
+	ErrProbeDropped     = errors.New("speed check probe is dropped by full queue")
+)
+
+// global probe scheduler shared by groups
+var scheduler = newProbeScheduler(config.DEFAULT_MAX_INFLIGHT_PROBES, config.DEFAULT_MAX_QUEUED_PROBES,
+	config.DROP_NEWEST_QUEUE_DROP_POLICY, config.DEFAULT_PER_DESTINATION_RATE, config.DEFAULT_PER_DESTINATION_BURST)
+
+// stats of the probe scheduler
+type SchedulerStats struct {
+	Inflight    int64 `json:"inflight"`
+	Queued      int64 `json:"queued"`
+	Executed    int64 `json:"executed"`
+	Dropped     int64 `json:"dropped"`
+	RateLimited int64 `json:"rateLimited"`
+	Canceled    int64 `json:"canceled"`
+}
+
+// limit the in-flight probes and the probe rate to each destination
+type probeScheduler struct {
+	sync.Mutex
+	maxInflight int64
+	maxQueued   int64
+	dropOldest  bool
+	destRate    float64
+	destBurst   int
+
+	inflight     int64
+	queue        *list.List
+	destinations map[string]*destinationLimiter
+	newDestCount int
+
+	executed    int64
+	dropped     int64
+	rateLimited int64
+	canceled    int64
+}
+
+type destinationLimiter struct {
+	limiter        *ratelimit.Limiter
+	lastUsedSecond int64
+}
+
+type probeTask struct {
+	// receive nil when a slot is granted, or the drop error
+	ready chan error
+	elem  *list.Element
+}
+
+func newProbeScheduler(maxInflight, maxQueued int64, policy config.QueueDropPolicy, destRate float64, destBurst int64) *probeScheduler {
+	s := &probeScheduler{queue: list.New(), destinations: make(map[string]*destinationLimiter)}
+	s.setConfig(maxInflight, maxQueued, policy, destRate, destBurst)
+	return s
+}
+
+func (s *probeScheduler) setConfig(maxInflight, maxQueued int64, policy config.QueueDropPolicy, destRate float64, destBurst int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.maxInflight = maxInflight
+	s.maxQueued = maxQueued
+	s.dropOldest = policy == config.DROP_OLDEST_QUEUE_DROP_POLICY
+	s.destRate = destRate
+	s.destBurst = int(destBurst)
+	s.destinations = make(map[string]*destinationLimiter)
+}
+
+// init the probe scheduler setting
+func initScheduler(cfg *config.SpeedCheck) {
+	scheduler.setConfig(*cfg.MaxInflightProbes, *cfg.MaxQueuedProbes, cfg.QueueDropPolicy, *cfg.PerDestinationRate, *cfg.PerDestinationBurst)
+}
+
+// get stats of the global probe scheduler
+func GetSchedulerStats() *SchedulerStats {
+	return scheduler.stats()
+}
+
+// run probe to the destination when a slot is available
+func (s *probeScheduler) do(ctx context.Context, destination string, probe func() (int64, error)) (int64, error) {
+	if err := s.acquire(ctx, destination); err != nil {
+		return 0, err
+	}
+	defer s.release()
+	atomic.AddInt64(&s.executed, 1)
+	return probe()
+}
+
+func (s *probeScheduler) acquire(ctx context.Context, destination string) error {
+	s.Lock()
+	if !s.allowDestination(destination, timeutil.NowSecond()) {
+		s.Unlock()
+		atomic.AddInt64(&s.rateLimited, 1)
+		return ErrProbeRateLimited
+	}
+	if s.inflight < s.maxInflight {
+		s.inflight++
+		s.Unlock()
+		return nil
+	}
+	if int64(s.queue.Len()) >= s.maxQueued {
+		if !s.dropOldest || s.queue.Len() == 0 {
+			s.Unlock()
+			atomic.AddInt64(&s.dropped, 1)
+			return ErrProbeDropped
+		}
+		oldest := s.queue.Remove(s.queue.Front()).(*probeTask)
+		oldest.elem = nil
+		oldest.ready <- ErrProbeDropped
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	task := &probeTask{ready: make(chan error, 1)}
+	task.elem = s.queue.PushBack(task)
+	s.Unlock()
+
+	select {
+	case err := <-task.ready:
+		return err
+	case <-ctx.Done():
+	}
+	s.Lock()
+	if task.elem != nil {
+		// still waiting in the queue
+		s.queue.Remove(task.elem)
+		task.elem = nil
+		s.Unlock()
+		atomic.AddInt64(&s.canceled, 1)
+		return ctx.Err()
+	}
+	s.Unlock()
+	// granted or dropped at the same time
+	if err := <-task.ready; err != nil {
+		return err
+	}
+	s.release()
+	atomic.AddInt64(&s.canceled, 1)
+	return ctx.Err()
+}
+
+// give the slot to the first queued task or free it
+func (s *probeScheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	if front := s.queue.Front(); front != nil {
+		task := s.queue.Remove(front).(*probeTask)
+		task.elem = nil
+		task.ready <- nil
+		return
+	}
+	s.inflight--
+}
+
+// must hold lock
+func (s *probeScheduler) allowDestination(destination string, now int64) bool {
+	if s.destRate <= 0 {
+		return true
+	}
+	dest, ok := s.destinations[destination]
+	if !ok {
+		s.newDestCount++
+		if s.newDestCount >= DESTINATION_LIMITER_SWEEP_INTERVAL {
+			s.newDestCount = 0
+			s.sweepDestinations(now)
+		}
+		dest = &destinationLimiter{limiter: ratelimit.NewLimiter(s.destRate, s.destBurst)}
+		s.destinations[destination] = dest
+	}
+	dest.lastUsedSecond = now
+	return dest.limiter.Allow()
+}
+
+// must hold lock
+func (s *probeScheduler) sweepDestinations(now int64) {
+	for destination, dest := range s.destinations {
+		if now-dest.lastUsedSecond > DESTINATION_LIMITER_IDLE_SECOND {
+			delete(s.destinations, destination)
+		}
+	}
+}
+
+func (s *probeScheduler) stats() *SchedulerStats {
+	s.Lock()
+	inflight, queued := s.inflight, int64(s.queue.Len())
+	s.Unlock()
+	return &SchedulerStats{
+		Inflight:    inflight,
+		Queued:      queued,
+		Executed:    atomic.LoadInt64(&s.executed),
+		Dropped:     atomic.LoadInt64(&s.dropped),
+		RateLimited: atomic.LoadInt64(&s.rateLimited),
+		Canceled:    atomic.LoadInt64(&s.canceled),
+	}
+}
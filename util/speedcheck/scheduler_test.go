@@ -0,0 +1,140 @@
+package speedcheck
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xsmartdns/xsmartdns/config"
+	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/model"
+)
+
+// the logger is nil until init
+func init() {
+	log.Init(&config.Log{Level: "error"})
+}
+
+// count the checks
+type countChecker struct {
+	checked int32
+}
+
+func (c *countChecker) Check(ctx context.Context, target *Target) (int64, error) {
+	atomic.AddInt32(&c.checked, 1)
+	return 1, nil
+}
+
+func TestProbeScheduler(t *testing.T) {
+	Convey("TestProbeScheduler", t, func() {
+		probe := func() (int64, error) { return 1, nil }
+
+		Convey("rate limited per destination", func() {
+			s := newProbeScheduler(4, 4, config.DROP_NEWEST_QUEUE_DROP_POLICY, 0.001, 2)
+			_, err := s.do(context.Background(), "1.1.1.1", probe)
+			So(err, ShouldBeNil)
+			_, err = s.do(context.Background(), "1.1.1.1", probe)
+			So(err, ShouldBeNil)
+			_, err = s.do(context.Background(), "1.1.1.1", probe)
+			So(err, ShouldEqual, ErrProbeRateLimited)
+			_, err = s.do(context.Background(), "2.2.2.2", probe)
+			So(err, ShouldBeNil)
+			So(s.stats().RateLimited, ShouldEqual, 1)
+			So(s.stats().Executed, ShouldEqual, 3)
+		})
+
+		Convey("queue and drop", func() {
+			for _, policy := range []config.QueueDropPolicy{config.DROP_NEWEST_QUEUE_DROP_POLICY, config.DROP_OLDEST_QUEUE_DROP_POLICY} {
+				s := newProbeScheduler(1, 1, policy, 0, 0)
+				block := make(chan struct{})
+				started := make(chan struct{})
+				go s.do(context.Background(), "1.1.1.1", func() (int64, error) {
+					close(started)
+					<-block
+					return 1, nil
+				})
+				<-started
+
+				queued := make(chan error, 1)
+				go func() {
+					_, err := s.do(context.Background(), "1.1.1.1", probe)
+					queued <- err
+				}()
+				for s.stats().Queued != 1 {
+					time.Sleep(time.Millisecond)
+				}
+
+				newest := make(chan error, 1)
+				go func() {
+					_, err := s.do(context.Background(), "1.1.1.1", probe)
+					newest <- err
+				}()
+				if policy == config.DROP_NEWEST_QUEUE_DROP_POLICY {
+					So(<-newest, ShouldEqual, ErrProbeDropped)
+					close(block)
+					So(<-queued, ShouldBeNil)
+				} else {
+					So(<-queued, ShouldEqual, ErrProbeDropped)
+					close(block)
+					So(<-newest, ShouldBeNil)
+				}
+				So(s.stats().Dropped, ShouldEqual, 1)
+				So(s.stats().Inflight, ShouldEqual, 0)
+			}
+		})
+
+		Convey("saturated probes are unknown", func() {
+			// drop all probes
+			saturatedScheduler := newProbeScheduler(0, 0, config.DROP_NEWEST_QUEUE_DROP_POLICY, 0, 0)
+			origin := scheduler
+			scheduler = saturatedScheduler
+			defer func() { scheduler = origin }()
+			checker := &countChecker{}
+			Register("count", checker)
+			cfg := &config.Group{SpeedChecks: config.SpeedChecks{
+				{SpeedCheckType: "count", Port: 1},
+				{SpeedCheckType: "count", Port: 2},
+			}}
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			rr, _ := dns.NewRR("example.com. 60 IN A 1.1.1.1")
+			msg := model.WrapDnsMsg(r)
+			msg.Trace = model.NewTrace()
+
+			So(SpeedCheckSync(context.Background(), msg, rr, cfg), ShouldEqual, UNKNOWN_RT_MS)
+			// the next check type is not tried
+			time.Sleep(2 * SPEED_CHECK_INTERVAL)
+			So(msg.Trace.SpeedChecks(), ShouldHaveLength, 1)
+			So(saturatedScheduler.stats().Dropped, ShouldEqual, 1)
+			So(atomic.LoadInt32(&checker.checked), ShouldEqual, 0)
+
+			scheduler = newProbeScheduler(1, 0, config.DROP_NEWEST_QUEUE_DROP_POLICY, 0, 0)
+			So(SpeedCheckSync(context.Background(), msg, rr, cfg), ShouldEqual, 1)
+		})
+
+		Convey("canceled in queue", func() {
+			s := newProbeScheduler(1, 1, config.DROP_NEWEST_QUEUE_DROP_POLICY, 0, 0)
+			block := make(chan struct{})
+			started := make(chan struct{})
+			go s.do(context.Background(), "1.1.1.1", func() (int64, error) {
+				close(started)
+				<-block
+				return 1, nil
+			})
+			<-started
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := s.do(ctx, "1.1.1.1", probe)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(s.stats().Canceled, ShouldEqual, 1)
+			So(s.stats().Queued, ShouldEqual, 0)
+			close(block)
+			for s.stats().Inflight != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	})
+}
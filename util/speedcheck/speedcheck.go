@@ -2,27 +2,24 @@ package speedcheck
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"math"
-	"net"
-	"net/http"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
-	probing "github.com/prometheus-community/pro-bing"
 	"github.com/xsmartdns/xsmartdns/config"
 	"github.com/xsmartdns/xsmartdns/log"
+	"github.com/xsmartdns/xsmartdns/metrics"
 	"github.com/xsmartdns/xsmartdns/model"
 	"github.com/xsmartdns/xsmartdns/util"
 )
 
 const (
-	PING_TIMEOUT         = 2 * time.Second
 	SPEED_CHECK_INTERVAL = 200 * time.Millisecond
+	// the ip is not checked, such as the speed check disabled or the probes saturated
+	UNKNOWN_RT_MS = int64(-1)
 )
 
 type sppedTestResault struct {
@@ -30,14 +27,18 @@ type sppedTestResault struct {
 	err  error
 }
 
-// do speed check
+// the background probes running, key of ip and speed checks
+var backgroundProbes sync.Map
+
+// do speed check, UNKNOWN_RT_MS if not checked, math.MaxInt64 if all checks failed
 func SpeedCheckSync(ctx context.Context, msg *model.Message, rr dns.RR, cfg *config.Group) (rtMs int64) {
-	if len(cfg.SpeedChecks) == 0 {
-		return -1
+	if len(cfg.SpeedChecks) == 0 || cfg.SpeedChecks.Disabled() {
+		return UNKNOWN_RT_MS
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	host, _ := util.GetHost(msg.Msg)
 	ch := make(chan *sppedTestResault, len(cfg.SpeedChecks))
 	timers := make([]*time.Timer, 0, len(cfg.SpeedChecks))
 	for i, speedConfig := range cfg.SpeedChecks {
@@ -51,7 +52,11 @@ func SpeedCheckSync(ctx context.Context, msg *model.Message, rr dns.RR, cfg *con
 			case <-ctx.Done():
 				return
 			default:
-				rtMs, err := speedCheckSyncWithTimes(ctx, rr, speedConfig, speedCheckTimes)
+				rtMs, err := speedCheckSyncWithTimes(ctx, rr, host, speedConfig, speedCheckTimes)
+				msg.Trace.AddSpeedCheck(util.GetIp(rr), speedConfig.String(), rtMs, err)
+				if err == nil {
+					FeedLatency(util.GetIp(rr), speedConfig, rtMs)
+				}
 				ch <- &sppedTestResault{rtMs: rtMs, err: err}
 				if err == nil {
 					log.Infof("speed %s:%d check:[%s] avg %dms", speedConfig.SpeedCheckType, speedConfig.Port, rr.String(), rtMs)
@@ -68,15 +73,38 @@ func SpeedCheckSync(ctx context.Context, msg *model.Message, rr dns.RR, cfg *con
 		}
 	}()
 	rtMs = math.MaxInt64
-	for resault := range ch {
-		if resault.err == nil {
-			return resault.rtMs
+	// all checks failed or canceled
+	for range cfg.SpeedChecks {
+		select {
+		case resault := <-ch:
+			if resault.err == nil {
+				return resault.rtMs
+			}
+			// the next check type would be saturated too, the ip is not failed
+			if saturated(resault.err) {
+				return UNKNOWN_RT_MS
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 	return
 }
 
-func speedCheckSyncWithTimes(ctx context.Context, rr dns.RR, cfg *config.SpeedCheckConfig, times int32) (rtMsAvg int64, err error) {
+// speed check in background to fill the latency cache, skipped if the same ip is probing
+func SpeedCheckAsync(msg *model.Message, rr dns.RR, cfg *config.Group) {
+	key := util.GetIp(rr) + "|" + cfg.SpeedChecks.String()
+	if _, running := backgroundProbes.LoadOrStore(key, struct{}{}); running {
+		msg.Trace.Addf("speedCheck", "%s is probing in background", util.GetIp(rr))
+		return
+	}
+	go func() {
+		defer backgroundProbes.Delete(key)
+		SpeedCheckSync(context.Background(), msg, rr, cfg)
+	}()
+}
+
+func speedCheckSyncWithTimes(ctx context.Context, rr dns.RR, host string, cfg *config.SpeedCheckConfig, times int32) (rtMsAvg int64, err error) {
 	sum := int64(0)
 	succeedOnce := false
 	for i := int32(0); i < times; i++ {
@@ -93,7 +121,15 @@ func speedCheckSyncWithTimes(ctx context.Context, rr dns.RR, cfg *config.SpeedCh
 		}
 
 		var rtMs int64
-		rtMs, err = speedCheckSyncOne(ctx, rr, cfg)
+		rtMs, err = speedCheckSyncOne(ctx, rr, host, cfg)
+		if saturated(err) {
+			if !succeedOnce {
+				return 0, err
+			}
+			// average the checked ones
+			times = i
+			break
+		}
 		if err != nil {
 			rtMs = math.MaxInt32
 			log.Infof("speed[%d] %s:%d check:[%s] error:%v", i, cfg.SpeedCheckType, cfg.Port, rr.String(), err)
@@ -109,115 +145,23 @@ func speedCheckSyncWithTimes(ctx context.Context, rr dns.RR, cfg *config.SpeedCh
 	return int64(math.Ceil(float64(sum) / float64(times))), nil
 }
 
-func speedCheckSyncOne(ctx context.Context, rr dns.RR, cfg *config.SpeedCheckConfig) (rtMs int64, err error) {
-	if !util.IsIpsRR(rr) {
-		return 0, fmt.Errorf("rr type is not ips")
-	}
-	var ip string
-	switch rr.Header().Rrtype {
-	case dns.TypeA:
-		ip = rr.(*dns.A).A.String()
-	case dns.TypeAAAA:
-		ip = rr.(*dns.AAAA).AAAA.String()
-	default:
+func speedCheckSyncOne(ctx context.Context, rr dns.RR, host string, cfg *config.SpeedCheckConfig) (rtMs int64, err error) {
+	ip := util.GetIp(rr)
+	if len(ip) == 0 {
 		return 0, fmt.Errorf("fail ip type:%s to speed check", dns.Type(rr.Header().Rrtype).String())
 	}
-
-	switch cfg.SpeedCheckType {
-	case config.PING_SPEED_CHECK_TYPE:
-		return ping(ctx, ip)
-	case config.HTTP_SPEED_CHECK_TYPE:
-		return httping(ctx, ip+":"+strconv.FormatInt(cfg.Port, 10))
-	case config.TCP_SPEED_CHECK_TYPE:
-		return tcping(ctx, ip+":"+strconv.FormatInt(cfg.Port, 10))
-	}
-
-	return math.MaxInt32, fmt.Errorf("unkonw type")
-}
-
-func ping(ctx context.Context, ip string) (rtMs int64, err error) {
-	ctx, cancel := context.WithTimeout(ctx, PING_TIMEOUT)
-	defer cancel()
-
-	pinger, err := probing.NewPinger(ip)
-	if err != nil {
-		return 0, err
-	}
-	defer pinger.Stop()
-	go func() {
-		<-ctx.Done()
-		pinger.Stop()
-	}()
-	pinger.Count = 1
-	err = pinger.RunWithContext(ctx)
-	if err != nil {
-		return 0, err
-	}
-	stats := pinger.Statistics()
-
-	return stats.MaxRtt.Milliseconds(), nil
-}
-
-func tcping(ctx context.Context, address string) (rtMs int64, err error) {
-	ctx, cancel := context.WithTimeout(ctx, PING_TIMEOUT)
-	defer cancel()
-
-	// start time
-	start := time.Now()
-	dialer := net.Dialer{
-		Timeout:   PING_TIMEOUT,
-		KeepAlive: -1 * time.Second,
-	}
-
-	conn, err := dialer.DialContext(ctx, "tcp", address)
-	if err != nil {
-		return 0, fmt.Errorf("tcping connection:%s error:%v", address, err)
+	checker, ok := GetChecker(cfg.SpeedCheckType)
+	if !ok {
+		return math.MaxInt32, fmt.Errorf("unkonw type:%s", cfg.SpeedCheckType)
 	}
-	defer conn.Close()
-
-	// cost time
-	elapsed := time.Since(start)
-
-	return elapsed.Milliseconds(), nil
+	return scheduler.do(ctx, ip, func() (int64, error) {
+		rtMs, err := checker.Check(ctx, &Target{Ip: ip, Host: host, Cfg: cfg})
+		metrics.ObserveSpeedCheck(string(cfg.SpeedCheckType), rtMs, err)
+		return rtMs, err
+	})
 }
 
-func httping(ctx context.Context, address string) (rtMs int64, err error) {
-	ctx, cancel := context.WithTimeout(ctx, PING_TIMEOUT)
-	defer cancel()
-
-	dialer := &net.Dialer{
-		Timeout:   PING_TIMEOUT,
-		KeepAlive: -1 * time.Second,
-	}
-	client := http.Client{
-		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			DialContext:           dialer.DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          1,
-			IdleConnTimeout:       PING_TIMEOUT,
-			TLSHandshakeTimeout:   PING_TIMEOUT,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: PING_TIMEOUT,
-	}
-
-	// start time
-	start := time.Now()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address, nil)
-	if err != nil {
-		return 0, fmt.Errorf("httping create request:%s error:%v", address, err)
-	}
-	// req.Host = host
-	resp, err := client.Do(req)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return 0, fmt.Errorf("httping connection:%s error:%v", address, err)
-	}
-	if resp != nil {
-		resp.Body.Close()
-	}
-	elapsed := time.Since(start)
-
-	return elapsed.Milliseconds(), nil
+// the probe is not run by the scheduler
+func saturated(err error) bool {
+	return errors.Is(err, ErrProbeRateLimited) || errors.Is(err, ErrProbeDropped)
 }
@@ -0,0 +1,42 @@
+package speedcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func init() {
+	Register(config.TCP_SPEED_CHECK_TYPE, &tcpChecker{})
+}
+
+type tcpChecker struct {
+}
+
+func (c *tcpChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := target.Address()
+	// start time
+	start := time.Now()
+	dialer := net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: -1 * time.Second,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, fmt.Errorf("tcping connection:%s error:%v", address, err)
+	}
+	defer conn.Close()
+
+	// cost time
+	elapsed := time.Since(start)
+
+	return elapsed.Milliseconds(), nil
+}
@@ -0,0 +1,48 @@
+package speedcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xsmartdns/xsmartdns/config"
+)
+
+func init() {
+	Register(config.TLS_SPEED_CHECK_TYPE, &tlsChecker{})
+}
+
+// rt of tcp connect and tls handshake with the queried host as SNI
+type tlsChecker struct {
+}
+
+func (c *tlsChecker) Check(ctx context.Context, target *Target) (rtMs int64, err error) {
+	timeout := target.Timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	address := target.Address()
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: -1 * time.Second,
+		},
+		Config: &tls.Config{
+			ServerName:         target.Host,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		},
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, fmt.Errorf("tls handshake:%s sni:%s error:%v", address, target.Host, err)
+	}
+	defer conn.Close()
+	elapsed := time.Since(start)
+
+	return elapsed.Milliseconds(), nil
+}